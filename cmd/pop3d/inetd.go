@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"time"
+
+	"github.com/infodancer/pop3d/internal/config"
+	"github.com/infodancer/pop3d/internal/pop3"
+)
+
+// runInetd serves a single POP3 session on stdin/stdout, for inetd or a
+// systemd socket with Accept=yes. Listeners in the configuration are ignored.
+func runInetd() {
+	mode := flag.String("mode", string(config.ModePop3), "Session mode (pop3, pop3s)")
+	flags := config.ParseFlags()
+
+	cfg, err := config.LoadWithFlags(flags)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error loading config: %v\n", err)
+		os.Exit(1)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "invalid configuration: %v\n", err)
+		os.Exit(1)
+	}
+
+	listenerMode := config.ListenerMode(*mode)
+	if listenerMode != config.ModePop3 && listenerMode != config.ModePop3s {
+		fmt.Fprintf(os.Stderr, "invalid mode %q (valid: pop3, pop3s)\n", *mode)
+		os.Exit(1)
+	}
+
+	// stdout carries the session, so logs go to stderr.
+	var level slog.Level
+	_ = level.UnmarshalText([]byte(cfg.LogLevel))
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+	logWarnings(logger, &cfg)
+
+	tlsConfig, _, err := loadTLSConfig(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+
+	stack, err := pop3.NewStack(pop3.StackConfig{
+		Config:    cfg,
+		TLSConfig: tlsConfig,
+		Logger:    logger,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error creating stack: %v\n", err)
+		os.Exit(1)
+	}
+	defer func() {
+		if err := stack.Close(); err != nil {
+			logger.Error("error closing stack", "error", err)
+		}
+	}()
+
+	conn := stdioConn()
+	if err := stack.RunSingleConn(conn, listenerMode, tlsConfig); err != nil {
+		logger.Error("session error", "error", err)
+		_ = conn.Close()
+		os.Exit(1)
+	}
+	_ = conn.Close()
+}
+
+// stdioConn returns the connection on stdin. inetd passes a socket, which
+// gives the client's address; anything else is served as a plain stream.
+func stdioConn() net.Conn {
+	if c, err := net.FileConn(os.Stdin); err == nil {
+		return c
+	}
+	return &streamConn{in: os.Stdin, out: os.Stdout}
+}
+
+// streamConn is a net.Conn over a pair of files that are not sockets.
+type streamConn struct {
+	in  *os.File
+	out *os.File
+}
+
+func (c *streamConn) Read(b []byte) (int, error)  { return c.in.Read(b) }
+func (c *streamConn) Write(b []byte) (int, error) { return c.out.Write(b) }
+
+func (c *streamConn) Close() error {
+	return errors.Join(c.in.Close(), c.out.Close())
+}
+
+func (c *streamConn) LocalAddr() net.Addr  { return stdioAddr{} }
+func (c *streamConn) RemoteAddr() net.Addr { return stdioAddr{} }
+
+// Deadlines apply only where the files support them (pipes do, terminals
+// and regular files may not); elsewhere they are ignored.
+func (c *streamConn) SetDeadline(t time.Time) error {
+	return errors.Join(c.SetReadDeadline(t), c.SetWriteDeadline(t))
+}
+
+func (c *streamConn) SetReadDeadline(t time.Time) error {
+	return ignoreNoDeadline(c.in.SetReadDeadline(t))
+}
+
+func (c *streamConn) SetWriteDeadline(t time.Time) error {
+	return ignoreNoDeadline(c.out.SetWriteDeadline(t))
+}
+
+func ignoreNoDeadline(err error) error {
+	if errors.Is(err, os.ErrNoDeadline) {
+		return nil
+	}
+	return err
+}
+
+// stdioAddr is the address of a session on stdin/stdout.
+type stdioAddr struct{}
+
+func (stdioAddr) Network() string { return "stdio" }
+func (stdioAddr) String() string  { return "stdio" }
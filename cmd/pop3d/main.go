@@ -19,8 +19,10 @@ func main() {
 	switch subcommand {
 	case "", "serve":
 		runServe()
+	case "inetd":
+		runInetd()
 	default:
-		fmt.Fprintf(os.Stderr, "unknown subcommand %q\nusage: pop3d [serve] [flags]\n", subcommand)
+		fmt.Fprintf(os.Stderr, "unknown subcommand %q\nusage: pop3d [serve|inetd] [flags]\n", subcommand)
 		os.Exit(1)
 	}
 }
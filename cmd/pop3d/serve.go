@@ -3,7 +3,9 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"log/slog"
 	"os"
 	"os/signal"
 	"syscall"
@@ -12,6 +14,8 @@ import (
 	"github.com/infodancer/pop3d/internal/config"
 	"github.com/infodancer/pop3d/internal/metrics"
 	"github.com/infodancer/pop3d/internal/pop3"
+	"github.com/infodancer/pop3d/internal/server"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 func runServe() {
@@ -29,34 +33,31 @@ func runServe() {
 	}
 
 	logger := logging.NewLogger(cfg.LogLevel)
+	logWarnings(logger, &cfg)
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-	go func() {
-		sig := <-sigChan
-		logger.Info("received signal, shutting down", "signal", sig.String())
-		cancel()
-	}()
 
-	// Load TLS configuration if specified.
-	var tlsConfig *tls.Config
-	if cfg.TLS.CertFile != "" && cfg.TLS.KeyFile != "" {
-		cert, err := tls.LoadX509KeyPair(cfg.TLS.CertFile, cfg.TLS.KeyFile)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "error loading TLS certificate: %v\n", err)
-			os.Exit(1)
-		}
-		tlsConfig = &tls.Config{
-			Certificates: []tls.Certificate{cert},
-			MinVersion:   cfg.TLS.MinTLSVersion(),
-		}
+	tlsConfig, certs, err := loadTLSConfig(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+
+	// Adopt listening sockets from systemd socket activation, if any.
+	activated, err := server.ActivationListeners()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error adopting systemd sockets: %v\n", err)
+		os.Exit(1)
 	}
 
 	// Metrics HTTP server.
+	var collector metrics.Collector
 	if cfg.Metrics.Enabled {
+		collector = metrics.NewPrometheusCollector(prometheus.DefaultRegisterer)
 		metricsServer := metrics.NewPrometheusServer(cfg.Metrics.Address, cfg.Metrics.Path)
 		go func() {
 			if err := metricsServer.Start(ctx); err != nil && err != context.Canceled {
@@ -65,14 +66,22 @@ func runServe() {
 		}()
 	}
 
-	logger.Info("starting pop3d",
-		"hostname", cfg.Hostname,
-		"listeners", len(cfg.Listeners))
+	if len(activated) > 0 {
+		logger.Info("starting pop3d",
+			"hostname", cfg.Hostname,
+			"activated_sockets", len(activated))
+	} else {
+		logger.Info("starting pop3d",
+			"hostname", cfg.Hostname,
+			"listeners", len(cfg.Listeners))
+	}
 
 	stack, err := pop3.NewStack(pop3.StackConfig{
 		Config:    cfg,
 		TLSConfig: tlsConfig,
+		Collector: collector,
 		Logger:    logger,
+		Activated: activated,
 	})
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error creating stack: %v\n", err)
@@ -84,6 +93,28 @@ func runServe() {
 		}
 	}()
 
+	// The drain period is the one in force at shutdown, after any reload.
+	go func() {
+		sig := <-sigChan
+		logger.Info("received signal, shutting down",
+			"signal", sig.String(),
+			"drain", stack.DrainTimeout().String())
+		cancel()
+	}()
+
+	// SIGHUP reloads the configuration file and certificate.
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP)
+	go func() {
+		for range hupChan {
+			if err := reload(flags, cfg.TLS, certs, stack, logger); err != nil {
+				logger.Error("reload failed, keeping current configuration", "error", err)
+				continue
+			}
+			logger.Info("reload complete")
+		}
+	}()
+
 	if err := stack.Run(ctx); err != nil && err != context.Canceled {
 		fmt.Fprintf(os.Stderr, "server error: %v\n", err)
 		os.Exit(1)
@@ -91,3 +122,103 @@ func runServe() {
 
 	logger.Info("POP3 server stopped")
 }
+
+// reload re-reads the configuration and certificate and applies them to the
+// running stack. Nothing is changed if either is invalid. running holds the
+// TLS settings the server was started with; only the certificates can change
+// without a restart.
+func reload(flags *config.Flags, running config.TLSConfig, certs *server.CertificateStore, stack *pop3.Stack, logger *slog.Logger) error {
+	cfg, err := config.LoadWithFlags(flags)
+	if err != nil {
+		return fmt.Errorf("loading config: %w", err)
+	}
+	if err := cfg.Validate(); err != nil {
+		return fmt.Errorf("invalid configuration: %w", err)
+	}
+
+	certificates, err := loadCertificates(cfg)
+	if err != nil {
+		return err
+	}
+	if (len(certificates) > 0) != (certs != nil) {
+		return fmt.Errorf("enabling or disabling TLS requires a restart")
+	}
+	// The client CA pool and minimum version are fixed in the tls.Config
+	// the listeners share.
+	if cfg.TLS.ClientCAFile != running.ClientCAFile {
+		return fmt.Errorf("changing tls client_ca_file requires a restart")
+	}
+	if cfg.TLS.MinTLSVersion() != running.MinTLSVersion() {
+		return fmt.Errorf("changing tls min_version requires a restart")
+	}
+	// Parse the certificates before anything is applied, so that the swap
+	// after the stack has reloaded cannot fail.
+	if certs != nil {
+		if certificates, err = server.ParseCertificates(certificates); err != nil {
+			return fmt.Errorf("error loading TLS certificate: %w", err)
+		}
+	}
+
+	if err := stack.Reload(cfg); err != nil {
+		return err
+	}
+	if certs != nil {
+		certs.Set(certificates)
+	}
+	logWarnings(logger, &cfg)
+	return nil
+}
+
+// logWarnings logs the settings that cfg adjusts rather than rejects.
+func logWarnings(logger *slog.Logger, cfg *config.Config) {
+	for _, w := range cfg.Warnings() {
+		logger.Warn("configuration adjusted", "warning", w)
+	}
+}
+
+// loadCertificates loads every configured certificate, the default first.
+func loadCertificates(cfg config.Config) ([]tls.Certificate, error) {
+	var certs []tls.Certificate
+	for _, pair := range cfg.TLS.CertificatePairs() {
+		cert, err := tls.LoadX509KeyPair(pair.CertFile, pair.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading TLS certificate %s: %w", pair.CertFile, err)
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// loadTLSConfig loads the certificates and client CA pool named in the
+// configuration. Certificates are served from the returned store, selected
+// by SNI, so that they can be replaced on reload. It returns nil if no
+// certificate is configured.
+func loadTLSConfig(cfg config.Config) (*tls.Config, *server.CertificateStore, error) {
+	certificates, err := loadCertificates(cfg)
+	if err != nil || len(certificates) == 0 {
+		return nil, nil, err
+	}
+	certs, err := server.NewCertificateStore(certificates)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error loading TLS certificate: %w", err)
+	}
+	tlsConfig := &tls.Config{
+		GetCertificate: certs.GetCertificate,
+		MinVersion:     cfg.TLS.MinTLSVersion(),
+	}
+
+	// Client certificates are requested per listener (client_auth);
+	// the CA pool to verify them against is shared.
+	if cfg.TLS.ClientCAFile != "" {
+		pem, err := os.ReadFile(cfg.TLS.ClientCAFile)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error loading client CA file: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, nil, fmt.Errorf("error loading client CA file: no certificates found")
+		}
+		tlsConfig.ClientCAs = pool
+	}
+	return tlsConfig, certs, nil
+}
@@ -5,6 +5,11 @@ import (
 	"crypto/tls"
 	"errors"
 	"fmt"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -16,6 +21,9 @@ const (
 	ModePop3 ListenerMode = "pop3"
 	// ModePop3s is implicit TLS on port 995.
 	ModePop3s ListenerMode = "pop3s"
+	// ModeUnix is POP3 on a Unix-domain socket, for clients on the same
+	// host. The address is the socket path.
+	ModeUnix ListenerMode = "unix"
 )
 
 // FileConfig is the top-level wrapper for the shared configuration file.
@@ -60,20 +68,120 @@ type ServerConfig struct {
 
 // Config holds the POP3-specific server configuration.
 type Config struct {
-	Hostname       string               `toml:"hostname"`
-	LogLevel       string               `toml:"log_level"`
-	Listeners      []ListenerConfig     `toml:"listeners"`
-	TLS            TLSConfig            `toml:"tls"`
-	Timeouts       TimeoutsConfig       `toml:"timeouts"`
-	Limits         LimitsConfig         `toml:"limits"`
-	Metrics        MetricsConfig        `toml:"metrics"`
-	SessionManager SessionManagerConfig `toml:"-"` // populated from [session-manager] top-level section
+	Hostname       string                  `toml:"hostname"`
+	LogLevel       string                  `toml:"log_level"`
+	Access         []string                `toml:"access"`
+	Listeners      []ListenerConfig        `toml:"listeners"`
+	TLS            TLSConfig               `toml:"tls"`
+	Timeouts       TimeoutsConfig          `toml:"timeouts"`
+	Limits         LimitsConfig            `toml:"limits"`
+	Metrics        MetricsConfig           `toml:"metrics"`
+	SASL           SASLConfig              `toml:"sasl"`
+	Lock           LockConfig              `toml:"lock"`
+	Policy         PolicyConfig            `toml:"policy"`
+	AuthThrottle   AuthThrottleConfig      `toml:"auth_throttle"`
+	Subaddress     SubaddressConfig        `toml:"subaddress"`
+	Aggregate      AggregateConfig         `toml:"aggregate"`
+	Domains        map[string]DomainConfig `toml:"domains"`
+	SessionManager SessionManagerConfig    `toml:"-"` // populated from [session-manager] top-level section
 }
 
 // ListenerConfig defines settings for a single listener.
 type ListenerConfig struct {
 	Address string       `toml:"address"`
 	Mode    ListenerMode `toml:"mode"`
+
+	// ClientAuth controls TLS client certificates on this listener:
+	// "none" (default), "request" (verified if presented) or "require".
+	ClientAuth string `toml:"client_auth"`
+
+	// ProxyProtocol expects a PROXY protocol v1 or v2 header, sent before
+	// the greeting (and before the TLS handshake on pop3s listeners), from
+	// peers in ProxyTrusted (CIDRs). Other peers are served directly.
+	ProxyProtocol bool     `toml:"proxy_protocol"`
+	ProxyTrusted  []string `toml:"proxy_trusted"`
+
+	// Hostname is used in the greeting instead of the server hostname.
+	Hostname string `toml:"hostname"`
+
+	// By default, logins without TLS are allowed only if no TLS is
+	// configured. AllowInsecureAuth allows them anyway, e.g. on a LAN
+	// listener; RequireTLSForAuth refuses them even without TLS configured
+	// (unless a trusted proxy terminated TLS).
+	AllowInsecureAuth bool `toml:"allow_insecure_auth"`
+	RequireTLSForAuth bool `toml:"require_tls_for_auth"`
+
+	// MaxConnections limits the listener's connections, within the
+	// server-wide limit. Zero means only the server-wide limit applies.
+	MaxConnections int `toml:"max_connections"`
+
+	// Timeouts overrides the server timeouts; empty fields inherit.
+	Timeouts TimeoutsConfig `toml:"timeouts"`
+
+	// Mechanisms limits the SASL mechanisms offered; empty offers all
+	// enabled ones.
+	Mechanisms []string `toml:"mechanisms"`
+
+	// SocketMode and SocketGroup set the permissions of a unix listener's
+	// socket file: an octal mode (default "0660") and a group name or ID.
+	SocketMode  string `toml:"socket_mode"`
+	SocketGroup string `toml:"socket_group"`
+
+	// Access is an ordered list of rules for the client addresses this
+	// listener accepts, checked after the server-wide rules.
+	Access []string `toml:"access"`
+}
+
+// SocketPermissions returns the file mode of a unix listener's socket.
+func (l *ListenerConfig) SocketPermissions() os.FileMode {
+	if l.SocketMode == "" {
+		return 0o660
+	}
+	mode, err := strconv.ParseUint(l.SocketMode, 8, 32)
+	if err != nil {
+		return 0o660
+	}
+	return os.FileMode(mode) & os.ModePerm
+}
+
+// EffectiveTimeouts returns the listener's timeouts: its own where set,
+// otherwise the server's.
+func (l *ListenerConfig) EffectiveTimeouts(server TimeoutsConfig) TimeoutsConfig {
+	t := server
+	if l.Timeouts.PreAuth != "" {
+		t.PreAuth = l.Timeouts.PreAuth
+	}
+	if l.Timeouts.Connection != "" {
+		t.Connection = l.Timeouts.Connection
+	}
+	if l.Timeouts.Command != "" {
+		t.Command = l.Timeouts.Command
+	}
+	if l.Timeouts.Idle != "" {
+		t.Idle = l.Timeouts.Idle
+	}
+	if l.Timeouts.Write != "" {
+		t.Write = l.Timeouts.Write
+	}
+	if l.Timeouts.Session != "" {
+		t.Session = l.Timeouts.Session
+	}
+	if l.Timeouts.Drain != "" {
+		t.Drain = l.Timeouts.Drain
+	}
+	return t
+}
+
+// ClientAuthType returns the crypto/tls client authentication policy for the listener.
+func (l *ListenerConfig) ClientAuthType() tls.ClientAuthType {
+	switch l.ClientAuth {
+	case "request":
+		return tls.VerifyClientCertIfGiven
+	case "require":
+		return tls.RequireAndVerifyClientCert
+	default:
+		return tls.NoClientCert
+	}
 }
 
 // TLSConfig holds TLS certificate and version settings.
@@ -81,20 +189,199 @@ type TLSConfig struct {
 	CertFile   string `toml:"cert_file"`
 	KeyFile    string `toml:"key_file"`
 	MinVersion string `toml:"min_version"`
+
+	// ClientCAFile is the CA bundle used to verify client certificates on
+	// listeners with client_auth enabled.
+	ClientCAFile string `toml:"client_ca_file"`
+
+	// Certificates are served in addition to CertFile/KeyFile, selected by
+	// the name the client asks for (SNI).
+	Certificates []CertificateConfig `toml:"certificates"`
+}
+
+// CertificateConfig names a certificate and its private key.
+type CertificateConfig struct {
+	CertFile string `toml:"cert_file"`
+	KeyFile  string `toml:"key_file"`
+}
+
+// CertificatePairs returns all configured certificates: cert_file/key_file
+// first, as the default for clients that send no matching name, then the
+// certificates list.
+func (c *TLSConfig) CertificatePairs() []CertificateConfig {
+	var pairs []CertificateConfig
+	if c.CertFile != "" && c.KeyFile != "" {
+		pairs = append(pairs, CertificateConfig{CertFile: c.CertFile, KeyFile: c.KeyFile})
+	}
+	return append(pairs, c.Certificates...)
+}
+
+// DomainConfig sets up a virtual host: a customer domain served from the
+// same listeners, recognised by the name the client asks for in TLS (SNI).
+type DomainConfig struct {
+	// Hostname is used in the greeting instead of the server hostname.
+	Hostname string `toml:"hostname"`
+
+	// LoginDomain is appended to usernames given without a domain, e.g.
+	// "alice" logs in as "alice@example.com".
+	LoginDomain string `toml:"login_domain"`
+
+	// Mechanisms limits the SASL mechanisms offered; empty offers all
+	// enabled ones.
+	Mechanisms []string `toml:"mechanisms"`
+
+	// RestrictLogins refuses logins for users of other domains.
+	RestrictLogins bool `toml:"restrict_logins"`
+
+	// Access is an ordered list of rules for the client addresses the
+	// domain's users may log in from, on any listener.
+	Access []string `toml:"access"`
+}
+
+// AccessRule allows or denies the client addresses in Prefix. A rule for
+// "all" has an invalid (zero) Prefix and matches every address.
+type AccessRule struct {
+	Allow  bool
+	Prefix netip.Prefix
+}
+
+// ParseAccessRules parses an ordered list of access rules, each of the form
+// "allow <cidr>" or "deny <cidr>", where the CIDR may also be a single
+// address or "all".
+func ParseAccessRules(rules []string) ([]AccessRule, error) {
+	parsed := make([]AccessRule, 0, len(rules))
+	for _, r := range rules {
+		fields := strings.Fields(r)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid access rule %q (want \"allow|deny <cidr>\")", r)
+		}
+		var rule AccessRule
+		switch strings.ToLower(fields[0]) {
+		case "allow":
+			rule.Allow = true
+		case "deny":
+		default:
+			return nil, fmt.Errorf("invalid access rule %q: unknown action %q", r, fields[0])
+		}
+		if !strings.EqualFold(fields[1], "all") {
+			prefix, err := parseAccessPrefix(fields[1])
+			if err != nil {
+				return nil, fmt.Errorf("invalid access rule %q: %w", r, err)
+			}
+			rule.Prefix = prefix
+		}
+		parsed = append(parsed, rule)
+	}
+	return parsed, nil
+}
+
+// parseAccessPrefix parses a CIDR or a single address.
+func parseAccessPrefix(s string) (netip.Prefix, error) {
+	if strings.Contains(s, "/") {
+		prefix, err := netip.ParsePrefix(s)
+		if err != nil {
+			return netip.Prefix{}, err
+		}
+		return prefix.Masked(), nil
+	}
+	addr, err := netip.ParseAddr(s)
+	if err != nil {
+		return netip.Prefix{}, err
+	}
+	addr = addr.Unmap()
+	return netip.PrefixFrom(addr, addr.BitLen()), nil
+}
+
+// Matches reports whether the rule applies to ip.
+func (r AccessRule) Matches(ip netip.Addr) bool {
+	return !r.Prefix.IsValid() || r.Prefix.Contains(ip.Unmap())
+}
+
+// String returns the rule in configuration form.
+func (r AccessRule) String() string {
+	action := "deny"
+	if r.Allow {
+		action = "allow"
+	}
+	if !r.Prefix.IsValid() {
+		return action + " all"
+	}
+	return action + " " + r.Prefix.String()
 }
 
 // TimeoutsConfig defines timeout durations.
 type TimeoutsConfig struct {
+	// PreAuth is how long to wait for each command before the client has
+	// logged in; short, to get rid of scanners. Command is its former name
+	// and applies if PreAuth is not set.
+	PreAuth string `toml:"pre_auth"`
+	Command string `toml:"command"`
+
+	// Idle is how long a logged-in session may wait between commands;
+	// RFC 1939 requires at least 10 minutes.
+	Idle string `toml:"idle"`
+
+	// Write is how long a write to the client may stall.
+	Write string `toml:"write"`
+
+	// Session caps the lifetime of a session; empty means no limit.
+	Session string `toml:"session"`
+
+	// Connection is no longer used; Idle and Session replace it.
 	Connection string `toml:"connection"`
-	Command    string `toml:"command"`
-	Idle       string `toml:"idle"`
+
+	// Drain is how long sessions may take to finish on shutdown before they
+	// are closed.
+	Drain string `toml:"drain"`
 }
 
 // LimitsConfig defines resource limits for the server.
 type LimitsConfig struct {
 	MaxConnections int `toml:"max_connections"`
+
+	// MaxPerIP and MaxPerNetwork cap the concurrent connections from one
+	// client address and from one /24 (IPv4) or /64 (IPv6) network.
+	// Zero means no cap.
+	MaxPerIP      int `toml:"max_per_ip"`
+	MaxPerNetwork int `toml:"max_per_network"`
+
+	// ConnectionRate is how many new connections per minute a client
+	// address may open, in bursts of up to ConnectionBurst (default: the
+	// rate). Zero means no rate limit.
+	ConnectionRate  int `toml:"connection_rate"`
+	ConnectionBurst int `toml:"connection_burst"`
+
+	// Exempt lists CIDRs, such as monitoring and webmail hosts, that the
+	// per-address limits do not apply to.
+	Exempt []string `toml:"exempt"`
+
+	// MaxSessionsPerUser and MaxSessionsPerDomain cap the concurrent
+	// logged-in sessions of one user and of all users of one domain.
+	// Zero means no cap.
+	MaxSessionsPerUser   int `toml:"max_sessions_per_user"`
+	MaxSessionsPerDomain int `toml:"max_sessions_per_domain"`
+
+	// MaxAuthLine is the longest AUTH command line or SASL response a
+	// client may send, in octets including CRLF; other commands are held
+	// to the RFC 2449 limit of 255. Zero means DefaultMaxAuthLine.
+	MaxAuthLine int `toml:"max_auth_line"`
+
+	// MaxBadCommands is how many unknown, invalid or overlong commands end
+	// a session. Zero means no limit.
+	MaxBadCommands int `toml:"max_bad_commands"`
 }
 
+// Command line limits.
+const (
+	// MaxCommandLine is the RFC 2449 limit on a command line, in octets
+	// including CRLF.
+	MaxCommandLine = 255
+
+	// DefaultMaxAuthLine is the default limit on AUTH command lines and
+	// SASL responses, which may carry large tokens.
+	DefaultMaxAuthLine = 8192
+)
+
 // MetricsConfig holds configuration for Prometheus metrics.
 type MetricsConfig struct {
 	Enabled bool   `toml:"enabled"`
@@ -102,6 +389,218 @@ type MetricsConfig struct {
 	Path    string `toml:"path"`
 }
 
+// SASLConfig controls the optional SASL mechanisms offered by AUTH.
+// PLAIN is always offered.
+type SASLConfig struct {
+	// Login enables the legacy LOGIN mechanism for clients that support
+	// nothing else. Off by default.
+	Login bool `toml:"login"`
+}
+
+// Maildrop lock policies.
+const (
+	// LockPolicyReject refuses a second login with -ERR [IN-USE].
+	LockPolicyReject = "reject"
+	// LockPolicyTakeover ends the older session and lets the new one in.
+	LockPolicyTakeover = "takeover"
+)
+
+// LockConfig controls the exclusive maildrop lock (RFC 1939 section 4) held
+// by each session in the TRANSACTION state.
+type LockConfig struct {
+	// Policy decides what happens when a user logs in while another session
+	// holds their maildrop: "reject" (default) or "takeover".
+	Policy string `toml:"policy"`
+}
+
+// LockPolicy returns the configured policy, or LockPolicyReject.
+func (c *LockConfig) LockPolicy() string {
+	if c.Policy == "" {
+		return LockPolicyReject
+	}
+	return c.Policy
+}
+
+// Folder case folding rules for subaddressed logins.
+const (
+	FolderCasePreserve = "preserve"
+	FolderCaseLower    = "lower"
+	FolderCaseUpper    = "upper"
+	FolderCaseTitle    = "title"
+)
+
+// SubaddressConfig controls user+folder@domain logins, which authenticate as
+// user@domain and present the folder as the maildrop.
+type SubaddressConfig struct {
+	// Separator lists the characters that may separate the user from the
+	// folder, e.g. "+" or "+-". Empty disables subaddressing.
+	Separator string `toml:"separator"`
+
+	// FolderCase folds the folder name: "preserve" (default), "lower",
+	// "upper" or "title" (first letter upper case, the rest lower case).
+	FolderCase string `toml:"folder_case"`
+}
+
+// AggregateConfig merges folders into the inbox maildrop, for users whose
+// mail is filtered into folders but whose POP3 client only sees the inbox.
+type AggregateConfig struct {
+	// Folders lists the folders merged after the inbox. Empty disables
+	// aggregation.
+	Folders []string `toml:"folders"`
+
+	// Header names a header added to merged messages giving their folder,
+	// e.g. "X-Folder". Empty adds none.
+	Header string `toml:"header"`
+}
+
+// validate checks the folder names and header.
+func (c *AggregateConfig) validate() error {
+	seen := make(map[string]bool, len(c.Folders))
+	for _, f := range c.Folders {
+		if f == "" || strings.EqualFold(f, "INBOX") || strings.ContainsAny(f, "\r\n") {
+			return fmt.Errorf("invalid aggregate folder %q", f)
+		}
+		if seen[f] {
+			return fmt.Errorf("duplicate aggregate folder %q", f)
+		}
+		seen[f] = true
+	}
+	for _, r := range c.Header {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-') {
+			return fmt.Errorf("invalid aggregate header %q", c.Header)
+		}
+	}
+	return nil
+}
+
+// PolicyConfig sets the RFC 2449 LOGIN-DELAY and EXPIRE policies. The
+// top-level values apply to everyone; Domains and Users override them.
+type PolicyConfig struct {
+	// LoginDelay is the minimum time between logins, e.g. "5m".
+	LoginDelay string `toml:"login_delay"`
+
+	// Expire is the number of days a retrieved message is kept before it is
+	// deleted server-side, or "never" (the default).
+	Expire string `toml:"expire"`
+
+	// RecordFile stores last-login and retrieval times across restarts.
+	// Required when messages expire.
+	RecordFile string `toml:"record_file"`
+
+	// Domains overrides the policy for all users of a domain.
+	Domains map[string]PolicyOverride `toml:"domains"`
+
+	// Users overrides the policy for single users.
+	Users map[string]PolicyOverride `toml:"users"`
+}
+
+// AuthThrottleConfig slows down and bans clients that repeatedly fail to log
+// in. Failures are counted per client address and per username, across
+// sessions.
+type AuthThrottleConfig struct {
+	// Delay is added before the reply to a failed login and doubles with
+	// each further recent failure, up to MaxDelay. Defaults: 1s and 30s.
+	Delay    string `toml:"delay"`
+	MaxDelay string `toml:"max_delay"`
+
+	// MaxFailures ends a session after that many failed logins. Zero
+	// means no limit.
+	MaxFailures int `toml:"max_failures"`
+
+	// BanThreshold bans an address for BanDuration (default 1h) after that
+	// many failures within Window (default 15m). Zero disables bans.
+	BanThreshold int    `toml:"ban_threshold"`
+	Window       string `toml:"window"`
+	BanDuration  string `toml:"ban_duration"`
+
+	// StateFile keeps bans across restarts. Empty keeps them in memory.
+	StateFile string `toml:"state_file"`
+}
+
+// IsEnabled returns true if login throttling is configured.
+func (c *AuthThrottleConfig) IsEnabled() bool {
+	return *c != AuthThrottleConfig{}
+}
+
+// validate checks the durations and counts.
+func (c *AuthThrottleConfig) validate() error {
+	for name, v := range map[string]string{
+		"delay":        c.Delay,
+		"max_delay":    c.MaxDelay,
+		"window":       c.Window,
+		"ban_duration": c.BanDuration,
+	} {
+		if v == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(v); err != nil || d < 0 {
+			return fmt.Errorf("auth_throttle: invalid %s %q", name, v)
+		}
+	}
+	if c.MaxFailures < 0 || c.BanThreshold < 0 {
+		return errors.New("auth_throttle: max_failures and ban_threshold must not be negative")
+	}
+	return nil
+}
+
+// PolicyOverride replaces parts of the default policy. Empty fields inherit.
+type PolicyOverride struct {
+	LoginDelay string `toml:"login_delay"`
+	Expire     string `toml:"expire"`
+}
+
+// IsEnabled returns true if any LOGIN-DELAY or EXPIRE policy is configured.
+func (c *PolicyConfig) IsEnabled() bool {
+	return c.LoginDelay != "" || c.Expire != "" || len(c.Domains) > 0 || len(c.Users) > 0
+}
+
+// ParseExpire parses an expire setting into days; "never" is -1.
+func ParseExpire(s string) (int, error) {
+	if strings.EqualFold(s, "never") {
+		return -1, nil
+	}
+	days, err := strconv.Atoi(s)
+	if err != nil || days < 0 {
+		return 0, fmt.Errorf("invalid expire %q (want days or \"never\")", s)
+	}
+	return days, nil
+}
+
+// validate checks the policy settings.
+func (c *PolicyConfig) validate() error {
+	overrides := map[string]PolicyOverride{"": {LoginDelay: c.LoginDelay, Expire: c.Expire}}
+	for d, o := range c.Domains {
+		overrides["domain "+d] = o
+	}
+	for u, o := range c.Users {
+		overrides["user "+u] = o
+	}
+
+	expires := false
+	for name, o := range overrides {
+		prefix := "policy"
+		if name != "" {
+			prefix += " " + name
+		}
+		if o.LoginDelay != "" {
+			if d, err := time.ParseDuration(o.LoginDelay); err != nil || d < 0 {
+				return fmt.Errorf("%s: invalid login_delay %q", prefix, o.LoginDelay)
+			}
+		}
+		if o.Expire != "" {
+			days, err := ParseExpire(o.Expire)
+			if err != nil {
+				return fmt.Errorf("%s: %w", prefix, err)
+			}
+			expires = expires || days >= 0
+		}
+	}
+	if expires && c.RecordFile == "" {
+		return errors.New("policy: expire requires record_file")
+	}
+	return nil
+}
+
 // Default returns a Config with sensible default values.
 func Default() Config {
 	return Config{
@@ -117,6 +616,7 @@ func Default() Config {
 			Connection: "10m",
 			Command:    "1m",
 			Idle:       "30m",
+			Drain:      "30s",
 		},
 		Limits: LimitsConfig{
 			MaxConnections: 100,
@@ -146,36 +646,134 @@ func (c *Config) Validate() error {
 		if !isValidMode(l.Mode) {
 			return fmt.Errorf("listener %d: invalid mode %q", i, l.Mode)
 		}
+		switch l.ClientAuth {
+		case "", "none":
+		case "request", "require":
+			if c.TLS.ClientCAFile == "" {
+				return fmt.Errorf("listener %d: client_auth requires tls client_ca_file", i)
+			}
+		default:
+			return fmt.Errorf("listener %d: invalid client_auth %q", i, l.ClientAuth)
+		}
+		if l.ProxyProtocol && len(l.ProxyTrusted) == 0 {
+			return fmt.Errorf("listener %d: proxy_protocol requires proxy_trusted", i)
+		}
+		for _, cidr := range l.ProxyTrusted {
+			if _, err := netip.ParsePrefix(cidr); err != nil {
+				return fmt.Errorf("listener %d: invalid proxy_trusted %q: %w", i, cidr, err)
+			}
+		}
+		if l.AllowInsecureAuth && l.RequireTLSForAuth {
+			return fmt.Errorf("listener %d: allow_insecure_auth and require_tls_for_auth are mutually exclusive", i)
+		}
+		if l.MaxConnections < 0 {
+			return fmt.Errorf("listener %d: max_connections must not be negative", i)
+		}
+		if err := l.Timeouts.validate(); err != nil {
+			return fmt.Errorf("listener %d: %w", i, err)
+		}
+		for _, m := range l.Mechanisms {
+			if m == "" || strings.ContainsAny(m, " \t") {
+				return fmt.Errorf("listener %d: invalid mechanism %q", i, m)
+			}
+		}
+		if err := c.validateSocket(l); err != nil {
+			return fmt.Errorf("listener %d: %w", i, err)
+		}
+		if _, err := ParseAccessRules(l.Access); err != nil {
+			return fmt.Errorf("listener %d: %w", i, err)
+		}
+	}
+
+	if _, err := ParseAccessRules(c.Access); err != nil {
+		return err
 	}
 
 	if c.Limits.MaxConnections <= 0 {
 		return errors.New("max_connections must be positive")
 	}
 
-	if c.Timeouts.Connection != "" {
-		if _, err := time.ParseDuration(c.Timeouts.Connection); err != nil {
-			return fmt.Errorf("invalid connection timeout: %w", err)
-		}
+	if c.Limits.MaxPerIP < 0 || c.Limits.MaxPerNetwork < 0 {
+		return errors.New("max_per_ip and max_per_network must not be negative")
 	}
 
-	if c.Timeouts.Command != "" {
-		if _, err := time.ParseDuration(c.Timeouts.Command); err != nil {
-			return fmt.Errorf("invalid command timeout: %w", err)
-		}
+	if c.Limits.ConnectionRate < 0 || c.Limits.ConnectionBurst < 0 {
+		return errors.New("connection_rate and connection_burst must not be negative")
 	}
 
-	if c.Timeouts.Idle != "" {
-		if _, err := time.ParseDuration(c.Timeouts.Idle); err != nil {
-			return fmt.Errorf("invalid idle timeout: %w", err)
+	if c.Limits.MaxSessionsPerUser < 0 || c.Limits.MaxSessionsPerDomain < 0 {
+		return errors.New("max_sessions_per_user and max_sessions_per_domain must not be negative")
+	}
+
+	if c.Limits.MaxAuthLine != 0 && c.Limits.MaxAuthLine < MaxCommandLine {
+		return fmt.Errorf("max_auth_line must be at least %d", MaxCommandLine)
+	}
+
+	if c.Limits.MaxBadCommands < 0 {
+		return errors.New("max_bad_commands must not be negative")
+	}
+
+	for _, cidr := range c.Limits.Exempt {
+		if _, err := netip.ParsePrefix(cidr); err != nil {
+			return fmt.Errorf("invalid limits exempt %q: %w", cidr, err)
 		}
 	}
 
+	if err := c.Timeouts.validate(); err != nil {
+		return err
+	}
+
 	if c.TLS.MinVersion != "" {
 		if _, ok := minTLSVersions[c.TLS.MinVersion]; !ok {
 			return fmt.Errorf("invalid TLS min_version %q (valid: 1.0, 1.1, 1.2, 1.3)", c.TLS.MinVersion)
 		}
 	}
 
+	switch c.Lock.Policy {
+	case "", LockPolicyReject, LockPolicyTakeover:
+	default:
+		return fmt.Errorf("invalid lock policy %q (valid: reject, takeover)", c.Lock.Policy)
+	}
+
+	if strings.ContainsAny(c.Subaddress.Separator, "@ \t") {
+		return fmt.Errorf("invalid subaddress separator %q", c.Subaddress.Separator)
+	}
+	switch c.Subaddress.FolderCase {
+	case "", FolderCasePreserve, FolderCaseLower, FolderCaseUpper, FolderCaseTitle:
+	default:
+		return fmt.Errorf("invalid subaddress folder_case %q (valid: preserve, lower, upper, title)", c.Subaddress.FolderCase)
+	}
+
+	for i, cert := range c.TLS.Certificates {
+		if cert.CertFile == "" || cert.KeyFile == "" {
+			return fmt.Errorf("tls certificate %d: cert_file and key_file are required", i)
+		}
+	}
+
+	for name, d := range c.Domains {
+		if name == "" || strings.ContainsAny(name, "@ \t") {
+			return fmt.Errorf("invalid domain %q", name)
+		}
+		if strings.ContainsAny(d.LoginDomain, "@ \t") {
+			return fmt.Errorf("domain %s: invalid login_domain %q", name, d.LoginDomain)
+		}
+		if _, err := ParseAccessRules(d.Access); err != nil {
+			return fmt.Errorf("domain %s: %w", name, err)
+		}
+	}
+
+	if err := c.Aggregate.validate(); err != nil {
+		return err
+	}
+
+	if err := c.Policy.validate(); err != nil {
+		return err
+	}
+
+	if err := c.AuthThrottle.validate(); err != nil {
+		return err
+	}
+
 	if c.Metrics.Enabled {
 		if c.Metrics.Address == "" {
 			return errors.New("metrics address is required when metrics are enabled")
@@ -188,6 +786,78 @@ func (c *Config) Validate() error {
 	return nil
 }
 
+// validate checks that the timeouts parse.
+func (c *TimeoutsConfig) validate() error {
+	if c.Connection != "" {
+		if _, err := time.ParseDuration(c.Connection); err != nil {
+			return fmt.Errorf("invalid connection timeout: %w", err)
+		}
+	}
+
+	if c.Command != "" {
+		if _, err := time.ParseDuration(c.Command); err != nil {
+			return fmt.Errorf("invalid command timeout: %w", err)
+		}
+	}
+
+	if c.PreAuth != "" {
+		if _, err := time.ParseDuration(c.PreAuth); err != nil {
+			return fmt.Errorf("invalid pre_auth timeout: %w", err)
+		}
+	}
+
+	if c.Idle != "" {
+		if _, err := time.ParseDuration(c.Idle); err != nil {
+			return fmt.Errorf("invalid idle timeout: %w", err)
+		}
+	}
+
+	if c.Write != "" {
+		if _, err := time.ParseDuration(c.Write); err != nil {
+			return fmt.Errorf("invalid write timeout: %w", err)
+		}
+	}
+
+	if c.Session != "" {
+		if d, err := time.ParseDuration(c.Session); err != nil || d < 0 {
+			return fmt.Errorf("invalid session timeout %q", c.Session)
+		}
+	}
+
+	if c.Drain != "" {
+		if d, err := time.ParseDuration(c.Drain); err != nil || d < 0 {
+			return fmt.Errorf("invalid drain timeout %q", c.Drain)
+		}
+	}
+	return nil
+}
+
+// Warnings describes settings that are accepted but adjusted, for the
+// caller to log. An idle timeout below RFC 1939's minimum is raised to it
+// rather than rejected, so that configurations written before the minimum
+// was enforced still load.
+func (c *Config) Warnings() []string {
+	var warnings []string
+	if w := c.Timeouts.idleWarning(); w != "" {
+		warnings = append(warnings, w)
+	}
+	for i, l := range c.Listeners {
+		if w := l.Timeouts.idleWarning(); w != "" {
+			warnings = append(warnings, fmt.Sprintf("listener %d: %s", i, w))
+		}
+	}
+	return warnings
+}
+
+// idleWarning describes the raising of an idle timeout below the minimum,
+// or returns "" if it is not raised.
+func (c *TimeoutsConfig) idleWarning() string {
+	if d, err := time.ParseDuration(c.Idle); err == nil && d < MinIdleTimeout {
+		return fmt.Sprintf("idle timeout %s is below the RFC 1939 minimum, using %s", c.Idle, MinIdleTimeout)
+	}
+	return ""
+}
+
 // MinTLSVersion returns the crypto/tls constant for the configured minimum TLS version.
 // Returns tls.VersionTLS12 if not configured or invalid.
 func (c *TLSConfig) MinTLSVersion() uint16 {
@@ -197,8 +867,14 @@ func (c *TLSConfig) MinTLSVersion() uint16 {
 	return tls.VersionTLS12
 }
 
+// MinIdleTimeout is the shortest idle timeout RFC 1939 allows.
+const MinIdleTimeout = 10 * time.Minute
+
 // ConnectionTimeout returns the connection timeout as a time.Duration.
 // Returns 10 minutes if not configured or invalid.
+//
+// Deprecated: the connection timeout is no longer used; see IdleTimeout
+// and SessionTimeout.
 func (c *TimeoutsConfig) ConnectionTimeout() time.Duration {
 	if c.Connection == "" {
 		return 10 * time.Minute
@@ -223,7 +899,47 @@ func (c *TimeoutsConfig) CommandTimeout() time.Duration {
 	return d
 }
 
-// IdleTimeout returns the idle timeout as a time.Duration.
+// PreAuthTimeout returns the pre-authentication timeout as a time.Duration:
+// PreAuth if set, otherwise the command timeout.
+func (c *TimeoutsConfig) PreAuthTimeout() time.Duration {
+	if c.PreAuth == "" {
+		return c.CommandTimeout()
+	}
+	d, err := time.ParseDuration(c.PreAuth)
+	if err != nil {
+		return c.CommandTimeout()
+	}
+	return d
+}
+
+// WriteTimeout returns the write timeout as a time.Duration.
+// Returns 1 minute if not configured or invalid.
+func (c *TimeoutsConfig) WriteTimeout() time.Duration {
+	if c.Write == "" {
+		return 1 * time.Minute
+	}
+	d, err := time.ParseDuration(c.Write)
+	if err != nil {
+		return 1 * time.Minute
+	}
+	return d
+}
+
+// SessionTimeout returns the maximum session lifetime as a time.Duration.
+// Returns zero, meaning no limit, if not configured or invalid.
+func (c *TimeoutsConfig) SessionTimeout() time.Duration {
+	if c.Session == "" {
+		return 0
+	}
+	d, err := time.ParseDuration(c.Session)
+	if err != nil {
+		return 0
+	}
+	return d
+}
+
+// IdleTimeout returns the idle timeout as a time.Duration, raised to
+// MinIdleTimeout if it is shorter.
 // Returns 30 minutes if not configured or invalid.
 func (c *TimeoutsConfig) IdleTimeout() time.Duration {
 	if c.Idle == "" {
@@ -233,6 +949,19 @@ func (c *TimeoutsConfig) IdleTimeout() time.Duration {
 	if err != nil {
 		return 30 * time.Minute
 	}
+	return max(d, MinIdleTimeout)
+}
+
+// DrainTimeout returns the shutdown drain period as a time.Duration.
+// Returns 30 seconds if not configured or invalid.
+func (c *TimeoutsConfig) DrainTimeout() time.Duration {
+	if c.Drain == "" {
+		return 30 * time.Second
+	}
+	d, err := time.ParseDuration(c.Drain)
+	if err != nil {
+		return 30 * time.Second
+	}
 	return d
 }
 
@@ -243,9 +972,35 @@ var minTLSVersions = map[string]uint16{
 	"1.3": tls.VersionTLS13,
 }
 
+// validateSocket checks the settings that apply only to unix listeners, or
+// not to them.
+func (c *Config) validateSocket(l ListenerConfig) error {
+	if l.Mode != ModeUnix {
+		if l.SocketMode != "" || l.SocketGroup != "" {
+			return errors.New("socket_mode and socket_group require mode unix")
+		}
+		return nil
+	}
+	if !filepath.IsAbs(l.Address) {
+		return fmt.Errorf("unix socket path %q must be absolute", l.Address)
+	}
+	if l.ClientAuth != "" && l.ClientAuth != "none" {
+		return errors.New("client_auth is not available on unix listeners")
+	}
+	if l.ProxyProtocol {
+		return errors.New("proxy_protocol is not available on unix listeners")
+	}
+	if l.SocketMode != "" {
+		if mode, err := strconv.ParseUint(l.SocketMode, 8, 32); err != nil || mode > 0o777 {
+			return fmt.Errorf("invalid socket_mode %q", l.SocketMode)
+		}
+	}
+	return nil
+}
+
 func isValidMode(m ListenerMode) bool {
 	switch m {
-	case ModePop3, ModePop3s:
+	case ModePop3, ModePop3s, ModeUnix:
 		return true
 	default:
 		return false
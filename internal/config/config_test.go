@@ -2,6 +2,9 @@ package config
 
 import (
 	"crypto/tls"
+	"net/netip"
+	"os"
+	"strings"
 	"testing"
 	"time"
 )
@@ -122,6 +125,54 @@ func TestValidate(t *testing.T) {
 			modify:  func(c *Config) { c.Timeouts.Idle = "invalid" },
 			wantErr: true,
 		},
+		{
+			name:    "idle timeout below RFC 1939 minimum",
+			modify:  func(c *Config) { c.Timeouts.Idle = "5m" },
+			wantErr: false,
+		},
+		{
+			name: "valid state timeouts",
+			modify: func(c *Config) {
+				c.Timeouts.PreAuth = "30s"
+				c.Timeouts.Write = "2m"
+				c.Timeouts.Session = "4h"
+			},
+			wantErr: false,
+		},
+		{
+			name:    "invalid pre_auth timeout",
+			modify:  func(c *Config) { c.Timeouts.PreAuth = "soon" },
+			wantErr: true,
+		},
+		{
+			name:    "negative session timeout",
+			modify:  func(c *Config) { c.Timeouts.Session = "-1h" },
+			wantErr: true,
+		},
+		{
+			name: "certificate without key",
+			modify: func(c *Config) {
+				c.TLS.Certificates = []CertificateConfig{{CertFile: "/etc/ssl/example.pem"}}
+			},
+			wantErr: true,
+		},
+		{
+			name: "invalid login domain",
+			modify: func(c *Config) {
+				c.Domains = map[string]DomainConfig{"example.com": {LoginDomain: "user@example.com"}}
+			},
+			wantErr: true,
+		},
+		{
+			name:    "invalid drain timeout",
+			modify:  func(c *Config) { c.Timeouts.Drain = "invalid" },
+			wantErr: true,
+		},
+		{
+			name:    "negative drain timeout",
+			modify:  func(c *Config) { c.Timeouts.Drain = "-1s" },
+			wantErr: true,
+		},
 		{
 			name:    "invalid TLS min_version",
 			modify:  func(c *Config) { c.TLS.MinVersion = "1.4" },
@@ -141,6 +192,165 @@ func TestValidate(t *testing.T) {
 			},
 			wantErr: false,
 		},
+		{
+			name: "listener overrides",
+			modify: func(c *Config) {
+				c.Listeners = []ListenerConfig{{
+					Address:           ":110",
+					Mode:              ModePop3,
+					Hostname:          "lan.example.com",
+					AllowInsecureAuth: true,
+					MaxConnections:    10,
+					Timeouts:          TimeoutsConfig{Idle: "1h"},
+					Mechanisms:        []string{"PLAIN"},
+				}}
+			},
+			wantErr: false,
+		},
+		{
+			name: "listener allowing and requiring insecure auth",
+			modify: func(c *Config) {
+				c.Listeners = []ListenerConfig{{Address: ":110", Mode: ModePop3, AllowInsecureAuth: true, RequireTLSForAuth: true}}
+			},
+			wantErr: true,
+		},
+		{
+			name: "listener negative max_connections",
+			modify: func(c *Config) {
+				c.Listeners = []ListenerConfig{{Address: ":110", Mode: ModePop3, MaxConnections: -1}}
+			},
+			wantErr: true,
+		},
+		{
+			name: "listener invalid timeout",
+			modify: func(c *Config) {
+				c.Listeners = []ListenerConfig{{Address: ":110", Mode: ModePop3, Timeouts: TimeoutsConfig{Command: "soon"}}}
+			},
+			wantErr: true,
+		},
+		{
+			name: "listener empty mechanism",
+			modify: func(c *Config) {
+				c.Listeners = []ListenerConfig{{Address: ":110", Mode: ModePop3, Mechanisms: []string{""}}}
+			},
+			wantErr: true,
+		},
+		{
+			name: "valid unix listener",
+			modify: func(c *Config) {
+				c.Listeners = []ListenerConfig{{Address: "/run/pop3d/pop3.sock", Mode: ModeUnix, SocketMode: "0660"}}
+			},
+			wantErr: false,
+		},
+		{
+			name: "unix listener with relative path",
+			modify: func(c *Config) {
+				c.Listeners = []ListenerConfig{{Address: "pop3.sock", Mode: ModeUnix}}
+			},
+			wantErr: true,
+		},
+		{
+			name: "unix listener with invalid socket_mode",
+			modify: func(c *Config) {
+				c.Listeners = []ListenerConfig{{Address: "/run/pop3d/pop3.sock", Mode: ModeUnix, SocketMode: "rw"}}
+			},
+			wantErr: true,
+		},
+		{
+			name: "socket_mode on a TCP listener",
+			modify: func(c *Config) {
+				c.Listeners = []ListenerConfig{{Address: ":110", Mode: ModePop3, SocketMode: "0660"}}
+			},
+			wantErr: true,
+		},
+		{
+			name: "valid per-address limits",
+			modify: func(c *Config) {
+				c.Limits.MaxPerIP = 10
+				c.Limits.MaxPerNetwork = 30
+				c.Limits.ConnectionRate = 60
+				c.Limits.Exempt = []string{"10.0.0.0/8", "2001:db8::/32"}
+			},
+			wantErr: false,
+		},
+		{
+			name:    "negative max_per_ip",
+			modify:  func(c *Config) { c.Limits.MaxPerIP = -1 },
+			wantErr: true,
+		},
+		{
+			name:    "negative max_sessions_per_user",
+			modify:  func(c *Config) { c.Limits.MaxSessionsPerUser = -1 },
+			wantErr: true,
+		},
+		{
+			name:    "max_auth_line below the command limit",
+			modify:  func(c *Config) { c.Limits.MaxAuthLine = 100 },
+			wantErr: true,
+		},
+		{
+			name:    "max_auth_line",
+			modify:  func(c *Config) { c.Limits.MaxAuthLine = 16384 },
+			wantErr: false,
+		},
+		{
+			name:    "negative max_bad_commands",
+			modify:  func(c *Config) { c.Limits.MaxBadCommands = -1 },
+			wantErr: true,
+		},
+		{
+			name:    "negative connection_rate",
+			modify:  func(c *Config) { c.Limits.ConnectionRate = -1 },
+			wantErr: true,
+		},
+		{
+			name:    "invalid limits exempt",
+			modify:  func(c *Config) { c.Limits.Exempt = []string{"10.0.0.1"} },
+			wantErr: true,
+		},
+		{
+			name: "valid access rules",
+			modify: func(c *Config) {
+				c.Access = []string{"deny 203.0.113.0/24", "deny 2001:db8:bad::/48"}
+				c.Listeners[0].Access = []string{"allow 10.0.0.0/8", "allow 192.0.2.7", "deny all"}
+				c.Domains = map[string]DomainConfig{"example.com": {Access: []string{"allow 198.51.100.0/24", "deny all"}}}
+			},
+			wantErr: false,
+		},
+		{
+			name:    "access rule without action",
+			modify:  func(c *Config) { c.Access = []string{"10.0.0.0/8"} },
+			wantErr: true,
+		},
+		{
+			name:    "listener access rule with unknown action",
+			modify:  func(c *Config) { c.Listeners[0].Access = []string{"permit 10.0.0.0/8"} },
+			wantErr: true,
+		},
+		{
+			name: "domain access rule with invalid cidr",
+			modify: func(c *Config) {
+				c.Domains = map[string]DomainConfig{"example.com": {Access: []string{"allow 10.0.0.0/33"}}}
+			},
+			wantErr: true,
+		},
+		{
+			name: "valid auth throttle",
+			modify: func(c *Config) {
+				c.AuthThrottle = AuthThrottleConfig{Delay: "1s", MaxDelay: "30s", MaxFailures: 3, BanThreshold: 10, Window: "15m", BanDuration: "1h"}
+			},
+			wantErr: false,
+		},
+		{
+			name:    "auth throttle invalid ban_duration",
+			modify:  func(c *Config) { c.AuthThrottle.BanDuration = "forever" },
+			wantErr: true,
+		},
+		{
+			name:    "auth throttle negative max_failures",
+			modify:  func(c *Config) { c.AuthThrottle.MaxFailures = -1 },
+			wantErr: true,
+		},
 		{
 			name: "valid metrics config enabled",
 			modify: func(c *Config) {
@@ -168,6 +378,127 @@ func TestValidate(t *testing.T) {
 			},
 			wantErr: true,
 		},
+		{
+			name: "listener client_auth with client CA",
+			modify: func(c *Config) {
+				c.TLS.ClientCAFile = "/etc/ssl/clients.pem"
+				c.Listeners = []ListenerConfig{{Address: ":995", Mode: ModePop3s, ClientAuth: "require"}}
+			},
+			wantErr: false,
+		},
+		{
+			name: "listener client_auth without client CA",
+			modify: func(c *Config) {
+				c.Listeners = []ListenerConfig{{Address: ":995", Mode: ModePop3s, ClientAuth: "request"}}
+			},
+			wantErr: true,
+		},
+		{
+			name: "listener invalid client_auth",
+			modify: func(c *Config) {
+				c.Listeners = []ListenerConfig{{Address: ":995", Mode: ModePop3s, ClientAuth: "optional"}}
+			},
+			wantErr: true,
+		},
+		{
+			name:    "lock takeover policy",
+			modify:  func(c *Config) { c.Lock.Policy = LockPolicyTakeover },
+			wantErr: false,
+		},
+		{
+			name:    "invalid lock policy",
+			modify:  func(c *Config) { c.Lock.Policy = "steal" },
+			wantErr: true,
+		},
+		{
+			name: "policy with login delay and expire",
+			modify: func(c *Config) {
+				c.Policy = PolicyConfig{
+					LoginDelay: "5m",
+					Expire:     "30",
+					RecordFile: "/var/lib/pop3d/record.json",
+					Users:      map[string]PolicyOverride{"alice@example.com": {Expire: "never"}},
+				}
+			},
+			wantErr: false,
+		},
+		{
+			name:    "policy expire without record file",
+			modify:  func(c *Config) { c.Policy.Expire = "30" },
+			wantErr: true,
+		},
+		{
+			name:    "policy invalid expire",
+			modify:  func(c *Config) { c.Policy.Expire = "soon" },
+			wantErr: true,
+		},
+		{
+			name: "policy invalid domain login delay",
+			modify: func(c *Config) {
+				c.Policy.Domains = map[string]PolicyOverride{"example.com": {LoginDelay: "-1m"}}
+			},
+			wantErr: true,
+		},
+		{
+			name: "subaddress separator and folder case",
+			modify: func(c *Config) {
+				c.Subaddress = SubaddressConfig{Separator: "+-", FolderCase: FolderCaseTitle}
+			},
+			wantErr: false,
+		},
+		{
+			name: "proxy protocol with trusted CIDRs",
+			modify: func(c *Config) {
+				c.Listeners[0].ProxyProtocol = true
+				c.Listeners[0].ProxyTrusted = []string{"10.0.0.0/8", "2001:db8::/32"}
+			},
+			wantErr: false,
+		},
+		{
+			name:    "proxy protocol without trusted CIDRs",
+			modify:  func(c *Config) { c.Listeners[0].ProxyProtocol = true },
+			wantErr: true,
+		},
+		{
+			name: "proxy trusted invalid CIDR",
+			modify: func(c *Config) {
+				c.Listeners[0].ProxyProtocol = true
+				c.Listeners[0].ProxyTrusted = []string{"10.0.0.1"}
+			},
+			wantErr: true,
+		},
+		{
+			name: "aggregate folders with header",
+			modify: func(c *Config) {
+				c.Aggregate = AggregateConfig{Folders: []string{"Junk", "Lists/go"}, Header: "X-Folder"}
+			},
+			wantErr: false,
+		},
+		{
+			name:    "aggregate inbox folder",
+			modify:  func(c *Config) { c.Aggregate.Folders = []string{"INBOX"} },
+			wantErr: true,
+		},
+		{
+			name:    "aggregate duplicate folder",
+			modify:  func(c *Config) { c.Aggregate.Folders = []string{"Junk", "Junk"} },
+			wantErr: true,
+		},
+		{
+			name:    "aggregate invalid header",
+			modify:  func(c *Config) { c.Aggregate.Header = "X-Folder:" },
+			wantErr: true,
+		},
+		{
+			name:    "subaddress separator with @",
+			modify:  func(c *Config) { c.Subaddress.Separator = "@" },
+			wantErr: true,
+		},
+		{
+			name:    "subaddress invalid folder case",
+			modify:  func(c *Config) { c.Subaddress.FolderCase = "camel" },
+			wantErr: true,
+		},
 		{
 			name: "metrics disabled allows empty address",
 			modify: func(c *Config) {
@@ -266,6 +597,7 @@ func TestIdleTimeout(t *testing.T) {
 		{"30m", 30 * time.Minute},
 		{"1h", 1 * time.Hour},
 		{"10m", 10 * time.Minute},
+		{"5m", 10 * time.Minute},      // raised to the RFC 1939 minimum
 		{"", 30 * time.Minute},        // default
 		{"invalid", 30 * time.Minute}, // invalid falls back to default
 	}
@@ -279,3 +611,146 @@ func TestIdleTimeout(t *testing.T) {
 		})
 	}
 }
+
+func TestWarningsIdleTimeout(t *testing.T) {
+	cfg := Default()
+	if w := cfg.Warnings(); len(w) != 0 {
+		t.Errorf("default config warnings = %q, want none", w)
+	}
+
+	cfg.Timeouts.Idle = "5m"
+	cfg.Listeners = []ListenerConfig{
+		{Address: ":110", Mode: ModePop3, Timeouts: TimeoutsConfig{Idle: "1m"}},
+		{Address: ":995", Mode: ModePop3s, Timeouts: TimeoutsConfig{Idle: "1h"}},
+	}
+	w := cfg.Warnings()
+	if len(w) != 2 || !strings.Contains(w[0], "5m") || !strings.HasPrefix(w[1], "listener 0: ") {
+		t.Errorf("warnings = %q, want the server and listener 0 idle timeouts", w)
+	}
+}
+
+func TestDrainTimeout(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected time.Duration
+	}{
+		{"30s", 30 * time.Second},
+		{"2m", 2 * time.Minute},
+		{"0s", 0},
+		{"", 30 * time.Second},        // default
+		{"invalid", 30 * time.Second}, // invalid falls back to default
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			cfg := TimeoutsConfig{Drain: tt.value}
+			if got := cfg.DrainTimeout(); got != tt.expected {
+				t.Errorf("DrainTimeout() = %v, want %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestPreAuthTimeout(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      TimeoutsConfig
+		expected time.Duration
+	}{
+		{"pre_auth", TimeoutsConfig{PreAuth: "20s", Command: "2m"}, 20 * time.Second},
+		{"command fallback", TimeoutsConfig{Command: "2m"}, 2 * time.Minute},
+		{"default", TimeoutsConfig{}, time.Minute},
+		{"invalid", TimeoutsConfig{PreAuth: "soon"}, time.Minute},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.cfg.PreAuthTimeout(); got != tt.expected {
+				t.Errorf("PreAuthTimeout() = %v, want %v", got, tt.expected)
+			}
+		})
+	}
+}
+
+func TestWriteAndSessionTimeout(t *testing.T) {
+	var cfg TimeoutsConfig
+	if got := cfg.WriteTimeout(); got != time.Minute {
+		t.Errorf("default WriteTimeout() = %v, want 1m", got)
+	}
+	if got := cfg.SessionTimeout(); got != 0 {
+		t.Errorf("default SessionTimeout() = %v, want no limit", got)
+	}
+
+	cfg = TimeoutsConfig{Write: "30s", Session: "4h"}
+	if got := cfg.WriteTimeout(); got != 30*time.Second {
+		t.Errorf("WriteTimeout() = %v, want 30s", got)
+	}
+	if got := cfg.SessionTimeout(); got != 4*time.Hour {
+		t.Errorf("SessionTimeout() = %v, want 4h", got)
+	}
+}
+
+func TestEffectiveTimeouts(t *testing.T) {
+	server := TimeoutsConfig{PreAuth: "1m", Idle: "30m", Write: "1m", Drain: "30s"}
+	l := ListenerConfig{Timeouts: TimeoutsConfig{PreAuth: "20s", Session: "4h", Drain: "1m"}}
+
+	got := l.EffectiveTimeouts(server)
+	want := TimeoutsConfig{PreAuth: "20s", Idle: "30m", Write: "1m", Session: "4h", Drain: "1m"}
+	if got != want {
+		t.Errorf("EffectiveTimeouts() = %+v, want %+v", got, want)
+	}
+}
+
+func TestParseAccessRules(t *testing.T) {
+	rules, err := ParseAccessRules([]string{"allow 10.1.2.3/8", "DENY 192.0.2.7", "deny all"})
+	if err != nil {
+		t.Fatalf("ParseAccessRules() error = %v", err)
+	}
+	want := []string{"allow 10.0.0.0/8", "deny 192.0.2.7/32", "deny all"}
+	for i, r := range rules {
+		if got := r.String(); got != want[i] {
+			t.Errorf("rule %d = %q, want %q", i, got, want[i])
+		}
+	}
+
+	tests := []struct {
+		rule string
+		ip   string
+		want bool
+	}{
+		{"allow 10.0.0.0/8", "10.9.8.7", true},
+		{"allow 10.0.0.0/8", "11.0.0.1", false},
+		{"allow 10.0.0.0/8", "::ffff:10.0.0.1", true},
+		{"deny all", "2001:db8::1", true},
+	}
+	for _, tt := range tests {
+		rules, err := ParseAccessRules([]string{tt.rule})
+		if err != nil {
+			t.Fatalf("ParseAccessRules(%q) error = %v", tt.rule, err)
+		}
+		if got := rules[0].Matches(netip.MustParseAddr(tt.ip)); got != tt.want {
+			t.Errorf("%q matches %s = %v, want %v", tt.rule, tt.ip, got, tt.want)
+		}
+	}
+}
+
+func TestSocketPermissions(t *testing.T) {
+	tests := []struct {
+		value    string
+		expected os.FileMode
+	}{
+		{"0600", 0o600},
+		{"660", 0o660},
+		{"", 0o660},   // default
+		{"rw", 0o660}, // invalid falls back to default
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			l := ListenerConfig{Mode: ModeUnix, SocketMode: tt.value}
+			if got := l.SocketPermissions(); got != tt.expected {
+				t.Errorf("SocketPermissions() = %v, want %v", got, tt.expected)
+			}
+		})
+	}
+}
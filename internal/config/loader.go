@@ -128,6 +128,14 @@ func mergeServerConfig(dst Config, src ServerConfig) Config {
 		dst.TLS.MinVersion = src.TLS.MinVersion
 	}
 
+	if src.TLS.ClientCAFile != "" {
+		dst.TLS.ClientCAFile = src.TLS.ClientCAFile
+	}
+
+	if len(src.TLS.Certificates) > 0 {
+		dst.TLS.Certificates = src.TLS.Certificates
+	}
+
 	return dst
 }
 
@@ -139,10 +147,17 @@ func mergeConfig(dst, src Config) Config {
 		dst.LogLevel = src.LogLevel
 	}
 
+	if len(src.Access) > 0 {
+		dst.Access = src.Access
+	}
 	if len(src.Listeners) > 0 {
 		dst.Listeners = src.Listeners
 	}
 
+	if src.Timeouts.PreAuth != "" {
+		dst.Timeouts.PreAuth = src.Timeouts.PreAuth
+	}
+
 	if src.Timeouts.Connection != "" {
 		dst.Timeouts.Connection = src.Timeouts.Connection
 	}
@@ -155,10 +170,58 @@ func mergeConfig(dst, src Config) Config {
 		dst.Timeouts.Idle = src.Timeouts.Idle
 	}
 
+	if src.Timeouts.Write != "" {
+		dst.Timeouts.Write = src.Timeouts.Write
+	}
+
+	if src.Timeouts.Session != "" {
+		dst.Timeouts.Session = src.Timeouts.Session
+	}
+
+	if src.Timeouts.Drain != "" {
+		dst.Timeouts.Drain = src.Timeouts.Drain
+	}
+
 	if src.Limits.MaxConnections > 0 {
 		dst.Limits.MaxConnections = src.Limits.MaxConnections
 	}
 
+	if src.Limits.MaxPerIP > 0 {
+		dst.Limits.MaxPerIP = src.Limits.MaxPerIP
+	}
+
+	if src.Limits.MaxPerNetwork > 0 {
+		dst.Limits.MaxPerNetwork = src.Limits.MaxPerNetwork
+	}
+
+	if src.Limits.ConnectionRate > 0 {
+		dst.Limits.ConnectionRate = src.Limits.ConnectionRate
+	}
+
+	if src.Limits.ConnectionBurst > 0 {
+		dst.Limits.ConnectionBurst = src.Limits.ConnectionBurst
+	}
+
+	if len(src.Limits.Exempt) > 0 {
+		dst.Limits.Exempt = src.Limits.Exempt
+	}
+
+	if src.Limits.MaxSessionsPerUser > 0 {
+		dst.Limits.MaxSessionsPerUser = src.Limits.MaxSessionsPerUser
+	}
+
+	if src.Limits.MaxSessionsPerDomain > 0 {
+		dst.Limits.MaxSessionsPerDomain = src.Limits.MaxSessionsPerDomain
+	}
+
+	if src.Limits.MaxAuthLine > 0 {
+		dst.Limits.MaxAuthLine = src.Limits.MaxAuthLine
+	}
+
+	if src.Limits.MaxBadCommands > 0 {
+		dst.Limits.MaxBadCommands = src.Limits.MaxBadCommands
+	}
+
 	// Metrics: enabled is explicitly set (boolean), so we merge if source has any non-zero value
 	if src.Metrics.Enabled {
 		dst.Metrics.Enabled = src.Metrics.Enabled
@@ -172,6 +235,82 @@ func mergeConfig(dst, src Config) Config {
 		dst.Metrics.Path = src.Metrics.Path
 	}
 
+	if src.SASL.Login {
+		dst.SASL.Login = src.SASL.Login
+	}
+
+	if src.Lock.Policy != "" {
+		dst.Lock.Policy = src.Lock.Policy
+	}
+
+	if src.Policy.LoginDelay != "" {
+		dst.Policy.LoginDelay = src.Policy.LoginDelay
+	}
+
+	if src.Policy.Expire != "" {
+		dst.Policy.Expire = src.Policy.Expire
+	}
+
+	if src.Policy.RecordFile != "" {
+		dst.Policy.RecordFile = src.Policy.RecordFile
+	}
+
+	if src.AuthThrottle.Delay != "" {
+		dst.AuthThrottle.Delay = src.AuthThrottle.Delay
+	}
+
+	if src.AuthThrottle.MaxDelay != "" {
+		dst.AuthThrottle.MaxDelay = src.AuthThrottle.MaxDelay
+	}
+
+	if src.AuthThrottle.MaxFailures > 0 {
+		dst.AuthThrottle.MaxFailures = src.AuthThrottle.MaxFailures
+	}
+
+	if src.AuthThrottle.BanThreshold > 0 {
+		dst.AuthThrottle.BanThreshold = src.AuthThrottle.BanThreshold
+	}
+
+	if src.AuthThrottle.Window != "" {
+		dst.AuthThrottle.Window = src.AuthThrottle.Window
+	}
+
+	if src.AuthThrottle.BanDuration != "" {
+		dst.AuthThrottle.BanDuration = src.AuthThrottle.BanDuration
+	}
+
+	if src.AuthThrottle.StateFile != "" {
+		dst.AuthThrottle.StateFile = src.AuthThrottle.StateFile
+	}
+
+	if len(src.Policy.Domains) > 0 {
+		dst.Policy.Domains = src.Policy.Domains
+	}
+
+	if len(src.Policy.Users) > 0 {
+		dst.Policy.Users = src.Policy.Users
+	}
+
+	if src.Subaddress.Separator != "" {
+		dst.Subaddress.Separator = src.Subaddress.Separator
+	}
+
+	if src.Subaddress.FolderCase != "" {
+		dst.Subaddress.FolderCase = src.Subaddress.FolderCase
+	}
+
+	if len(src.Aggregate.Folders) > 0 {
+		dst.Aggregate.Folders = src.Aggregate.Folders
+	}
+
+	if src.Aggregate.Header != "" {
+		dst.Aggregate.Header = src.Aggregate.Header
+	}
+
+	if len(src.Domains) > 0 {
+		dst.Domains = src.Domains
+	}
+
 	return dst
 }
 
@@ -339,6 +339,96 @@ enabled = true
 	}
 }
 
+func TestLoadSASLConfig(t *testing.T) {
+	content := `
+[pop3d.sasl]
+login = true
+`
+
+	path := createTempConfig(t, content)
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	if !cfg.SASL.Login {
+		t.Error("sasl.login = false, want true")
+	}
+}
+
+func TestLoadPolicyConfig(t *testing.T) {
+	content := `
+[pop3d.policy]
+login_delay = "15m"
+expire = "30"
+record_file = "/var/lib/pop3d/record.json"
+
+[pop3d.policy.domains."example.com"]
+expire = "never"
+
+[pop3d.policy.users."alice@example.com"]
+login_delay = "0s"
+`
+
+	path := createTempConfig(t, content)
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	if cfg.Policy.LoginDelay != "15m" || cfg.Policy.Expire != "30" {
+		t.Errorf("policy = %+v, want login_delay 15m, expire 30", cfg.Policy)
+	}
+	if cfg.Policy.Domains["example.com"].Expire != "never" {
+		t.Errorf("policy.domains = %+v", cfg.Policy.Domains)
+	}
+	if cfg.Policy.Users["alice@example.com"].LoginDelay != "0s" {
+		t.Errorf("policy.users = %+v", cfg.Policy.Users)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Validate() error = %v", err)
+	}
+}
+
+func TestLoadSubaddressConfig(t *testing.T) {
+	content := `
+[pop3d.subaddress]
+separator = "+"
+folder_case = "lower"
+`
+
+	path := createTempConfig(t, content)
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	if cfg.Subaddress.Separator != "+" || cfg.Subaddress.FolderCase != FolderCaseLower {
+		t.Errorf("subaddress = %+v, want separator + and folder_case lower", cfg.Subaddress)
+	}
+}
+
+func TestLoadLockConfig(t *testing.T) {
+	content := `
+[pop3d.lock]
+policy = "takeover"
+`
+
+	path := createTempConfig(t, content)
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	if cfg.Lock.LockPolicy() != LockPolicyTakeover {
+		t.Errorf("lock.policy = %q, want takeover", cfg.Lock.LockPolicy())
+	}
+}
+
 func TestFlagPriorityOverConfig(t *testing.T) {
 	content := `
 [pop3d]
@@ -388,3 +478,44 @@ func createTempConfig(t *testing.T, content string) string {
 	}
 	return path
 }
+
+func TestLoadVirtualHostConfig(t *testing.T) {
+	content := `
+[server.tls]
+cert_file = "/etc/ssl/default.pem"
+key_file = "/etc/ssl/default.key"
+
+[[server.tls.certificates]]
+cert_file = "/etc/ssl/example.pem"
+key_file = "/etc/ssl/example.key"
+
+[pop3d.domains."example.com"]
+hostname = "pop.example.com"
+login_domain = "example.com"
+mechanisms = ["PLAIN"]
+restrict_logins = true
+`
+
+	path := createTempConfig(t, content)
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load() error = %v", err)
+	}
+
+	pairs := cfg.TLS.CertificatePairs()
+	if len(pairs) != 2 || pairs[0].CertFile != "/etc/ssl/default.pem" || pairs[1].CertFile != "/etc/ssl/example.pem" {
+		t.Errorf("certificate pairs = %+v, want default then example", pairs)
+	}
+
+	d, ok := cfg.Domains["example.com"]
+	if !ok {
+		t.Fatal("domain example.com not loaded")
+	}
+	if d.Hostname != "pop.example.com" || d.LoginDomain != "example.com" || !d.RestrictLogins || len(d.Mechanisms) != 1 {
+		t.Errorf("domain = %+v", d)
+	}
+	if err := cfg.Validate(); err != nil {
+		t.Errorf("Validate() error = %v", err)
+	}
+}
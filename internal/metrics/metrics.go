@@ -12,16 +12,42 @@ type Collector interface {
 	ConnectionClosed()
 	TLSConnectionEstablished()
 
+	// Connections turned away before the greeting, by the limit they hit
+	ConnectionRejected(reason string)
+
+	// Virtual host metrics (TLS sessions by the virtual host selected by SNI)
+	VirtualHostSession(vhost string)
+
 	// Authentication metrics (authenticated user's domain)
 	AuthAttempt(authDomain string, success bool)
 
-	// Command metrics
+	// Addresses banned after repeated login failures, and how many bans
+	// are in force
+	IPBanned()
+	ActiveBans(count int)
+
+	// Logged-in sessions by the user's domain, and logins refused for
+	// being over the per-user or per-domain session limit
+	ActiveSessions(domain string, count int)
+	SessionLimitReached(limit string)
+
+	// Command metrics, including command lines refused as line_too_long,
+	// unknown or invalid, and sessions closed for too many of them
 	CommandProcessed(command string)
+	CommandRejected(reason string)
+	BadCommandDisconnect()
 
 	// Message retrieval metrics
 	MessageRetrieved(userDomain string, sizeBytes int64)
 	MessageDeleted(userDomain string)
 	MessageListed(userDomain string)
+
+	// Sessions ended by a timeout: pre_auth, idle, write or session
+	SessionTimedOut(timeout string)
+
+	// Shutdown metrics: sessions that ended within the drain period and
+	// sessions closed when it ran out
+	SessionsDrained(drained, forced int)
 }
 
 // Server defines the interface for a metrics HTTP server.
@@ -13,12 +13,36 @@ func (n *NoopCollector) ConnectionClosed() {}
 // TLSConnectionEstablished is a no-op.
 func (n *NoopCollector) TLSConnectionEstablished() {}
 
+// ConnectionRejected is a no-op.
+func (n *NoopCollector) ConnectionRejected(reason string) {}
+
+// VirtualHostSession is a no-op.
+func (n *NoopCollector) VirtualHostSession(vhost string) {}
+
 // AuthAttempt is a no-op.
 func (n *NoopCollector) AuthAttempt(authDomain string, success bool) {}
 
+// IPBanned is a no-op.
+func (n *NoopCollector) IPBanned() {}
+
+// ActiveBans is a no-op.
+func (n *NoopCollector) ActiveBans(count int) {}
+
+// ActiveSessions is a no-op.
+func (n *NoopCollector) ActiveSessions(domain string, count int) {}
+
+// SessionLimitReached is a no-op.
+func (n *NoopCollector) SessionLimitReached(limit string) {}
+
 // CommandProcessed is a no-op.
 func (n *NoopCollector) CommandProcessed(command string) {}
 
+// CommandRejected is a no-op.
+func (n *NoopCollector) CommandRejected(reason string) {}
+
+// BadCommandDisconnect is a no-op.
+func (n *NoopCollector) BadCommandDisconnect() {}
+
 // MessageRetrieved is a no-op.
 func (n *NoopCollector) MessageRetrieved(userDomain string, sizeBytes int64) {}
 
@@ -27,3 +51,9 @@ func (n *NoopCollector) MessageDeleted(userDomain string) {}
 
 // MessageListed is a no-op.
 func (n *NoopCollector) MessageListed(userDomain string) {}
+
+// SessionTimedOut is a no-op.
+func (n *NoopCollector) SessionTimedOut(timeout string) {}
+
+// SessionsDrained is a no-op.
+func (n *NoopCollector) SessionsDrained(drained, forced int) {}
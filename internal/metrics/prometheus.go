@@ -10,18 +10,32 @@ type PrometheusCollector struct {
 	connectionsTotal   prometheus.Counter
 	connectionsActive  prometheus.Gauge
 	tlsConnectionTotal prometheus.Counter
+	connectionsReject  *prometheus.CounterVec
+	vhostSessionsTotal *prometheus.CounterVec
 
 	// Authentication metrics
 	authAttemptsTotal *prometheus.CounterVec
+	authBansTotal     prometheus.Counter
+	authBansActive    prometheus.Gauge
+
+	// Session metrics
+	sessionsActive       *prometheus.GaugeVec
+	sessionLimitRejected *prometheus.CounterVec
 
 	// Command metrics
-	commandsTotal *prometheus.CounterVec
+	commandsTotal              *prometheus.CounterVec
+	commandErrorsTotal         *prometheus.CounterVec
+	badCommandDisconnectsTotal prometheus.Counter
 
 	// Message metrics
 	messagesRetrievedTotal *prometheus.CounterVec
 	messagesDeletedTotal   *prometheus.CounterVec
 	messagesListedTotal    *prometheus.CounterVec
 	messagesSizeBytes      prometheus.Histogram
+
+	// Timeout and shutdown metrics
+	sessionTimeoutsTotal  *prometheus.CounterVec
+	shutdownSessionsTotal *prometheus.CounterVec
 }
 
 // NewPrometheusCollector creates a new PrometheusCollector with all metrics registered.
@@ -39,16 +53,49 @@ func NewPrometheusCollector(reg prometheus.Registerer) *PrometheusCollector {
 			Name: "pop3d_tls_connections_total",
 			Help: "Total number of TLS connections established.",
 		}),
+		connectionsReject: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "pop3d_connections_rejected_total",
+			Help: "Total number of connections rejected before the greeting, by the limit they hit.",
+		}, []string{"reason"}),
+		vhostSessionsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "pop3d_vhost_sessions_total",
+			Help: "Total number of TLS sessions by virtual host.",
+		}, []string{"vhost"}),
 
 		authAttemptsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
 			Name: "pop3d_auth_attempts_total",
 			Help: "Total number of authentication attempts.",
 		}, []string{"domain", "result"}),
+		authBansTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "pop3d_auth_bans_total",
+			Help: "Total number of addresses banned after repeated login failures.",
+		}),
+		authBansActive: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "pop3d_auth_bans_active",
+			Help: "Number of addresses currently banned.",
+		}),
+
+		sessionsActive: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "pop3d_sessions_active",
+			Help: "Number of logged-in sessions by the user's domain.",
+		}, []string{"domain"}),
+		sessionLimitRejected: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "pop3d_session_limit_rejections_total",
+			Help: "Total number of logins refused for being over a session limit.",
+		}, []string{"limit"}),
 
 		commandsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
 			Name: "pop3d_commands_total",
 			Help: "Total number of POP3 commands processed.",
 		}, []string{"command"}),
+		commandErrorsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "pop3d_command_errors_total",
+			Help: "Total number of command lines refused, by reason.",
+		}, []string{"reason"}),
+		badCommandDisconnectsTotal: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "pop3d_bad_command_disconnects_total",
+			Help: "Total number of sessions closed for sending too many bad commands.",
+		}),
 
 		messagesRetrievedTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
 			Name: "pop3d_messages_retrieved_total",
@@ -67,6 +114,15 @@ func NewPrometheusCollector(reg prometheus.Registerer) *PrometheusCollector {
 			Help:    "Size of retrieved messages in bytes.",
 			Buckets: []float64{1024, 10240, 102400, 1048576, 10485760, 26214400, 52428800},
 		}),
+
+		sessionTimeoutsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "pop3d_session_timeouts_total",
+			Help: "Total number of sessions ended by a timeout, by the timeout that fired.",
+		}, []string{"timeout"}),
+		shutdownSessionsTotal: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "pop3d_shutdown_sessions_total",
+			Help: "Total number of sessions ended by shutdown, by whether they finished within the drain period.",
+		}, []string{"result"}),
 	}
 
 	// Register all metrics
@@ -74,12 +130,22 @@ func NewPrometheusCollector(reg prometheus.Registerer) *PrometheusCollector {
 		c.connectionsTotal,
 		c.connectionsActive,
 		c.tlsConnectionTotal,
+		c.connectionsReject,
+		c.vhostSessionsTotal,
 		c.authAttemptsTotal,
+		c.authBansTotal,
+		c.authBansActive,
+		c.sessionsActive,
+		c.sessionLimitRejected,
 		c.commandsTotal,
+		c.commandErrorsTotal,
+		c.badCommandDisconnectsTotal,
 		c.messagesRetrievedTotal,
 		c.messagesDeletedTotal,
 		c.messagesListedTotal,
 		c.messagesSizeBytes,
+		c.sessionTimeoutsTotal,
+		c.shutdownSessionsTotal,
 	)
 
 	return c
@@ -101,6 +167,16 @@ func (c *PrometheusCollector) TLSConnectionEstablished() {
 	c.tlsConnectionTotal.Inc()
 }
 
+// ConnectionRejected increments the rejected connection counter.
+func (c *PrometheusCollector) ConnectionRejected(reason string) {
+	c.connectionsReject.WithLabelValues(reason).Inc()
+}
+
+// VirtualHostSession increments the TLS session counter of a virtual host.
+func (c *PrometheusCollector) VirtualHostSession(vhost string) {
+	c.vhostSessionsTotal.WithLabelValues(vhost).Inc()
+}
+
 // AuthAttempt increments the authentication attempts counter.
 func (c *PrometheusCollector) AuthAttempt(authDomain string, success bool) {
 	result := "failure"
@@ -110,11 +186,42 @@ func (c *PrometheusCollector) AuthAttempt(authDomain string, success bool) {
 	c.authAttemptsTotal.WithLabelValues(authDomain, result).Inc()
 }
 
+// IPBanned increments the ban counter.
+func (c *PrometheusCollector) IPBanned() {
+	c.authBansTotal.Inc()
+}
+
+// ActiveBans sets the number of bans in force.
+func (c *PrometheusCollector) ActiveBans(count int) {
+	c.authBansActive.Set(float64(count))
+}
+
+// ActiveSessions sets the number of logged-in sessions of a domain.
+func (c *PrometheusCollector) ActiveSessions(domain string, count int) {
+	c.sessionsActive.WithLabelValues(domain).Set(float64(count))
+}
+
+// SessionLimitReached increments the counter of logins over a session limit.
+func (c *PrometheusCollector) SessionLimitReached(limit string) {
+	c.sessionLimitRejected.WithLabelValues(limit).Inc()
+}
+
 // CommandProcessed increments the command counter.
 func (c *PrometheusCollector) CommandProcessed(command string) {
 	c.commandsTotal.WithLabelValues(command).Inc()
 }
 
+// CommandRejected increments the counter of refused command lines.
+func (c *PrometheusCollector) CommandRejected(reason string) {
+	c.commandErrorsTotal.WithLabelValues(reason).Inc()
+}
+
+// BadCommandDisconnect increments the counter of sessions closed for too
+// many bad commands.
+func (c *PrometheusCollector) BadCommandDisconnect() {
+	c.badCommandDisconnectsTotal.Inc()
+}
+
 // MessageRetrieved increments the message retrieved counter and observes message size.
 func (c *PrometheusCollector) MessageRetrieved(userDomain string, sizeBytes int64) {
 	c.messagesRetrievedTotal.WithLabelValues(userDomain).Inc()
@@ -130,3 +237,14 @@ func (c *PrometheusCollector) MessageDeleted(userDomain string) {
 func (c *PrometheusCollector) MessageListed(userDomain string) {
 	c.messagesListedTotal.WithLabelValues(userDomain).Inc()
 }
+
+// SessionTimedOut increments the counter of sessions ended by a timeout.
+func (c *PrometheusCollector) SessionTimedOut(timeout string) {
+	c.sessionTimeoutsTotal.WithLabelValues(timeout).Inc()
+}
+
+// SessionsDrained counts the sessions that ended during a shutdown drain.
+func (c *PrometheusCollector) SessionsDrained(drained, forced int) {
+	c.shutdownSessionsTotal.WithLabelValues("drained").Add(float64(drained))
+	c.shutdownSessionsTotal.WithLabelValues("forced").Add(float64(forced))
+}
@@ -0,0 +1,61 @@
+package pop3
+
+import (
+	"net/netip"
+	"strings"
+	"sync/atomic"
+
+	"github.com/infodancer/pop3d/internal/config"
+	"github.com/infodancer/pop3d/internal/server"
+)
+
+// DomainAccess holds the access rules of each domain's users, which decide
+// the client addresses they may log in from. The rules can be replaced while
+// the server runs.
+type DomainAccess struct {
+	lists atomic.Pointer[map[string]server.AccessList]
+}
+
+// NewDomainAccess builds the domains' access rules from configuration.
+func NewDomainAccess(domains map[string]config.DomainConfig) (*DomainAccess, error) {
+	d := &DomainAccess{}
+	if err := d.Set(domains); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Set replaces the rules. Logins already under way keep the old ones.
+func (d *DomainAccess) Set(domains map[string]config.DomainConfig) error {
+	lists := make(map[string]server.AccessList)
+	for name, dc := range domains {
+		if len(dc.Access) == 0 {
+			continue
+		}
+		acl, err := server.NewAccessList(dc.Access)
+		if err != nil {
+			return err
+		}
+		lists[strings.ToLower(name)] = acl
+	}
+	d.lists.Store(&lists)
+	return nil
+}
+
+// Check reports whether username may log in from clientIP and, if a rule
+// decided, which one. Users of domains without rules, and clients without
+// an address (on unix listeners), are allowed.
+func (d *DomainAccess) Check(username, clientIP string) (allowed bool, rule string) {
+	if d == nil {
+		return true, ""
+	}
+	acl, ok := (*d.lists.Load())[strings.ToLower(extractDomain(username))]
+	if !ok {
+		return true, ""
+	}
+	ip, err := netip.ParseAddr(clientIP)
+	if err != nil {
+		return true, ""
+	}
+	return acl.Check(ip)
+}
@@ -0,0 +1,195 @@
+package pop3
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// recordSaveInterval is the least time between the saves made by RecordLogin.
+// Logins in between are saved with the next one, or on Close.
+const recordSaveInterval = 10 * time.Second
+
+// AccessRecord keeps each user's last login time and when each of their
+// messages was first retrieved, for enforcing LOGIN-DELAY and EXPIRE. It is
+// persisted as a small JSON file; with no path it is kept in memory only.
+// Users are keyed as Policies looks them up, case-insensitively.
+type AccessRecord struct {
+	path       string
+	keepLogins time.Duration // logins older than this no longer delay one
+	saveMu     sync.Mutex    // serializes Save so an older snapshot never wins
+
+	mu        sync.Mutex
+	data      accessData
+	dirty     bool // changed since the last save
+	lastSave  time.Time
+	lastSweep time.Time
+}
+
+type accessData struct {
+	LastLogin map[string]time.Time            `json:"last_login"`
+	Retrieved map[string]map[uint32]time.Time `json:"retrieved"`
+}
+
+// LoadAccessRecord loads the record at path. A missing file yields an empty
+// record. Logins are kept for keepLogins, the longest LOGIN-DELAY in force.
+func LoadAccessRecord(path string, keepLogins time.Duration) (*AccessRecord, error) {
+	r := &AccessRecord{
+		path:       path,
+		keepLogins: keepLogins,
+		data: accessData{
+			LastLogin: make(map[string]time.Time),
+			Retrieved: make(map[string]map[uint32]time.Time),
+		},
+	}
+	if path == "" {
+		return r, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return r, nil
+		}
+		return nil, fmt.Errorf("access record: %w", err)
+	}
+	if err := json.Unmarshal(data, &r.data); err != nil {
+		return nil, fmt.Errorf("access record %s: %w", path, err)
+	}
+	if r.data.LastLogin == nil {
+		r.data.LastLogin = make(map[string]time.Time)
+	}
+	if r.data.Retrieved == nil {
+		r.data.Retrieved = make(map[string]map[uint32]time.Time)
+	}
+	return r, nil
+}
+
+// LastLogin returns the time of the user's last successful login.
+func (r *AccessRecord) LastLogin(username string) (time.Time, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	t, ok := r.data.LastLogin[userKey(username)]
+	return t, ok
+}
+
+// RecordLogin records a successful login. The record is saved at most once
+// every recordSaveInterval, so that LOGIN-DELAY holds across restarts without
+// a write for every login.
+func (r *AccessRecord) RecordLogin(username string, at time.Time) error {
+	r.mu.Lock()
+	r.sweep(at)
+	r.data.LastLogin[userKey(username)] = at
+	r.dirty = true
+	due := r.path != "" && at.Sub(r.lastSave) >= recordSaveInterval
+	r.mu.Unlock()
+	if !due {
+		return nil
+	}
+	return r.Save()
+}
+
+// sweep forgets, about once a minute, logins too old to delay another. The
+// caller must hold r.mu.
+func (r *AccessRecord) sweep(now time.Time) {
+	if now.Sub(r.lastSweep) < time.Minute {
+		return
+	}
+	r.lastSweep = now
+	for user, at := range r.data.LastLogin {
+		if now.Sub(at) >= r.keepLogins {
+			delete(r.data.LastLogin, user)
+			r.dirty = true
+		}
+	}
+}
+
+// RecordRetrieved records the first retrieval of a message. It is saved with
+// the next call to Save.
+func (r *AccessRecord) RecordRetrieved(username string, uid uint32, at time.Time) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	msgs := r.data.Retrieved[username]
+	if msgs == nil {
+		msgs = make(map[uint32]time.Time)
+		r.data.Retrieved[username] = msgs
+	}
+	if _, ok := msgs[uid]; !ok {
+		msgs[uid] = at
+		r.dirty = true
+	}
+}
+
+// Expired returns the messages retrieved at least days before now.
+func (r *AccessRecord) Expired(username string, days int, now time.Time) []uint32 {
+	if days < 0 {
+		return nil
+	}
+	cutoff := now.Add(-time.Duration(days) * 24 * time.Hour)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var uids []uint32
+	for uid, at := range r.data.Retrieved[username] {
+		if !at.After(cutoff) {
+			uids = append(uids, uid)
+		}
+	}
+	return uids
+}
+
+// Prune forgets retrievals of messages that are no longer in the maildrop.
+func (r *AccessRecord) Prune(username string, present map[uint32]bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	msgs := r.data.Retrieved[username]
+	for uid := range msgs {
+		if !present[uid] {
+			delete(msgs, uid)
+			r.dirty = true
+		}
+	}
+	if len(msgs) == 0 {
+		delete(r.data.Retrieved, username)
+	}
+}
+
+// Save writes the record to its file, replacing it atomically.
+func (r *AccessRecord) Save() error {
+	if r.path == "" {
+		return nil
+	}
+
+	r.saveMu.Lock()
+	defer r.saveMu.Unlock()
+
+	r.mu.Lock()
+	data, err := json.Marshal(r.data)
+	r.dirty = false
+	r.lastSave = time.Now()
+	r.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("access record: %w", err)
+	}
+
+	if err := writeStateFile(r.path, data); err != nil {
+		r.mu.Lock()
+		r.dirty = true
+		r.mu.Unlock()
+		return fmt.Errorf("access record: %w", err)
+	}
+	return nil
+}
+
+// Close saves any changes not yet written.
+func (r *AccessRecord) Close() error {
+	r.mu.Lock()
+	dirty := r.dirty
+	r.mu.Unlock()
+	if !dirty {
+		return nil
+	}
+	return r.Save()
+}
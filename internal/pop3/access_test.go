@@ -0,0 +1,76 @@
+package pop3
+
+import (
+	"context"
+	"testing"
+
+	"github.com/infodancer/pop3d/internal/config"
+	smpb "github.com/infodancer/session-manager/proto/sessionmanager/v1"
+)
+
+func TestDomainAccessCheck(t *testing.T) {
+	access, err := NewDomainAccess(map[string]config.DomainConfig{
+		"Example.com": {Access: []string{"allow 198.51.100.0/24", "deny all"}},
+		"example.org": {},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		username, ip string
+		want         bool
+	}{
+		{"alice@example.com", "198.51.100.9", true},
+		{"alice@EXAMPLE.COM", "192.0.2.1", false},
+		{"bob@example.org", "192.0.2.1", true},
+		{"carol", "192.0.2.1", true},
+		{"alice@example.com", "", true}, // unix listener
+	}
+	for _, tt := range tests {
+		if got, _ := access.Check(tt.username, tt.ip); got != tt.want {
+			t.Errorf("Check(%q, %q) = %v, want %v", tt.username, tt.ip, got, tt.want)
+		}
+	}
+
+	// Rules replaced on reload apply to the next login.
+	if err := access.Set(map[string]config.DomainConfig{"example.org": {Access: []string{"deny 192.0.2.0/24"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if allowed, _ := access.Check("alice@example.com", "192.0.2.1"); !allowed {
+		t.Error("removed rules still apply")
+	}
+	if allowed, rule := access.Check("bob@example.org", "192.0.2.1"); allowed || rule != "deny 192.0.2.0/24" {
+		t.Errorf("Check() = %v, %q; want denied by the new rule", allowed, rule)
+	}
+}
+
+func TestPassDeniedByDomainAccess(t *testing.T) {
+	access, err := NewDomainAccess(map[string]config.DomainConfig{
+		"example.com": {Access: []string{"allow 10.0.0.0/8", "deny all"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	svc := &mockSessionService{
+		loginFunc: func(ctx context.Context, req *smpb.LoginRequest) (*smpb.LoginResponse, error) {
+			t.Error("credentials checked for a denied address")
+			return &smpb.LoginResponse{}, nil
+		},
+	}
+	cmd := &passCommand{smClient: newTestSMClient(t, svc, &mockMailboxService{}), auth: AuthConfig{Access: access}}
+	sess := newTestSession(config.ModePop3s, true)
+	sess.SetClientIP("192.0.2.1")
+	sess.SetUsername("alice@example.com")
+
+	resp, err := cmd.Execute(context.Background(), sess, newMockConnection(), []string{"secret"})
+	if err != nil {
+		t.Fatalf("Execute() error = %v", err)
+	}
+	if got := resp.String(); got != "-ERR [SYS/PERM] Login not permitted from your address\r\n" {
+		t.Errorf("response = %q, want an access denied response", got)
+	}
+	if sess.State() != StateAuthorization {
+		t.Error("session authenticated despite the access rule")
+	}
+}
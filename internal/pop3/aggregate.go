@@ -0,0 +1,186 @@
+package pop3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/infodancer/msgstore"
+)
+
+// Compile-time assertions.
+var (
+	_ msgstore.MessageStore = (*aggregateStore)(nil)
+	_ io.Closer             = (*aggregateStore)(nil)
+)
+
+// maxUIDLFolder is the longest folder name used as-is in a folder-qualified
+// unique-id; RFC 1939 limits unique-ids to 70 characters.
+const maxUIDLFolder = 48
+
+// aggregatePart is one folder of a maildrop and its message list.
+type aggregatePart struct {
+	folder   string // "" is the inbox
+	store    msgstore.MessageStore
+	messages []msgstore.MessageInfo
+}
+
+// aggregateEntry locates a message of the virtual maildrop in its folder.
+type aggregateEntry struct {
+	part   int
+	uid    uint32
+	header string // prepended to the message; counted in its size
+}
+
+// aggregateStore presents the inbox and other folders as one maildrop.
+// Messages are renumbered with virtual UIDs, which map back to the folder and
+// UID they came from, so RETR, DELE and the UPDATE state reach the right folder.
+type aggregateStore struct {
+	parts   []aggregatePart
+	entries []aggregateEntry       // indexed by virtual UID - 1
+	list    []msgstore.MessageInfo // the virtual maildrop
+
+	mu    sync.Mutex   // deletions run in parallel
+	dirty map[int]bool // parts with messages marked deleted
+}
+
+// newAggregateStore merges the message lists of parts, inbox first. If header
+// is set, messages from other folders get a header naming their folder.
+func newAggregateStore(parts []aggregatePart, header string) *aggregateStore {
+	s := &aggregateStore{parts: parts, dirty: make(map[int]bool)}
+	for i, p := range parts {
+		var line string
+		if header != "" && p.folder != "" {
+			line = header + ": " + p.folder + "\r\n"
+		}
+		for _, m := range p.messages {
+			s.entries = append(s.entries, aggregateEntry{part: i, uid: m.UID, header: line})
+			s.list = append(s.list, msgstore.MessageInfo{
+				UID:  uint32(len(s.entries)),
+				Size: m.Size + int64(len(line)),
+			})
+		}
+	}
+	return s
+}
+
+// entry returns the entry for a virtual UID.
+func (s *aggregateStore) entry(uid uint32) (aggregateEntry, error) {
+	if uid == 0 || int(uid) > len(s.entries) {
+		return aggregateEntry{}, fmt.Errorf("%w: uid %d", ErrNoSuchMessage, uid)
+	}
+	return s.entries[uid-1], nil
+}
+
+// locate returns the folder and UID a virtual UID refers to.
+func (s *aggregateStore) locate(uid uint32) (string, uint32) {
+	e, err := s.entry(uid)
+	if err != nil {
+		return "", uid
+	}
+	return s.parts[e.part].folder, e.uid
+}
+
+// storeOf returns the store of the folder a virtual UID refers to.
+func (s *aggregateStore) storeOf(uid uint32) msgstore.MessageStore {
+	e, err := s.entry(uid)
+	if err != nil {
+		return nil
+	}
+	return s.parts[e.part].store
+}
+
+// uidl returns the unique-id of a message. Inbox messages keep their plain
+// UID, so enabling aggregation does not make clients download them again;
+// other messages are qualified with their folder.
+func (s *aggregateStore) uidl(uid uint32) string {
+	folder, uid := s.locate(uid)
+	id := strconv.FormatUint(uint64(uid), 10)
+	if folder == "" {
+		return id
+	}
+	return uidlFolder(folder) + "/" + id
+}
+
+// uidlFolder returns folder in a form allowed in a unique-id (printable ASCII
+// other than space), or a hash of it.
+func uidlFolder(folder string) string {
+	ok := len(folder) <= maxUIDLFolder
+	for i := 0; ok && i < len(folder); i++ {
+		ok = folder[i] > 0x20 && folder[i] < 0x7f
+	}
+	if ok {
+		return folder
+	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(folder))
+	return fmt.Sprintf("%08x", h.Sum32())
+}
+
+func (s *aggregateStore) List(ctx context.Context, mailbox string) ([]msgstore.MessageInfo, error) {
+	return s.list, nil
+}
+
+func (s *aggregateStore) Stat(ctx context.Context, mailbox string) (int, int64, error) {
+	var total int64
+	for _, m := range s.list {
+		total += m.Size
+	}
+	return len(s.list), total, nil
+}
+
+func (s *aggregateStore) Retrieve(ctx context.Context, mailbox string, uid uint32) (io.ReadCloser, error) {
+	e, err := s.entry(uid)
+	if err != nil {
+		return nil, err
+	}
+	rc, err := s.parts[e.part].store.Retrieve(ctx, mailbox, e.uid)
+	if err != nil || e.header == "" {
+		return rc, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(strings.NewReader(e.header), rc), rc}, nil
+}
+
+func (s *aggregateStore) Delete(ctx context.Context, mailbox string, uid uint32) error {
+	e, err := s.entry(uid)
+	if err != nil {
+		return err
+	}
+	if err := s.parts[e.part].store.Delete(ctx, mailbox, e.uid); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.dirty[e.part] = true
+	s.mu.Unlock()
+	return nil
+}
+
+// Expunge expunges each folder that had messages deleted.
+func (s *aggregateStore) Expunge(ctx context.Context, mailbox string) error {
+	var errs []error
+	for i, p := range s.parts {
+		if !s.dirty[i] {
+			continue
+		}
+		if err := p.store.Expunge(ctx, mailbox); err != nil {
+			errs = append(errs, fmt.Errorf("folder %q: %w", p.folder, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Close closes the inbox store, which holds the session the folders share.
+func (s *aggregateStore) Close() error {
+	if c, ok := s.parts[0].store.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
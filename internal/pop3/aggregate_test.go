@@ -0,0 +1,130 @@
+package pop3
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+
+	pb "github.com/infodancer/mail-session/proto/mailsession/v1"
+	"github.com/infodancer/pop3d/internal/config"
+	"google.golang.org/grpc"
+)
+
+func TestAggregateMaildrop(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		deleted  []string
+		expunged []string
+		folders  []string
+	)
+	mailboxSvc := folderMailboxSvc(&folders)
+	mailboxSvc.fetchFunc = func(req *pb.FetchRequest, stream grpc.ServerStreamingServer[pb.FetchResponse]) error {
+		return stream.Send(&pb.FetchResponse{Data: []byte("Subject: " + req.Folder + "\r\n\r\nbody\r\n")})
+	}
+	mailboxSvc.deleteFunc = func(ctx context.Context, req *pb.DeleteRequest) (*pb.DeleteResponse, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		deleted = append(deleted, fmt.Sprintf(":%d", req.Uid))
+		return &pb.DeleteResponse{}, nil
+	}
+	mailboxSvc.expungeFunc = func(ctx context.Context, req *pb.ExpungeRequest) (*pb.ExpungeResponse, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		expunged = append(expunged, req.Folder)
+		return &pb.ExpungeResponse{}, nil
+	}
+
+	smClient := newTestSMClient(t, defaultSessionSvc(), mailboxSvc)
+	sess := newTestSession(config.ModePop3s, true)
+	sess.SetMaildrop(MaildropConfig{Aggregate: []string{"Work", "Missing"}, FolderHeader: "X-Folder"}, nil)
+	sess.SetUsername("alice@example.com")
+	ctx := context.Background()
+	conn := newMockConnection()
+
+	if resp, err := (&passCommand{smClient: smClient}).Execute(ctx, sess, conn, []string{"secret"}); err != nil || !resp.OK {
+		t.Fatalf("PASS = %+v, %v", resp, err)
+	}
+	if sess.MessageCount() != 3 {
+		t.Fatalf("MessageCount() = %d, want 3", sess.MessageCount())
+	}
+
+	resp, _ := (&uidlCommand{}).Execute(ctx, sess, conn, nil)
+	if want := []string{"1 1", "2 2", "3 Work/7"}; !slices.Equal(resp.Lines, want) {
+		t.Errorf("UIDL = %q, want %q", resp.Lines, want)
+	}
+
+	header := "X-Folder: Work\r\n"
+	resp, _ = (&listCommand{}).Execute(ctx, sess, conn, []string{"3"})
+	if want := "3 116"; resp.Message != want {
+		t.Errorf("LIST 3 = %q, want %q (100 octets plus %d for the header)", resp.Message, want, len(header))
+	}
+
+	resp, _ = (&retrCommand{}).Execute(ctx, sess, conn, []string{"3"})
+	if !resp.OK {
+		t.Fatalf("RETR 3 = %+v", resp)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if !strings.HasPrefix(string(body), header+"Subject: Work\r\n") {
+		t.Errorf("RETR 3 body = %q, want the folder header before the message", body)
+	}
+
+	resp, _ = (&retrCommand{}).Execute(ctx, sess, conn, []string{"1"})
+	body, _ = io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if !strings.HasPrefix(string(body), "Subject: \r\n") {
+		t.Errorf("RETR 1 body = %q, want the inbox message without a folder header", body)
+	}
+
+	if resp, _ := (&deleCommand{}).Execute(ctx, sess, conn, []string{"1"}); !resp.OK {
+		t.Fatalf("DELE 1 = %+v", resp)
+	}
+	// Expunging Work would also remove what other clients marked deleted
+	if resp, _ := (&deleCommand{}).Execute(ctx, sess, conn, []string{"3"}); resp.OK {
+		t.Errorf("DELE 3 = %+v, want messages in folders refused", resp)
+	}
+	if resp, _ := (&quitCommand{}).Execute(ctx, sess, conn, nil); !resp.OK {
+		t.Fatalf("QUIT = %+v", resp)
+	}
+
+	slices.Sort(deleted)
+	slices.Sort(expunged)
+	if want := []string{":1"}; !slices.Equal(deleted, want) {
+		t.Errorf("deleted = %q, want %q", deleted, want)
+	}
+	if want := []string{""}; !slices.Equal(expunged, want) {
+		t.Errorf("expunged folders = %q, want %q", expunged, want)
+	}
+}
+
+func TestAggregateNotAppliedToFolderLogin(t *testing.T) {
+	var folders []string
+	smClient := newTestSMClient(t, defaultSessionSvc(), folderMailboxSvc(&folders))
+	sess := newTestSession(config.ModePop3s, true)
+	sess.SetMaildrop(MaildropConfig{Aggregate: []string{"Work"}}, nil)
+	sess.SetUsername("alice+Work@example.com")
+
+	cmd := &passCommand{smClient: smClient, auth: AuthConfig{Subaddress: Subaddressing{Separators: "+"}}}
+	if resp, err := cmd.Execute(context.Background(), sess, newMockConnection(), []string{"secret"}); err != nil || !resp.OK {
+		t.Fatalf("PASS = %+v, %v", resp, err)
+	}
+	if sess.Folder() != "Work" || sess.MessageCount() != 1 {
+		t.Errorf("folder = %q with %d messages, want Work with 1", sess.Folder(), sess.MessageCount())
+	}
+}
+
+func TestUIDLFolder(t *testing.T) {
+	if got := uidlFolder("Junk"); got != "Junk" {
+		t.Errorf("uidlFolder(Junk) = %q", got)
+	}
+	for _, folder := range []string{"Junk Mail", "Entwürfe", strings.Repeat("x", maxUIDLFolder+1)} {
+		got := uidlFolder(folder)
+		if len(got) != 8 || got == uidlFolder(folder+"2") {
+			t.Errorf("uidlFolder(%q) = %q, want a distinct 8-digit hash", folder, got)
+		}
+	}
+}
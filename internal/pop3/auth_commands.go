@@ -2,6 +2,7 @@ package pop3
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"strings"
 
@@ -97,6 +98,7 @@ func (u *userCommand) Execute(ctx context.Context, sess *Session, conn Connectio
 // passCommand implements the PASS command (RFC 1939).
 type passCommand struct {
 	smClient *SessionManagerClient
+	auth     AuthConfig
 }
 
 func (p *passCommand) Name() string {
@@ -125,34 +127,10 @@ func (p *passCommand) Execute(ctx context.Context, sess *Session, conn Connectio
 		return Response{OK: false, Message: "PASS command requires password argument"}, nil
 	}
 
-	password := args[0]
-
-	token, mailbox, err := p.smClient.Login(ctx, username, password)
-	if err != nil {
-		conn.Logger().Info("authentication failed",
-			"username", username,
-			"error", err.Error(),
-		)
-		return Response{OK: false, Message: "Authentication failed"}, nil
+	if err := login(ctx, p.smClient, p.auth, sess, conn, "", username, args[0]); err != nil {
+		return authFailure(err), nil
 	}
-
-	sess.SetAuthenticated(AuthenticatedUser{Username: username, Mailbox: mailbox})
-
-	store := newSessionManagerStore(p.smClient, token)
-	if err := sess.InitializeMailbox(ctx, store, ""); err != nil {
-		conn.Logger().Error("failed to initialize mailbox",
-			"username", username,
-			"mailbox", mailbox,
-			"error", err.Error(),
-		)
-		return Response{OK: false, Message: "Failed to access mailbox"}, nil
-	}
-
-	conn.Logger().Info("authentication successful",
-		"username", username,
-		"mailbox", mailbox,
-	)
-	return Response{OK: true, Message: fmt.Sprintf("Logged in as %s", username)}, nil
+	return Response{OK: true, Message: fmt.Sprintf("Logged in as %s", sess.Username())}, nil
 }
 
 // quitCommand implements the QUIT command (RFC 1939).
@@ -176,8 +154,38 @@ func (q *quitCommand) Execute(ctx context.Context, sess *Session, conn Connectio
 		message = "Goodbye"
 
 	case StateTransaction:
-		// Enter UPDATE state to commit changes (future: commit deletions)
+		// Enter UPDATE state and commit deletions; the response reports
+		// whether they were all removed (RFC 1939 section 6).
 		sess.EnterUpdate()
+		deleted := len(sess.GetDeletedUIDs())
+		err := sess.CommitDeletions(ctx)
+		// The maildrop is released before responding, so a client that
+		// reconnects at once does not find it still locked.
+		if err := sess.Cleanup(); err != nil {
+			conn.Logger().Error("failed to save access record", "error", err.Error())
+		}
+
+		var derr *DeleteError
+		if errors.As(err, &derr) {
+			for _, uid := range derr.UIDs() {
+				conn.Logger().Error("failed to delete message",
+					"uid", uid,
+					"error", derr.Failed[uid].Error(),
+				)
+			}
+			conn.Logger().Error("deleted messages not removed",
+				"username", sess.Username(),
+				"requested", deleted,
+				"failed", len(derr.Failed),
+			)
+			return Response{OK: false, Code: RespCodeSysTemp, Message: "Some deleted messages not removed"}, nil
+		}
+		if deleted > 0 {
+			conn.Logger().Info("expunged messages",
+				"username", sess.Username(),
+				"count", deleted,
+			)
+		}
 		message = "Logging out"
 
 	default:
@@ -190,6 +198,7 @@ func (q *quitCommand) Execute(ctx context.Context, sess *Session, conn Connectio
 // authCommand implements the AUTH command (RFC 5034).
 type authCommand struct {
 	smClient *SessionManagerClient
+	auth     AuthConfig
 }
 
 func (a *authCommand) Name() string {
@@ -216,13 +225,13 @@ func (a *authCommand) Execute(ctx context.Context, sess *Session, conn Connectio
 
 	// Check if mechanism is supported
 	supported := false
-	for _, mech := range SupportedSASLMechanisms() {
+	for _, mech := range a.auth.Mechanisms() {
 		if strings.EqualFold(mech, mechanism) {
 			supported = true
 			break
 		}
 	}
-	if !supported {
+	if !supported || !sess.AllowsMechanism(mechanism) {
 		return Response{OK: false, Message: fmt.Sprintf("Unsupported mechanism: %s", mechanism)}, nil
 	}
 
@@ -231,8 +240,12 @@ func (a *authCommand) Execute(ctx context.Context, sess *Session, conn Connectio
 	switch mechanism {
 	case sasl.Plain:
 		server = sasl.NewPlainServer(func(identity, username, password string) error {
-			return a.saslAuthenticate(ctx, sess, conn, mechanism, username, password)
+			return saslLogin(login(ctx, a.smClient, a.auth, sess, conn, mechanism, username, password))
 		})
+	case sasl.Login:
+		server = &loginServer{authenticate: func(username, password string) error {
+			return saslLogin(login(ctx, a.smClient, a.auth, sess, conn, mechanism, username, password))
+		}}
 	default:
 		return Response{OK: false, Message: fmt.Sprintf("Unsupported mechanism: %s", mechanism)}, nil
 	}
@@ -259,44 +272,115 @@ func (a *authCommand) Execute(ctx context.Context, sess *Session, conn Connectio
 		return a.processSASLStep(ctx, sess, conn, initialResponse)
 	}
 
-	// No initial response - send empty challenge to request credentials
-	return Response{Continuation: true, Challenge: ""}, nil
+	// No initial response - the mechanism sends its first challenge
+	// (empty for most mechanisms, a username prompt for LOGIN)
+	return a.processSASLStep(ctx, sess, conn, nil)
 }
 
-// saslAuthenticate handles SASL PLAIN via session-manager.
-func (a *authCommand) saslAuthenticate(ctx context.Context, sess *Session, conn ConnectionLogger, mechanism, username, password string) error {
-	token, mailbox, err := a.smClient.Login(ctx, username, password)
+// login runs the steps shared by USER/PASS and the SASL mechanisms: a
+// user+folder@domain login authenticates as user@domain, a bare username
+// takes the virtual host's login domain, and the virtual host and the
+// user's domain must permit the login before the session-manager checks
+// the password. A user or domain over its session limit is turned away
+// only once the password is accepted, so that the refusal tells nothing
+// about the account to a client without it. The username is recorded on the
+// session so that login throttling counts the attempt against the account.
+// mechanism is empty for USER/PASS.
+func login(ctx context.Context, smClient *SessionManagerClient, auth AuthConfig, sess *Session, conn ConnectionLogger, mechanism, name, password string) error {
+	username, folder := auth.Subaddress.Split(sess.VirtualHost().Qualify(name))
+	sess.SetLoginUser(username)
+	if err := permitVirtualHost(sess, conn, mechanism, username); err != nil {
+		return err
+	}
+	if err := permitAccess(auth.Access, sess, conn, mechanism, username); err != nil {
+		return err
+	}
+	token, mailbox, err := smClient.Login(ctx, username, password)
 	if err != nil {
-		conn.Logger().Info("SASL authentication failed",
-			"mechanism", mechanism,
-			"username", username,
-			"error", err.Error(),
-		)
+		conn.Logger().Info("authentication failed",
+			withMechanism(mechanism, "username", username, "error", err.Error())...)
+		return err
+	}
+	if err := sess.AcquireSessionSlot(username); err != nil {
+		conn.Logger().Info("login rejected: session limit",
+			withMechanism(mechanism, "username", username, "error", err.Error())...)
+		if logoutErr := smClient.Logout(ctx, token); logoutErr != nil {
+			conn.Logger().Warn("failed to log out of the session-manager",
+				withMechanism(mechanism, "username", username, "error", logoutErr.Error())...)
+		}
 		return err
 	}
+	return startSession(ctx, smClient, sess, conn, mechanism, username, folder, token, mailbox)
+}
+
+// withMechanism prepends the SASL mechanism, if any, to log attributes.
+func withMechanism(mechanism string, attrs ...any) []any {
+	if mechanism == "" {
+		return attrs
+	}
+	return append([]any{"mechanism", mechanism}, attrs...)
+}
 
+// permitVirtualHost refuses users that the session's virtual host does not
+// permit to log in.
+func permitVirtualHost(sess *Session, conn ConnectionLogger, mechanism, username string) error {
+	if sess.VirtualHost().Permits(username) {
+		return nil
+	}
+	conn.Logger().Info("authentication failed",
+		withMechanism(mechanism, "username", username, "error", "user not permitted on this virtual host")...)
+	return ErrAuthFailed
+}
+
+// permitAccess refuses users whose domain does not permit logins from the
+// client's address. It runs before the credentials are checked, so that the
+// response tells nothing about them.
+func permitAccess(access *DomainAccess, sess *Session, conn ConnectionLogger, mechanism, username string) error {
+	allowed, rule := access.Check(username, sess.ClientIP())
+	if allowed {
+		return nil
+	}
+	conn.Logger().Warn("login rejected: access denied",
+		withMechanism(mechanism, "username", username, "rule", rule, "error", "access denied for the user's domain")...)
+	return ErrAccessDenied
+}
+
+// startSession marks the session authenticated and loads the mailbox (or the
+// folder within it) behind a session-manager token.
+func startSession(ctx context.Context, smClient *SessionManagerClient, sess *Session, conn ConnectionLogger, mechanism, username, folder, token, mailbox string) error {
 	sess.SetAuthenticated(AuthenticatedUser{Username: username, Mailbox: mailbox})
 	sess.SetUsername(username)
 
-	store := newSessionManagerStore(a.smClient, token)
-	if err := sess.InitializeMailbox(ctx, store, ""); err != nil {
+	store := newSessionManagerStore(smClient, token)
+	if err := sess.InitializeMailbox(ctx, store, folder); err != nil {
 		conn.Logger().Error("failed to initialize mailbox",
-			"mechanism", mechanism,
-			"username", username,
-			"mailbox", mailbox,
-			"error", err.Error(),
-		)
-		return err
+			withMechanism(mechanism, "username", username, "mailbox", mailbox, "folder", folder, "error", err.Error())...)
+		sess.AbortAuthentication()
+		return fmt.Errorf("%w: %w", ErrMailboxUnavailable, err)
 	}
 
-	conn.Logger().Info("SASL authentication successful",
-		"mechanism", mechanism,
-		"username", username,
-		"mailbox", mailbox,
-	)
+	conn.Logger().Info("authentication successful",
+		withMechanism(mechanism, "username", username, "mailbox", mailbox, "folder", sess.Folder())...)
 	return nil
 }
 
+// saslLoginError carries the error of a login made by a SASL mechanism, so
+// that it can be told apart from the mechanism's own errors.
+type saslLoginError struct {
+	err error
+}
+
+func (e *saslLoginError) Error() string { return e.err.Error() }
+func (e *saslLoginError) Unwrap() error { return e.err }
+
+// saslLogin marks a failed login for processSASLStep.
+func saslLogin(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &saslLoginError{err: err}
+}
+
 // processSASLStep processes a SASL response and returns the next challenge or completion.
 func (a *authCommand) processSASLStep(ctx context.Context, sess *Session, conn ConnectionLogger, response []byte) (Response, error) {
 	server := sess.SASLServer()
@@ -308,7 +392,13 @@ func (a *authCommand) processSASLStep(ctx context.Context, sess *Session, conn C
 	challenge, done, err := server.Next(response)
 	if err != nil {
 		sess.ClearSASL()
-		return Response{OK: false, Message: "Authentication failed"}, nil
+		// Any error that did not come from the login is a malformed
+		// exchange, which is the client's failure like a wrong password.
+		var le *saslLoginError
+		if !errors.As(err, &le) {
+			err = fmt.Errorf("%w: %w", ErrAuthFailed, err)
+		}
+		return authFailure(err), nil
 	}
 
 	if done {
@@ -341,12 +431,13 @@ func (a *authCommand) ProcessSASLResponse(ctx context.Context, sess *Session, co
 }
 
 // RegisterAuthCommands registers all authentication-related commands.
-// Authentication is delegated to the session-manager via smClient.
-func RegisterAuthCommands(smClient *SessionManagerClient) {
+// Authentication is delegated to the session-manager via smClient; auth
+// selects the SASL mechanisms offered in addition to PLAIN.
+func RegisterAuthCommands(smClient *SessionManagerClient, auth AuthConfig) {
 	RegisterCommand(&capaCommand{})
 	RegisterCommand(&stlsCommand{})
 	RegisterCommand(&userCommand{})
-	RegisterCommand(&passCommand{smClient: smClient})
-	RegisterCommand(&authCommand{smClient: smClient})
+	RegisterCommand(&passCommand{smClient: smClient, auth: auth})
+	RegisterCommand(&authCommand{smClient: smClient, auth: auth})
 	RegisterCommand(&quitCommand{})
 }
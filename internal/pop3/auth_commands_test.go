@@ -4,8 +4,10 @@ import (
 	"context"
 	"crypto/tls"
 	"log/slog"
+	"slices"
 	"testing"
 
+	"github.com/infodancer/msgstore"
 	"github.com/infodancer/pop3d/internal/config"
 	smpb "github.com/infodancer/session-manager/proto/sessionmanager/v1"
 	"google.golang.org/grpc/codes"
@@ -90,7 +92,7 @@ func TestCapaCommand(t *testing.T) {
 			args:         []string{},
 			wantOK:       true,
 			wantMessage:  "Capability list follows",
-			wantCapCount: 3, // TOP, UIDL, RESP-CODES (no USER, no STLS without TLS config)
+			wantCapCount: 5, // TOP, UIDL, PIPELINING, RESP-CODES, AUTH-RESP-CODE (no USER, no STLS without TLS config)
 		},
 		{
 			name:         "CAPA with TLS shows USER and SASL",
@@ -98,7 +100,7 @@ func TestCapaCommand(t *testing.T) {
 			args:         []string{},
 			wantOK:       true,
 			wantMessage:  "Capability list follows",
-			wantCapCount: 5, // USER, TOP, UIDL, RESP-CODES, SASL PLAIN
+			wantCapCount: 7, // USER, TOP, UIDL, PIPELINING, RESP-CODES, AUTH-RESP-CODE, SASL PLAIN
 		},
 		{
 			name:        "CAPA with arguments fails",
@@ -422,12 +424,39 @@ func TestQuitCommand(t *testing.T) {
 	}
 }
 
+func TestQuitCommandReportsFailedDeletions(t *testing.T) {
+	store := &recordingStore{
+		messages:   []msgstore.MessageInfo{{UID: 1}, {UID: 2}},
+		failDelete: map[uint32]bool{2: true},
+	}
+	sess := newAuthenticatedSession()
+	if err := sess.InitializeMailbox(context.Background(), store, ""); err != nil {
+		t.Fatalf("InitializeMailbox: %v", err)
+	}
+	_ = sess.MarkDeleted(1)
+	_ = sess.MarkDeleted(2)
+
+	resp, err := (&quitCommand{}).Execute(context.Background(), sess, newMockConnection(), nil)
+	if err != nil {
+		t.Fatalf("Execute() error = %v", err)
+	}
+	if resp.OK || resp.String() != "-ERR [SYS/TEMP] Some deleted messages not removed\r\n" {
+		t.Errorf("QUIT = %q, want -ERR some deleted messages not removed", resp.String())
+	}
+	if sess.State() != StateUpdate {
+		t.Errorf("state = %v, want UPDATE", sess.State())
+	}
+	if !slices.Equal(store.deleted, []uint32{1}) || !store.expunged {
+		t.Errorf("deleted = %v, expunged = %v; want [1], true", store.deleted, store.expunged)
+	}
+}
+
 func TestCommandRegistry(t *testing.T) {
 	// Clear the registry first
 	commandRegistry = make(map[string]Command)
 
 	// Register test commands — nil smClient is fine for registry tests
-	RegisterAuthCommands(nil)
+	RegisterAuthCommands(nil, AuthConfig{})
 
 	tests := []struct {
 		name      string
@@ -676,6 +705,89 @@ func TestAuthSASLMultiStep(t *testing.T) {
 	}
 }
 
+func TestAuthSASLLogin(t *testing.T) {
+	smClient := newTestSMClient(t, defaultSessionSvc(), &mockMailboxService{})
+	cmd := &authCommand{smClient: smClient, auth: AuthConfig{Login: true}}
+	conn := newMockConnection()
+
+	usernamePrompt := EncodeSASLChallenge([]byte("Username:"))
+	passwordPrompt := EncodeSASLChallenge([]byte("Password:"))
+
+	t.Run("prompted username and password", func(t *testing.T) {
+		sess := newTestSession(config.ModePop3s, true)
+
+		resp, err := cmd.Execute(context.Background(), sess, conn, []string{"LOGIN"})
+		if err != nil || !resp.Continuation || resp.Challenge != usernamePrompt {
+			t.Fatalf("AUTH LOGIN = %+v, %v; want username prompt", resp, err)
+		}
+
+		resp, err = cmd.ProcessSASLResponse(context.Background(), sess, conn, EncodeSASLChallenge([]byte("alice")))
+		if err != nil || !resp.Continuation || resp.Challenge != passwordPrompt {
+			t.Fatalf("username step = %+v, %v; want password prompt", resp, err)
+		}
+		if sess.State() != StateAuthorization {
+			t.Fatal("authenticated before password was sent")
+		}
+
+		resp, err = cmd.ProcessSASLResponse(context.Background(), sess, conn, EncodeSASLChallenge([]byte("secret")))
+		if err != nil || !resp.OK {
+			t.Fatalf("password step = %+v, %v; want +OK", resp, err)
+		}
+		if sess.State() != StateTransaction || sess.Username() != "alice" {
+			t.Errorf("state = %v, username = %q; want TRANSACTION, alice", sess.State(), sess.Username())
+		}
+		if sess.IsSASLInProgress() {
+			t.Error("SASL should be cleared after completion")
+		}
+	})
+
+	t.Run("username as initial response", func(t *testing.T) {
+		sess := newTestSession(config.ModePop3s, true)
+
+		resp, err := cmd.Execute(context.Background(), sess, conn, []string{"LOGIN", EncodeSASLChallenge([]byte("alice"))})
+		if err != nil || !resp.Continuation || resp.Challenge != passwordPrompt {
+			t.Fatalf("AUTH LOGIN <user> = %+v, %v; want password prompt", resp, err)
+		}
+
+		resp, err = cmd.ProcessSASLResponse(context.Background(), sess, conn, EncodeSASLChallenge([]byte("secret")))
+		if err != nil || !resp.OK {
+			t.Fatalf("password step = %+v, %v; want +OK", resp, err)
+		}
+	})
+
+	t.Run("wrong password", func(t *testing.T) {
+		failing := &authCommand{
+			smClient: newTestSMClient(t, failingSessionSvc(), &mockMailboxService{}),
+			auth:     AuthConfig{Login: true},
+		}
+		sess := newTestSession(config.ModePop3s, true)
+
+		if _, err := failing.Execute(context.Background(), sess, conn, []string{"LOGIN", EncodeSASLChallenge([]byte("alice"))}); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := failing.ProcessSASLResponse(context.Background(), sess, conn, EncodeSASLChallenge([]byte("wrong")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.OK || resp.Continuation || resp.Message != "Authentication failed" {
+			t.Errorf("resp = %+v, want -ERR Authentication failed", resp)
+		}
+	})
+
+	t.Run("disabled by default", func(t *testing.T) {
+		sess := newTestSession(config.ModePop3s, true)
+		plain := &authCommand{smClient: smClient}
+
+		resp, err := plain.Execute(context.Background(), sess, conn, []string{"LOGIN"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.OK || resp.Message != "Unsupported mechanism: LOGIN" {
+			t.Errorf("resp = %+v, want unsupported mechanism", resp)
+		}
+	})
+}
+
 func TestCapabilitiesIncludeSASL(t *testing.T) {
 	// With TLS active, SASL should be advertised
 	sess := newTestSession(config.ModePop3s, true)
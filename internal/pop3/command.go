@@ -3,6 +3,7 @@ package pop3
 import (
 	"context"
 	"fmt"
+	"io"
 	"log/slog"
 	"strings"
 	"sync"
@@ -29,6 +30,10 @@ type Response struct {
 	// OK indicates success (+OK) or failure (-ERR).
 	OK bool
 
+	// Code is the optional extended response code (RFC 2449, RFC 3206),
+	// written in brackets before Message.
+	Code RespCode
+
 	// Message is the response message (without +OK/-ERR prefix).
 	Message string
 
@@ -43,6 +48,15 @@ type Response struct {
 	// Challenge is the base64-encoded SASL challenge data.
 	// Only used when Continuation is true.
 	Challenge string
+
+	// Body streams multi-line response data (for RETR and TOP) instead of Lines.
+	// It is CRLF-normalized and dot-stuffed as it is copied to the connection,
+	// so a message is never held in memory in full. WriteTo closes Body.
+	Body io.ReadCloser
+
+	// Sent, if set, is called by the handler once the whole response,
+	// including any Body, has been written to the connection.
+	Sent func()
 }
 
 // String formats the response as a POP3 protocol string.
@@ -63,6 +77,12 @@ func (r Response) String() string {
 		sb.WriteString("-ERR")
 	}
 
+	if r.Code != "" {
+		sb.WriteString(" [")
+		sb.WriteString(string(r.Code))
+		sb.WriteString("]")
+	}
+
 	if r.Message != "" {
 		sb.WriteString(" ")
 		sb.WriteString(r.Message)
@@ -70,8 +90,8 @@ func (r Response) String() string {
 
 	sb.WriteString("\r\n")
 
-	// Add multi-line data if present
-	if len(r.Lines) > 0 {
+	// Add multi-line data if present; a streamed Body is written by WriteTo
+	if len(r.Lines) > 0 && r.Body == nil {
 		for _, line := range r.Lines {
 			// Byte-stuff lines that start with "."
 			if strings.HasPrefix(line, ".") {
@@ -86,6 +106,30 @@ func (r Response) String() string {
 	return sb.String()
 }
 
+// WriteTo writes the response to w, streaming Body after the status line
+// if present. Body is always closed, even when writing fails part way.
+func (r Response) WriteTo(w io.Writer) (int64, error) {
+	if r.Body != nil {
+		defer func() {
+			_ = r.Body.Close()
+		}()
+	}
+
+	n, err := io.WriteString(w, r.String())
+	written := int64(n)
+	if err != nil || r.Body == nil {
+		return written, err
+	}
+
+	dw := newDotStuffWriter(w)
+	copied, err := io.Copy(dw, r.Body)
+	written += copied
+	if err != nil {
+		return written, err
+	}
+	return written, dw.Close()
+}
+
 // commandRegistry holds all registered commands.
 var (
 	commandRegistry   = make(map[string]Command)
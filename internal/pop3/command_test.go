@@ -1,6 +1,8 @@
 package pop3
 
 import (
+	"bytes"
+	"strings"
 	"testing"
 )
 
@@ -102,3 +104,21 @@ func stringSlicesEqual(a, b []string) bool {
 	}
 	return true
 }
+
+func TestResponseWriteTo_Body(t *testing.T) {
+	body := &closeTracker{Reader: strings.NewReader("Subject: x\n\n.dot\nend")}
+	resp := Response{OK: true, Message: "12 octets", Body: body}
+
+	var buf bytes.Buffer
+	if _, err := resp.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo() error = %v", err)
+	}
+
+	want := "+OK 12 octets\r\nSubject: x\r\n\r\n..dot\r\nend\r\n.\r\n"
+	if got := buf.String(); got != want {
+		t.Errorf("WriteTo() = %q, want %q", got, want)
+	}
+	if !body.closed {
+		t.Error("WriteTo() did not close Body")
+	}
+}
@@ -0,0 +1,98 @@
+package pop3
+
+import "io"
+
+var (
+	crlf       = []byte("\r\n")
+	dot        = []byte(".")
+	terminator = []byte(".\r\n")
+)
+
+// dotStuffWriter encodes a message as the body of a POP3 multi-line response
+// (RFC 1939 section 3). Line endings (LF, CRLF or bare CR) are normalized to
+// CRLF and lines beginning with "." are byte-stuffed. Input may be split at any
+// byte boundary across calls to Write. Close terminates the final line if
+// needed and writes the "." terminator.
+type dotStuffWriter struct {
+	w           io.Writer
+	atLineStart bool
+	pendingCR   bool
+}
+
+// newDotStuffWriter returns a dotStuffWriter that writes to w.
+func newDotStuffWriter(w io.Writer) *dotStuffWriter {
+	return &dotStuffWriter{w: w, atLineStart: true}
+}
+
+// Write encodes p and writes it to the underlying writer. It returns len(p)
+// on success, i.e. the number of input bytes consumed.
+func (d *dotStuffWriter) Write(p []byte) (int, error) {
+	start := 0
+	for i, b := range p {
+		// A CR not followed by LF is a bare CR; treat it as a line break.
+		if d.pendingCR && b != '\n' {
+			if err := d.writeLineEnd(); err != nil {
+				return 0, err
+			}
+		}
+
+		switch b {
+		case '\r':
+			if err := d.write(p[start:i]); err != nil {
+				return 0, err
+			}
+			start = i + 1
+			d.pendingCR = true
+		case '\n':
+			if err := d.write(p[start:i]); err != nil {
+				return 0, err
+			}
+			start = i + 1
+			if err := d.writeLineEnd(); err != nil {
+				return 0, err
+			}
+		case '.':
+			if d.atLineStart {
+				if err := d.write(p[start:i]); err != nil {
+					return 0, err
+				}
+				if err := d.write(dot); err != nil {
+					return 0, err
+				}
+				start = i
+			}
+			d.atLineStart = false
+		default:
+			d.atLineStart = false
+		}
+	}
+	if err := d.write(p[start:]); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close ends an unterminated final line and writes the "." terminator.
+// It does not close the underlying writer.
+func (d *dotStuffWriter) Close() error {
+	if d.pendingCR || !d.atLineStart {
+		if err := d.writeLineEnd(); err != nil {
+			return err
+		}
+	}
+	return d.write(terminator)
+}
+
+func (d *dotStuffWriter) writeLineEnd() error {
+	d.pendingCR = false
+	d.atLineStart = true
+	return d.write(crlf)
+}
+
+func (d *dotStuffWriter) write(b []byte) error {
+	if len(b) == 0 {
+		return nil
+	}
+	_, err := d.w.Write(b)
+	return err
+}
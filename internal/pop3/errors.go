@@ -31,6 +31,33 @@ var (
 	// ErrMessageDeleted is returned when accessing a message marked for deletion.
 	ErrMessageDeleted = errors.New("message already deleted")
 
+	// ErrMailboxUnavailable is returned when the mailbox cannot be opened after
+	// a successful login.
+	ErrMailboxUnavailable = errors.New("mailbox unavailable")
+
+	// ErrMaildropLocked is returned when another session holds the maildrop lock.
+	ErrMaildropLocked = errors.New("maildrop locked by another session")
+
+	// ErrLoginDelay is returned when a user logs in again before their LOGIN-DELAY has passed.
+	ErrLoginDelay = errors.New("login delay not yet passed")
+
+	// ErrTooManyUserSessions is returned when a user already has as many
+	// sessions as max_sessions_per_user allows.
+	ErrTooManyUserSessions = errors.New("too many sessions for user")
+
+	// ErrTooManyDomainSessions is returned when a domain's users already have
+	// as many sessions as max_sessions_per_domain allows.
+	ErrTooManyDomainSessions = errors.New("too many sessions for domain")
+
+	// ErrAccessDenied is returned when the user's domain does not permit
+	// logins from the client's address.
+	ErrAccessDenied = errors.New("access denied from client address")
+
+	// ErrFolderReadOnly is returned when a message outside the inbox is
+	// deleted. The session-manager can only expunge a whole folder, which
+	// would also remove messages other clients have marked \Deleted.
+	ErrFolderReadOnly = errors.New("messages in folders cannot be deleted")
+
 	// ErrMailboxNotInitialized is returned when mailbox is accessed before auth.
 	ErrMailboxNotInitialized = errors.New("mailbox not initialized")
 )
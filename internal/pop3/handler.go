@@ -1,12 +1,15 @@
 package pop3
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"net"
 	"strings"
+	"time"
 
 	"github.com/infodancer/logging"
 	"github.com/infodancer/pop3d/internal/config"
@@ -16,23 +19,44 @@ import (
 
 // Handler creates a POP3 protocol handler with the given configuration.
 // Authentication and mailbox operations are delegated to the session-manager.
-func Handler(hostname string, smClient *SessionManagerClient, tlsConfig *tls.Config, collector metrics.Collector) server.ConnectionHandler {
-	RegisterAuthCommands(smClient)
+// maildrop sets the locking and LOGIN-DELAY/EXPIRE policies for maildrops.
+// vhosts, if not nil, assigns TLS sessions to virtual hosts by SNI.
+func Handler(hostname string, smClient *SessionManagerClient, tlsConfig *tls.Config, collector metrics.Collector, auth AuthConfig, maildrop MaildropConfig, vhosts *VirtualHosts) server.ConnectionHandler {
+	RegisterAuthCommands(smClient, auth)
 	RegisterTransactionCommands()
 
 	return func(ctx context.Context, conn *server.Connection) {
-		handleConnection(ctx, conn, hostname, tlsConfig, collector)
+		handleConnection(ctx, conn, hostname, tlsConfig, collector, auth, maildrop, vhosts)
 	}
 }
 
 // handleConnection manages a single POP3 connection.
-func handleConnection(ctx context.Context, conn *server.Connection, hostname string, tlsConfig *tls.Config, collector metrics.Collector) {
+func handleConnection(ctx context.Context, conn *server.Connection, hostname string, tlsConfig *tls.Config, collector metrics.Collector, auth AuthConfig, maildrop MaildropConfig, vhosts *VirtualHosts) {
 	logger := logging.FromContext(ctx)
 
+	// The session can be ended from outside when a newer session takes over
+	// its maildrop lock. Closing the connection unblocks a pending read.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
 	// Record connection opened
 	collector.ConnectionOpened()
 	defer collector.ConnectionClosed()
 
+	// Report the timeout, if any, that ended the session
+	defer func() {
+		if timeout := conn.TimedOut(); timeout != "" {
+			conn.Logger().Info("session timed out", "timeout", timeout)
+			collector.SessionTimedOut(timeout)
+		}
+	}()
+
+	// Prefer the accepting listener's TLS configuration, which may request
+	// client certificates.
+	if c := conn.TLSConfig(); c != nil {
+		tlsConfig = c
+	}
+
 	// Determine listener mode based on connection state
 	// If already TLS, assume ModePop3s; otherwise ModePop3
 	listenerMode := config.ModePop3
@@ -41,12 +65,68 @@ func handleConnection(ctx context.Context, conn *server.Connection, hostname str
 		collector.TLSConnectionEstablished()
 	}
 
+	// A trusted proxy that terminated TLS for the client reports it in its
+	// PROXY header; the session is then as secure as one over TLS.
+	isTLS := conn.IsTLS()
+	if conn.TLSOffloaded() {
+		isTLS = true
+		collector.TLSConnectionEstablished()
+	}
+
+	// A unix socket never leaves the host, so plaintext over it is treated
+	// as secure.
+	if conn.IsUnix() {
+		isTLS = true
+	}
+
+	// The accepting listener may override the hostname and the login policy
+	lc := conn.ListenerConfig()
+	if lc.Hostname != "" {
+		hostname = lc.Hostname
+	}
+
 	// Create session
-	sess := NewSession(hostname, listenerMode, tlsConfig, conn.IsTLS())
+	sess := NewSession(hostname, listenerMode, tlsConfig, isTLS)
+	sess.SetSASLMechanisms(auth.Mechanisms())
+	sess.SetListenerMechanisms(lc.Mechanisms)
+	if lc.AllowInsecureAuth {
+		sess.SetInsecureAuth(true)
+	} else if lc.RequireTLSForAuth {
+		sess.SetInsecureAuth(false)
+	}
+	sess.SetMaildrop(maildrop, func() {
+		conn.Logger().Info("maildrop taken over by a new session, closing connection")
+		cancel()
+		_ = conn.Close()
+	})
 	if host, _, err := net.SplitHostPort(conn.RemoteAddr().String()); err == nil {
 		sess.SetClientIP(host)
 	}
-	defer sess.Cleanup()
+	defer func() {
+		if err := sess.Cleanup(); err != nil {
+			logger.Error("failed to save access record", "error", err.Error())
+		}
+	}()
+
+	// For POP3S, complete the handshake first so that the greeting can name
+	// the virtual host the client asked for.
+	if conn.IsTLS() {
+		if err := conn.Handshake(); err != nil {
+			logger.Info("TLS handshake failed", "error", err.Error())
+			return
+		}
+		selectVirtualHost(conn, sess, vhosts, collector)
+		logger = conn.Logger()
+	}
+
+	// Plaintext on a unix socket is trusted, so record who is connecting.
+	if creds, ok := conn.PeerCredentials(); ok {
+		logger.Info("unix socket peer",
+			"uid", creds.UID,
+			"gid", creds.GID,
+			"pid", creds.PID,
+		)
+	}
 
 	logger.Info("starting POP3 session",
 		"state", sess.State().String(),
@@ -54,7 +134,7 @@ func handleConnection(ctx context.Context, conn *server.Connection, hostname str
 	)
 
 	// Send greeting
-	greeting := fmt.Sprintf("+OK %s POP3 server ready\r\n", hostname)
+	greeting := fmt.Sprintf("+OK %s POP3 server ready\r\n", sess.VirtualHost().Greeting(hostname))
 	if _, err := conn.Writer().WriteString(greeting); err != nil {
 		logger.Error("failed to send greeting", "error", err.Error())
 		return
@@ -80,32 +160,54 @@ func handleConnection(ctx context.Context, conn *server.Connection, hostname str
 			return
 		}
 
-		// Set command timeout
-		if err := conn.SetCommandTimeout(); err != nil {
+		// Wait for the command as long as the session's state allows
+		if err := conn.SetCommandTimeout(sess.IsAuthenticated()); err != nil {
 			logger.Error("failed to set command timeout", "error", err.Error())
 			return
 		}
 
-		// Read command line
-		line, err := conn.Reader().ReadString('\n')
+		// On shutdown the session ends between commands. Drain interrupts
+		// the read below if it starts after this check.
+		if conn.Draining() {
+			endDrainedSession(conn, sess)
+			return
+		}
+
+		// Read command line. AUTH and SASL responses may carry large tokens;
+		// other commands are held to the RFC 2449 limit.
+		line, err := conn.ReadLine(conn.MaxAuthLine())
+		if err == nil && len(line) > config.MaxCommandLine && !sess.IsSASLInProgress() && !isAuthLine(line) {
+			err = server.ErrLineTooLong
+		}
+		if errors.Is(err, server.ErrLineTooLong) {
+			// An overlong SASL response cancels the exchange
+			sess.ClearSASL()
+			if rejectCommand(conn, sess, collector, "line_too_long", "Command line too long") {
+				return
+			}
+			continue
+		}
 		if err != nil {
+			if conn.Draining() {
+				endDrainedSession(conn, sess)
+				return
+			}
 			if err == io.EOF {
 				logger.Info("client closed connection")
 				return
 			}
+			// A timeout is reported as the session ends
+			if conn.TimedOut() != "" {
+				return
+			}
 			logger.Error("error reading command", "error", err.Error())
 			return
 		}
 
-		// Reset idle timeout after successful read
-		if err := conn.ResetIdleTimeout(); err != nil {
-			logger.Error("failed to reset idle timeout", "error", err.Error())
-			return
-		}
-
-		// Trim whitespace
+		// Trim whitespace. An empty line is a valid SASL response, so only
+		// skip it outside an exchange.
 		line = strings.TrimSpace(line)
-		if line == "" {
+		if line == "" && !sess.IsSASLInProgress() {
 			continue
 		}
 
@@ -123,7 +225,7 @@ func handleConnection(ctx context.Context, conn *server.Connection, hostname str
 			}
 
 			// Type assert to access ProcessSASLResponse
-			auth, ok := authCmd.(*authCommand)
+			saslCmd, ok := authCmd.(*authCommand)
 			if !ok {
 				logger.Error("AUTH command has wrong type")
 				sess.ClearSASL()
@@ -132,20 +234,21 @@ func handleConnection(ctx context.Context, conn *server.Connection, hostname str
 			}
 
 			// Process the SASL response
-			resp, err := auth.ProcessSASLResponse(ctx, sess, conn, line)
+			resp, err := saslCmd.ProcessSASLResponse(ctx, sess, conn, line)
 			if err != nil {
 				logger.Error("SASL processing error", "error", err.Error())
 				sess.ClearSASL()
 				sendError(conn, logger, "Internal server error")
 				continue
 			}
+			endSession := throttleAuth(ctx, conn, sess, auth.Throttle, resp)
 
 			// Send response
 			if _, err := conn.Writer().WriteString(resp.String()); err != nil {
 				logger.Error("failed to send response", "error", err.Error())
 				return
 			}
-			if err := conn.Flush(); err != nil {
+			if err := flushUnlessPipelined(conn); err != nil {
 				logger.Error("failed to flush response", "error", err.Error())
 				return
 			}
@@ -156,6 +259,10 @@ func handleConnection(ctx context.Context, conn *server.Connection, hostname str
 				collector.AuthAttempt(domain, resp.OK)
 				collector.CommandProcessed("AUTH")
 			}
+			if endSession {
+				logger.Info("too many failed logins, closing connection")
+				return
+			}
 
 			continue
 		}
@@ -163,14 +270,18 @@ func handleConnection(ctx context.Context, conn *server.Connection, hostname str
 		// Parse command
 		cmdName, args, err := ParseCommand(line)
 		if err != nil {
-			sendError(conn, logger, "Invalid command")
+			if rejectCommand(conn, sess, collector, "invalid", "Invalid command") {
+				return
+			}
 			continue
 		}
 
 		// Look up command
 		cmd, ok := GetCommand(cmdName)
 		if !ok {
-			sendError(conn, logger, "Unknown command")
+			if rejectCommand(conn, sess, collector, "unknown", "Unknown command") {
+				return
+			}
 			continue
 		}
 
@@ -193,15 +304,31 @@ func handleConnection(ctx context.Context, conn *server.Connection, hostname str
 			continue
 		}
 
-		// Send response
-		if _, err := conn.Writer().WriteString(resp.String()); err != nil {
+		// A failed login is answered only after the throttle's delay
+		endSession := false
+		if cmdName == "PASS" || cmdName == "AUTH" {
+			endSession = throttleAuth(ctx, conn, sess, auth.Throttle, resp)
+		}
+
+		// Send response; RETR/TOP bodies are streamed straight to the connection.
+		// A failure part way through a multi-line body cannot be reported to the
+		// client, so the connection is dropped. While pipelined commands are
+		// waiting, responses are batched; STLS and QUIT always flush.
+		if _, err := resp.WriteTo(conn.Writer()); err != nil {
 			logger.Error("failed to send response", "error", err.Error())
 			return
 		}
-		if err := conn.Flush(); err != nil {
+		flush := flushUnlessPipelined
+		if cmdName == "STLS" || cmdName == "QUIT" {
+			flush = (*server.Connection).Flush
+		}
+		if err := flush(conn); err != nil {
 			logger.Error("failed to flush response", "error", err.Error())
 			return
 		}
+		if resp.Sent != nil {
+			resp.Sent()
+		}
 
 		logger.Debug("sent response",
 			"ok", resp.OK,
@@ -216,41 +343,36 @@ func handleConnection(ctx context.Context, conn *server.Connection, hostname str
 				collector.AuthAttempt(domain, resp.OK)
 			}
 		}
+		if endSession {
+			logger.Info("too many failed logins, closing connection")
+			return
+		}
 
 		// Handle special cases
 		switch cmdName {
 		case "STLS":
 			// If STLS succeeded, upgrade the connection to TLS
 			if resp.OK {
+				// Anything sent after STLS was sent in the clear and could
+				// have been injected; it must not run inside the TLS session.
+				if n := conn.Reader().Buffered(); n > 0 {
+					logger.Warn("discarding data pipelined after STLS", "bytes", n)
+					_, _ = conn.Reader().Discard(n)
+				}
 				if err := upgradeToTLS(ctx, conn, sess); err != nil {
 					logger.Error("TLS upgrade failed", "error", err.Error())
 					return
 				}
 				collector.TLSConnectionEstablished()
+				selectVirtualHost(conn, sess, vhosts, collector)
+				logger = conn.Logger()
 				logger.Info("TLS upgrade successful",
 					"tls_state", sess.TLSState().String(),
 				)
 			}
 
 		case "QUIT":
-			// If we were in TRANSACTION state (now UPDATE), expunge deleted messages.
-			// Use sess.Store() which may be domain-specific rather than the global msgStore.
-			store := sess.Store()
-			if sess.State() == StateUpdate && store != nil {
-				uids := sess.GetDeletedUIDs()
-				for _, uid := range uids {
-					if err := store.Delete(ctx, sess.Mailbox(), uid); err != nil {
-						logger.Error("failed to delete message", "uid", uid, "error", err.Error())
-					}
-				}
-				if len(uids) > 0 {
-					if err := store.Expunge(ctx, sess.Mailbox()); err != nil {
-						logger.Error("failed to expunge mailbox", "error", err.Error())
-					} else {
-						logger.Info("expunged messages", "count", len(uids))
-					}
-				}
-			}
+			// Deletions were committed by QUIT itself in the UPDATE state.
 			logger.Info("QUIT command received, closing connection")
 			return
 		}
@@ -279,13 +401,113 @@ func upgradeToTLS(ctx context.Context, conn *server.Connection, sess *Session) e
 	return nil
 }
 
+// selectVirtualHost assigns the session to the virtual host named by the
+// client in the TLS handshake (SNI) and labels its logs with it.
+func selectVirtualHost(conn *server.Connection, sess *Session, vhosts *VirtualHosts, collector metrics.Collector) {
+	var serverName string
+	if cs, ok := conn.TLSConnectionState(); ok {
+		serverName = cs.ServerName
+	}
+	vh := vhosts.Lookup(serverName)
+	sess.SetVirtualHost(vh)
+	conn.AddLogAttrs("vhost", vh.LogName())
+	collector.VirtualHostSession(vh.LogName())
+}
+
+// endDrainedSession tells the client that the server is shutting down. The
+// session then ends without entering the UPDATE state, so messages marked
+// for deletion are kept.
+func endDrainedSession(conn *server.Connection, sess *Session) {
+	conn.Logger().Info("server shutting down, closing session", "state", sess.State().String())
+	resp := Response{OK: false, Code: RespCodeSysTemp, Message: "server shutting down"}
+	if _, err := conn.Writer().WriteString(resp.String()); err != nil {
+		return
+	}
+	_ = conn.Flush()
+}
+
 // sendError sends an error response to the client.
 func sendError(conn *server.Connection, logger interface{}, message string) {
 	resp := Response{OK: false, Message: message}
 	if _, err := conn.Writer().WriteString(resp.String()); err != nil {
 		return
 	}
+	_ = flushUnlessPipelined(conn)
+}
+
+// rejectCommand answers a bad command line with message and counts it as
+// reason. It returns true if the session must end because the client has
+// sent too many bad commands.
+func rejectCommand(conn *server.Connection, sess *Session, collector metrics.Collector, reason, message string) bool {
+	collector.CommandRejected(reason)
+	sendError(conn, conn.Logger(), message)
+
+	limit := conn.MaxBadCommands()
+	if limit == 0 || sess.RecordBadCommand() < limit {
+		return false
+	}
+	conn.Logger().Info("too many bad commands, closing connection")
+	collector.BadCommandDisconnect()
 	_ = conn.Flush()
+	return true
+}
+
+// isAuthLine reports whether line is an AUTH command, which may carry an
+// initial response longer than other commands are allowed (RFC 5034).
+func isAuthLine(line string) bool {
+	name, _, _ := strings.Cut(strings.TrimSpace(line), " ")
+	return strings.EqualFold(name, "AUTH")
+}
+
+// flushUnlessPipelined flushes buffered responses unless the client has
+// already sent another complete command (RFC 2449 PIPELINING). Responses are
+// then written together once the pipelined commands have been processed.
+func flushUnlessPipelined(conn *server.Connection) error {
+	r := conn.Reader()
+	if n := r.Buffered(); n > 0 {
+		if buf, err := r.Peek(n); err == nil && bytes.IndexByte(buf, '\n') >= 0 {
+			return nil
+		}
+	}
+	return conn.Flush()
+}
+
+// throttleAuth applies login throttling to the response to a login attempt:
+// a failure is delayed, and true is returned if the session must then end
+// because it has failed too often or its address has been banned.
+func throttleAuth(ctx context.Context, conn *server.Connection, sess *Session, throttle *AuthThrottle, resp Response) bool {
+	if throttle == nil || resp.Continuation {
+		return false
+	}
+	username := sess.TakeLoginUser()
+	if resp.OK {
+		throttle.Success(username)
+		return false
+	}
+	// Only rejected credentials count; a locked maildrop or a
+	// session-manager outage is not the client's failure.
+	if resp.Code != RespCodeAuth {
+		return false
+	}
+
+	failures := sess.RecordAuthFailure()
+	result, err := throttle.Failure(sess.ClientIP(), username)
+	if err != nil {
+		conn.Logger().Error("failed to save bans", "error", err.Error())
+	}
+	if result.Banned {
+		conn.Logger().Warn("address banned after repeated login failures", "ip", sess.ClientIP())
+	}
+	if result.Delay > 0 {
+		timer := time.NewTimer(result.Delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+		}
+	}
+	limit := throttle.MaxFailures()
+	return result.Banned || (limit > 0 && failures >= limit)
 }
 
 // extractDomain extracts the domain part from a username.
@@ -0,0 +1,252 @@
+package pop3
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/infodancer/pop3d/internal/metrics"
+	"github.com/infodancer/pop3d/internal/server"
+)
+
+// writeCountingConn counts the writes made to a net.Conn.
+type writeCountingConn struct {
+	net.Conn
+	writes atomic.Int32
+}
+
+func (c *writeCountingConn) Write(p []byte) (int, error) {
+	c.writes.Add(1)
+	return c.Conn.Write(p)
+}
+
+// startHandler runs handleConnection on one end of a pipe and returns the
+// client end.
+func startHandler(t *testing.T, wrap func(net.Conn) net.Conn, tlsConfig *tls.Config) net.Conn {
+	t.Helper()
+	RegisterAuthCommands(nil, AuthConfig{})
+	RegisterTransactionCommands()
+
+	srv, cli := net.Pipe()
+	t.Cleanup(func() { cli.Close() })
+	c := server.NewConnection(wrap(srv), server.ConnectionConfig{
+		PreAuthTimeout: 10 * time.Second,
+		IdleTimeout:    10 * time.Second,
+	})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer c.Close()
+		handleConnection(context.Background(), c, "test.example.com", tlsConfig, &metrics.NoopCollector{}, AuthConfig{}, MaildropConfig{}, nil)
+	}()
+	t.Cleanup(func() {
+		cli.Close()
+		<-done
+	})
+	return cli
+}
+
+func TestHandlerPipeliningBatchesResponses(t *testing.T) {
+	var counter *writeCountingConn
+	cli := startHandler(t, func(c net.Conn) net.Conn {
+		counter = &writeCountingConn{Conn: c}
+		return counter
+	}, nil)
+	r := bufio.NewReader(cli)
+
+	if line, _ := r.ReadString('\n'); !strings.HasPrefix(line, "+OK") {
+		t.Fatalf("greeting = %q", line)
+	}
+	afterGreeting := counter.writes.Load()
+
+	go func() {
+		_, _ = io.WriteString(cli, "CAPA\r\nUSER alice\r\nNOOP\r\nQUIT\r\n")
+	}()
+
+	var lines []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			break
+		}
+		lines = append(lines, strings.TrimRight(line, "\r\n"))
+	}
+
+	if !containsLine(lines, "PIPELINING") {
+		t.Errorf("CAPA does not advertise PIPELINING: %v", lines)
+	}
+	if n := len(lines); n < 4 || !strings.HasPrefix(lines[n-1], "+OK") {
+		t.Fatalf("responses = %q, want CAPA, USER, NOOP and QUIT responses", lines)
+	}
+	if got := counter.writes.Load() - afterGreeting; got != 1 {
+		t.Errorf("pipelined responses took %d writes, want 1", got)
+	}
+}
+
+func TestHandlerDiscardsDataPipelinedAfterSTLS(t *testing.T) {
+	cert := newTestCertificate(t)
+	cli := startHandler(t, func(c net.Conn) net.Conn { return c }, &tls.Config{Certificates: []tls.Certificate{cert}})
+	r := bufio.NewReader(cli)
+
+	if line, _ := r.ReadString('\n'); !strings.HasPrefix(line, "+OK") {
+		t.Fatalf("greeting = %q", line)
+	}
+
+	// An attacker appends a command to STLS in the same packet.
+	go func() {
+		_, _ = io.WriteString(cli, "STLS\r\nUSER mallory\r\n")
+	}()
+	if line, _ := r.ReadString('\n'); !strings.HasPrefix(line, "+OK") {
+		t.Fatalf("STLS response = %q", line)
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(cert.Leaf)
+	tc := tls.Client(cli, &tls.Config{RootCAs: pool, ServerName: "localhost"})
+	if err := tc.Handshake(); err != nil {
+		t.Fatalf("handshake: %v", err)
+	}
+	tr := bufio.NewReader(tc)
+
+	// The injected USER must not have been executed.
+	if _, err := io.WriteString(tc, "PASS secret\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	if line, _ := tr.ReadString('\n'); line != "-ERR No username specified\r\n" {
+		t.Errorf("PASS after STLS = %q, want -ERR No username specified", line)
+	}
+}
+
+func TestHandlerRejectsBadCommands(t *testing.T) {
+	RegisterAuthCommands(nil, AuthConfig{})
+	RegisterTransactionCommands()
+
+	srv, cli := net.Pipe()
+	t.Cleanup(func() { cli.Close() })
+	c := server.NewConnection(srv, server.ConnectionConfig{
+		PreAuthTimeout: 10 * time.Second,
+		IdleTimeout:    10 * time.Second,
+		MaxBadCommands: 3,
+	})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer c.Close()
+		handleConnection(context.Background(), c, "test.example.com", nil, &metrics.NoopCollector{}, AuthConfig{}, MaildropConfig{}, nil)
+	}()
+	r := bufio.NewReader(cli)
+
+	if line, _ := r.ReadString('\n'); !strings.HasPrefix(line, "+OK") {
+		t.Fatalf("greeting = %q", line)
+	}
+
+	steps := []struct {
+		name, send, want string
+	}{
+		{"overlong", "USER " + strings.Repeat("a", 300) + "\r\n", "-ERR Command line too long\r\n"},
+		{"valid", "NOOP\r\n", "+OK\r\n"},
+		{"unknown", "BOGUS\r\n", "-ERR Unknown command\r\n"},
+		{"unknown", "XYZZY\r\n", "-ERR Unknown command\r\n"},
+	}
+	for _, s := range steps {
+		go func() { _, _ = io.WriteString(cli, s.send) }()
+		if line, _ := r.ReadString('\n'); line != s.want {
+			t.Fatalf("%s command: response = %q, want %q", s.name, line, s.want)
+		}
+	}
+
+	// The third bad command ended the session.
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("session did not end after too many bad commands")
+	}
+}
+
+func containsLine(lines []string, want string) bool {
+	for _, l := range lines {
+		if l == want {
+			return true
+		}
+	}
+	return false
+}
+
+func TestHandlerDrainEndsSessionWithNotice(t *testing.T) {
+	RegisterAuthCommands(nil, AuthConfig{})
+	RegisterTransactionCommands()
+
+	srv, cli := net.Pipe()
+	t.Cleanup(func() { cli.Close() })
+	c := server.NewConnection(srv, server.ConnectionConfig{
+		PreAuthTimeout: 10 * time.Second,
+		IdleTimeout:    10 * time.Second,
+	})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer c.Close()
+		handleConnection(context.Background(), c, "test.example.com", nil, &metrics.NoopCollector{}, AuthConfig{}, MaildropConfig{}, nil)
+	}()
+	r := bufio.NewReader(cli)
+
+	if line, _ := r.ReadString('\n'); !strings.HasPrefix(line, "+OK") {
+		t.Fatalf("greeting = %q", line)
+	}
+	go func() { _, _ = io.WriteString(cli, "USER alice\r\n") }()
+	if line, _ := r.ReadString('\n'); !strings.HasPrefix(line, "+OK") {
+		t.Fatalf("USER = %q", line)
+	}
+
+	// The session is now waiting for its next command.
+	c.Drain()
+	if line, _ := r.ReadString('\n'); line != "-ERR [SYS/TEMP] server shutting down\r\n" {
+		t.Errorf("after drain = %q, want -ERR [SYS/TEMP] server shutting down", line)
+	}
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("session did not end after drain")
+	}
+}
+
+// newTestCertificate creates a self-signed ECDSA certificate for localhost.
+func newTestCertificate(t *testing.T) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "localhost"},
+		DNSNames:              []string{"localhost"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
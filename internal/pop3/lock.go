@@ -0,0 +1,96 @@
+package pop3
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/infodancer/pop3d/internal/config"
+)
+
+// takeoverTimeout bounds how long a new session waits for a session it has
+// taken over to release the maildrop.
+const takeoverTimeout = 10 * time.Second
+
+// MaildropLocks hands out exclusive per-mailbox locks so that only one session
+// at a time can be in the TRANSACTION state for a maildrop (RFC 1939 section 4).
+// Locks are held in process only.
+type MaildropLocks struct {
+	policy string
+
+	mu   sync.Mutex
+	held map[string]*maildropLock
+}
+
+// maildropLock is the lock on one mailbox.
+type maildropLock struct {
+	// terminate ends the session holding the lock.
+	terminate func()
+	// released is closed when the holder releases the lock.
+	released chan struct{}
+}
+
+// NewMaildropLocks creates a lock manager with the given policy
+// (config.LockPolicyReject or config.LockPolicyTakeover).
+func NewMaildropLocks(policy string) *MaildropLocks {
+	return &MaildropLocks{
+		policy: policy,
+		held:   make(map[string]*maildropLock),
+	}
+}
+
+// Acquire locks mailbox for a session. terminate is called if a later session
+// takes the lock over; it must end the session, which then releases the lock
+// through the returned function.
+//
+// If the mailbox is already locked, the reject policy fails with
+// ErrMaildropLocked. The takeover policy terminates the holder and waits for
+// it to release the lock, so its pending deletions are never applied on top
+// of the new session's view of the maildrop.
+func (m *MaildropLocks) Acquire(ctx context.Context, mailbox string, terminate func()) (release func(), err error) {
+	timer := time.NewTimer(takeoverTimeout)
+	defer timer.Stop()
+
+	for {
+		m.mu.Lock()
+		holder, locked := m.held[mailbox]
+		if !locked {
+			lock := &maildropLock{terminate: terminate, released: make(chan struct{})}
+			m.held[mailbox] = lock
+			m.mu.Unlock()
+			return m.releaseFunc(mailbox, lock), nil
+		}
+		m.mu.Unlock()
+
+		if m.policy != config.LockPolicyTakeover {
+			return nil, ErrMaildropLocked
+		}
+
+		if holder.terminate != nil {
+			holder.terminate()
+		}
+		select {
+		case <-holder.released:
+			// Try again; another newcomer may have taken the lock first.
+		case <-timer.C:
+			return nil, ErrMaildropLocked
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// releaseFunc returns a function that releases lock exactly once.
+func (m *MaildropLocks) releaseFunc(mailbox string, lock *maildropLock) func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			m.mu.Lock()
+			if m.held[mailbox] == lock {
+				delete(m.held, mailbox)
+			}
+			m.mu.Unlock()
+			close(lock.released)
+		})
+	}
+}
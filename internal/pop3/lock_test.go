@@ -0,0 +1,122 @@
+package pop3
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/infodancer/pop3d/internal/config"
+)
+
+func TestMaildropLocks_Reject(t *testing.T) {
+	locks := NewMaildropLocks(config.LockPolicyReject)
+	ctx := context.Background()
+
+	release, err := locks.Acquire(ctx, "alice", nil)
+	if err != nil {
+		t.Fatalf("Acquire() error = %v", err)
+	}
+	if _, err := locks.Acquire(ctx, "alice", nil); !errors.Is(err, ErrMaildropLocked) {
+		t.Fatalf("second Acquire() error = %v, want ErrMaildropLocked", err)
+	}
+
+	// Other mailboxes are independent.
+	releaseBob, err := locks.Acquire(ctx, "bob", nil)
+	if err != nil {
+		t.Fatalf("Acquire(bob) error = %v", err)
+	}
+	releaseBob()
+
+	release()
+	release() // releasing twice is harmless
+	release, err = locks.Acquire(ctx, "alice", nil)
+	if err != nil {
+		t.Fatalf("Acquire() after release error = %v", err)
+	}
+	release()
+}
+
+func TestMaildropLocks_Takeover(t *testing.T) {
+	locks := NewMaildropLocks(config.LockPolicyTakeover)
+	ctx := context.Background()
+
+	terminated := make(chan struct{})
+	var releaseOld func()
+	releaseOld, err := locks.Acquire(ctx, "alice", func() {
+		close(terminated)
+		// The old session releases its lock as it shuts down.
+		go releaseOld()
+	})
+	if err != nil {
+		t.Fatalf("Acquire() error = %v", err)
+	}
+
+	release, err := locks.Acquire(ctx, "alice", nil)
+	if err != nil {
+		t.Fatalf("takeover Acquire() error = %v", err)
+	}
+	select {
+	case <-terminated:
+	default:
+		t.Error("older session was not terminated")
+	}
+
+	// A repeated release by the old session must not drop the new lock.
+	releaseOld()
+	locks.policy = config.LockPolicyReject
+	if _, err := locks.Acquire(ctx, "alice", nil); !errors.Is(err, ErrMaildropLocked) {
+		t.Errorf("Acquire() after stale release error = %v, want ErrMaildropLocked", err)
+	}
+	release()
+}
+
+func TestMaildropLocks_TakeoverHonoursContext(t *testing.T) {
+	locks := NewMaildropLocks(config.LockPolicyTakeover)
+
+	// A holder that never releases.
+	if _, err := locks.Acquire(context.Background(), "alice", func() {}); err != nil {
+		t.Fatalf("Acquire() error = %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := locks.Acquire(ctx, "alice", nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Acquire() error = %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestSessionMaildropLock(t *testing.T) {
+	locks := NewMaildropLocks(config.LockPolicyReject)
+	smClient := newTestSMClient(t, defaultSessionSvc(), &mockMailboxService{})
+	cmd := &passCommand{smClient: smClient}
+
+	login := func() (*Session, Response) {
+		sess := newTestSession(config.ModePop3s, true)
+		sess.SetMaildrop(MaildropConfig{Locks: locks}, nil)
+		sess.SetUsername("alice")
+		resp, err := cmd.Execute(context.Background(), sess, newMockConnection(), []string{"secret"})
+		if err != nil {
+			t.Fatalf("Execute() error = %v", err)
+		}
+		return sess, resp
+	}
+
+	first, resp := login()
+	if !resp.OK {
+		t.Fatalf("first login = %+v", resp)
+	}
+
+	second, resp := login()
+	if resp.OK || resp.Code != RespCodeInUse {
+		t.Fatalf("second login = %+v, want -ERR [IN-USE]", resp)
+	}
+	if second.State() != StateAuthorization {
+		t.Errorf("second session state = %v, want AUTHORIZATION", second.State())
+	}
+
+	first.Cleanup()
+	if _, resp := login(); !resp.OK {
+		t.Errorf("login after Cleanup = %+v", resp)
+	}
+}
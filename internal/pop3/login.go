@@ -0,0 +1,49 @@
+package pop3
+
+import "errors"
+
+// loginServer implements the server side of the LOGIN mechanism
+// (draft-murchison-sasl-login). The client is prompted for its username and
+// then its password, one continuation each. A username sent as the initial
+// response skips the first prompt.
+type loginServer struct {
+	authenticate func(username, password string) error
+
+	step     int
+	username string
+}
+
+// LOGIN prompts. Clients generally ignore their content, but these are the
+// strings they have always been sent.
+var (
+	loginUsernamePrompt = []byte("Username:")
+	loginPasswordPrompt = []byte("Password:")
+)
+
+// Next implements sasl.Server.
+func (s *loginServer) Next(response []byte) (challenge []byte, done bool, err error) {
+	switch s.step {
+	case 0:
+		s.step++
+		if len(response) == 0 {
+			return loginUsernamePrompt, false, nil
+		}
+		// Initial response carries the username.
+		fallthrough
+	case 1:
+		if len(response) == 0 {
+			return nil, false, errors.New("login: empty username")
+		}
+		s.username = string(response)
+		s.step = 2
+		return loginPasswordPrompt, false, nil
+	case 2:
+		s.step++
+		if err := s.authenticate(s.username, string(response)); err != nil {
+			return nil, false, err
+		}
+		return nil, true, nil
+	default:
+		return nil, false, errors.New("login: unexpected client response")
+	}
+}
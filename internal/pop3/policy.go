@@ -0,0 +1,167 @@
+package pop3
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/infodancer/pop3d/internal/config"
+)
+
+// MaildropConfig holds the policies applied when a session opens a maildrop.
+// A zero MaildropConfig disables all of them.
+type MaildropConfig struct {
+	// Locks serializes access to each maildrop.
+	Locks *MaildropLocks
+
+	// Policies sets LOGIN-DELAY and EXPIRE (RFC 2449); Record keeps the
+	// login and retrieval times they are enforced against. Both or neither.
+	Policies *Policies
+	Record   *AccessRecord
+
+	// Aggregate lists folders merged into an inbox maildrop. FolderHeader,
+	// if set, names the header added to merged messages to show their folder.
+	Aggregate    []string
+	FolderHeader string
+
+	// Sessions caps the concurrent sessions of each user and domain. When
+	// nil, sessions are not counted.
+	Sessions *SessionLimits
+}
+
+// MaildropPolicy is the LOGIN-DELAY and EXPIRE policy for one user.
+type MaildropPolicy struct {
+	// LoginDelay is the minimum time between logins.
+	LoginDelay time.Duration
+
+	// ExpireDays is how long a retrieved message is kept, in days;
+	// -1 keeps it forever.
+	ExpireDays int
+}
+
+// Policies resolves the maildrop policy for a user from per-user, per-domain
+// and default settings.
+type Policies struct {
+	defaults MaildropPolicy
+	domains  map[string]config.PolicyOverride
+	users    map[string]config.PolicyOverride
+}
+
+// NewPolicies builds the policies from validated configuration.
+func NewPolicies(cfg config.PolicyConfig) (*Policies, error) {
+	defaults, err := applyOverride(MaildropPolicy{ExpireDays: -1}, config.PolicyOverride{
+		LoginDelay: cfg.LoginDelay,
+		Expire:     cfg.Expire,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	p := &Policies{
+		defaults: defaults,
+		domains:  make(map[string]config.PolicyOverride),
+		users:    make(map[string]config.PolicyOverride),
+	}
+	for domain, o := range cfg.Domains {
+		if _, err := applyOverride(defaults, o); err != nil {
+			return nil, fmt.Errorf("domain %s: %w", domain, err)
+		}
+		p.domains[strings.ToLower(domain)] = o
+	}
+	for user, o := range cfg.Users {
+		if _, err := applyOverride(defaults, o); err != nil {
+			return nil, fmt.Errorf("user %s: %w", user, err)
+		}
+		p.users[userKey(user)] = o
+	}
+	return p, nil
+}
+
+// MaxLoginDelay returns the longest LOGIN-DELAY of any user.
+func (p *Policies) MaxLoginDelay() time.Duration {
+	longest := p.defaults.LoginDelay
+	for _, overrides := range []map[string]config.PolicyOverride{p.domains, p.users} {
+		for _, o := range overrides {
+			if policy, _ := applyOverride(p.defaults, o); policy.LoginDelay > longest {
+				longest = policy.LoginDelay
+			}
+		}
+	}
+	return longest
+}
+
+// Default returns the policy for users without an override.
+func (p *Policies) Default() MaildropPolicy {
+	return p.defaults
+}
+
+// VariesByUser returns true if some users or domains have their own policy.
+func (p *Policies) VariesByUser() bool {
+	return len(p.domains) > 0 || len(p.users) > 0
+}
+
+// For returns the policy for username. A user override takes precedence over
+// a domain override, which takes precedence over the defaults.
+func (p *Policies) For(username string) MaildropPolicy {
+	username = userKey(username)
+	policy := p.defaults
+	if i := strings.LastIndex(username, "@"); i >= 0 {
+		if o, ok := p.domains[username[i+1:]]; ok {
+			policy, _ = applyOverride(policy, o)
+		}
+	}
+	if o, ok := p.users[username]; ok {
+		policy, _ = applyOverride(policy, o)
+	}
+	return policy
+}
+
+// userKey is the form of a username that policies and the access record are
+// keyed by, so that logins differing only in case count as one user.
+func userKey(username string) string {
+	return strings.ToLower(username)
+}
+
+// applyOverride returns policy with the fields set in o replaced.
+func applyOverride(policy MaildropPolicy, o config.PolicyOverride) (MaildropPolicy, error) {
+	if o.LoginDelay != "" {
+		d, err := time.ParseDuration(o.LoginDelay)
+		if err != nil {
+			return policy, fmt.Errorf("invalid login_delay: %w", err)
+		}
+		policy.LoginDelay = d
+	}
+	if o.Expire != "" {
+		days, err := config.ParseExpire(o.Expire)
+		if err != nil {
+			return policy, err
+		}
+		policy.ExpireDays = days
+	}
+	return policy, nil
+}
+
+// loginDelayCapability formats the LOGIN-DELAY capability (RFC 2449 section 6.7).
+func loginDelayCapability(d time.Duration, perUser bool) string {
+	return withUserSuffix("LOGIN-DELAY "+strconv.Itoa(int(d/time.Second)), perUser)
+}
+
+// expireCapability formats the EXPIRE capability (RFC 2449 section 6.6).
+func expireCapability(days int, perUser bool) string {
+	value := "NEVER"
+	if days >= 0 {
+		value = strconv.Itoa(days)
+	}
+	return withUserSuffix("EXPIRE "+value, perUser)
+}
+
+// withUserSuffix appends the USER argument, which tells a client that has not
+// yet logged in that its own value may differ. After login the server reports
+// the user's actual value without it.
+func withUserSuffix(capability string, perUser bool) string {
+	if perUser {
+		return capability + " USER"
+	}
+	return capability
+}
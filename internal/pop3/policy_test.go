@@ -0,0 +1,290 @@
+package pop3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/infodancer/msgstore"
+	"github.com/infodancer/pop3d/internal/config"
+)
+
+func TestPolicies_For(t *testing.T) {
+	p, err := NewPolicies(config.PolicyConfig{
+		LoginDelay: "15m",
+		Expire:     "30",
+		Domains:    map[string]config.PolicyOverride{"Example.com": {Expire: "7"}},
+		Users:      map[string]config.PolicyOverride{"alice@example.com": {LoginDelay: "0s"}},
+	})
+	if err != nil {
+		t.Fatalf("NewPolicies: %v", err)
+	}
+
+	tests := []struct {
+		user string
+		want MaildropPolicy
+	}{
+		{"bob@other.org", MaildropPolicy{LoginDelay: 15 * time.Minute, ExpireDays: 30}},
+		{"bob@example.com", MaildropPolicy{LoginDelay: 15 * time.Minute, ExpireDays: 7}},
+		{"Alice@Example.com", MaildropPolicy{LoginDelay: 0, ExpireDays: 7}},
+		{"localpart", MaildropPolicy{LoginDelay: 15 * time.Minute, ExpireDays: 30}},
+	}
+	for _, tt := range tests {
+		if got := p.For(tt.user); got != tt.want {
+			t.Errorf("For(%q) = %+v, want %+v", tt.user, got, tt.want)
+		}
+	}
+
+	if defaults, _ := NewPolicies(config.PolicyConfig{}); defaults.Default().ExpireDays != -1 {
+		t.Errorf("default expire = %d, want -1 (never)", defaults.Default().ExpireDays)
+	}
+}
+
+func TestAccessRecord_Persists(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "record.json")
+	now := time.Now().Truncate(time.Second)
+
+	r, err := LoadAccessRecord(path, time.Hour)
+	if err != nil {
+		t.Fatalf("LoadAccessRecord: %v", err)
+	}
+	r.RecordRetrieved("alice", 1, now.Add(-48*time.Hour))
+	r.RecordRetrieved("alice", 2, now)
+	r.RecordRetrieved("alice", 1, now) // first retrieval counts
+	if err := r.RecordLogin("alice", now); err != nil {
+		t.Fatalf("RecordLogin: %v", err)
+	}
+
+	r, err = LoadAccessRecord(path, time.Hour)
+	if err != nil {
+		t.Fatalf("reload: %v", err)
+	}
+	if last, ok := r.LastLogin("alice"); !ok || !last.Equal(now) {
+		t.Errorf("LastLogin = %v, %v; want %v", last, ok, now)
+	}
+	if got := r.Expired("alice", 1, now); !slices.Equal(got, []uint32{1}) {
+		t.Errorf("Expired(1 day) = %v, want [1]", got)
+	}
+	if got := r.Expired("alice", 0, now); len(got) != 2 {
+		t.Errorf("Expired(0 days) = %v, want both messages", got)
+	}
+	if got := r.Expired("alice", -1, now); got != nil {
+		t.Errorf("Expired(never) = %v, want none", got)
+	}
+
+	r.Prune("alice", map[uint32]bool{2: true})
+	if got := r.Expired("alice", 0, now); !slices.Equal(got, []uint32{2}) {
+		t.Errorf("Expired after Prune = %v, want [2]", got)
+	}
+}
+
+func TestPolicies_MaxLoginDelay(t *testing.T) {
+	p, err := NewPolicies(config.PolicyConfig{
+		LoginDelay: "15m",
+		Domains:    map[string]config.PolicyOverride{"example.com": {LoginDelay: "1h"}},
+		Users:      map[string]config.PolicyOverride{"alice@example.com": {Expire: "7"}},
+	})
+	if err != nil {
+		t.Fatalf("NewPolicies: %v", err)
+	}
+	if got := p.MaxLoginDelay(); got != time.Hour {
+		t.Errorf("MaxLoginDelay() = %v, want 1h", got)
+	}
+}
+
+func TestAccessRecord_FoldsUsernameCase(t *testing.T) {
+	r, _ := LoadAccessRecord("", time.Hour)
+	now := time.Now()
+	if err := r.RecordLogin("Alice@Example.com", now); err != nil {
+		t.Fatalf("RecordLogin: %v", err)
+	}
+	if last, ok := r.LastLogin("alice@example.com"); !ok || !last.Equal(now) {
+		t.Errorf("LastLogin = %v, %v; want the login recorded as Alice@Example.com", last, ok)
+	}
+}
+
+func TestAccessRecord_BatchesLoginSaves(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "record.json")
+	now := time.Now()
+	r, _ := LoadAccessRecord(path, time.Hour)
+
+	// The first login is saved; one soon after waits for the next save.
+	_ = r.RecordLogin("alice", now)
+	_ = r.RecordLogin("bob", now)
+	saved, _ := LoadAccessRecord(path, time.Hour)
+	if _, ok := saved.LastLogin("alice"); !ok {
+		t.Error("first login not saved")
+	}
+	if _, ok := saved.LastLogin("bob"); ok {
+		t.Error("second login saved at once, want it batched")
+	}
+
+	if err := r.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	saved, _ = LoadAccessRecord(path, time.Hour)
+	if _, ok := saved.LastLogin("bob"); !ok {
+		t.Error("pending login not saved on Close")
+	}
+}
+
+func TestAccessRecord_SweepsOldLogins(t *testing.T) {
+	r, _ := LoadAccessRecord("", time.Hour)
+	now := time.Now()
+	_ = r.RecordLogin("alice", now.Add(-2*time.Hour))
+	_ = r.RecordLogin("bob", now)
+	if _, ok := r.LastLogin("alice"); ok {
+		t.Error("login older than the longest LOGIN-DELAY was kept")
+	}
+	if _, ok := r.LastLogin("bob"); !ok {
+		t.Error("recent login was swept")
+	}
+}
+
+// recordingStore is a MessageStore that records deletions and can be told to
+// fail them.
+type recordingStore struct {
+	messages   []msgstore.MessageInfo
+	failDelete map[uint32]bool
+	expungeErr error
+	mu         sync.Mutex
+	deleted    []uint32
+	expunged   bool
+}
+
+func (s *recordingStore) List(context.Context, string) ([]msgstore.MessageInfo, error) {
+	return slices.Clone(s.messages), nil
+}
+
+func (s *recordingStore) Stat(context.Context, string) (int, int64, error) {
+	return len(s.messages), 0, nil
+}
+
+func (s *recordingStore) Retrieve(_ context.Context, _ string, uid uint32) (io.ReadCloser, error) {
+	return io.NopCloser(strings.NewReader(fmt.Sprintf("Subject: %d\r\n\r\nbody\r\n", uid))), nil
+}
+
+func (s *recordingStore) Delete(_ context.Context, _ string, uid uint32) error {
+	if s.failDelete[uid] {
+		return errors.New("backend unavailable")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deleted = append(s.deleted, uid)
+	return nil
+}
+
+func (s *recordingStore) Expunge(context.Context, string) error {
+	if s.expungeErr != nil {
+		return s.expungeErr
+	}
+	s.expunged = true
+	return nil
+}
+
+func newPolicySession(t *testing.T, policy config.PolicyConfig, record *AccessRecord) *Session {
+	t.Helper()
+	policies, err := NewPolicies(policy)
+	if err != nil {
+		t.Fatalf("NewPolicies: %v", err)
+	}
+	sess := newAuthenticatedSession()
+	sess.SetMaildrop(MaildropConfig{Policies: policies, Record: record}, nil)
+	return sess
+}
+
+func TestInitializeMailbox_LoginDelay(t *testing.T) {
+	record, _ := LoadAccessRecord("", time.Hour)
+	policy := config.PolicyConfig{LoginDelay: "1h"}
+	store := &recordingStore{messages: []msgstore.MessageInfo{{UID: 1, Size: 10}}}
+
+	sess := newPolicySession(t, policy, record)
+	if err := sess.InitializeMailbox(context.Background(), store, ""); err != nil {
+		t.Fatalf("first login: %v", err)
+	}
+
+	sess = newPolicySession(t, policy, record)
+	err := sess.InitializeMailbox(context.Background(), store, "")
+	if !errors.Is(err, ErrLoginDelay) {
+		t.Fatalf("second login error = %v, want ErrLoginDelay", err)
+	}
+	if respCodeForError(fmt.Errorf("%w: %w", ErrMailboxUnavailable, err)) != RespCodeLoginDelay {
+		t.Error("login delay not reported as [LOGIN-DELAY]")
+	}
+
+	// Once the delay has passed the user may log in again.
+	_ = record.RecordLogin("testuser", time.Now().Add(-2*time.Hour))
+	sess = newPolicySession(t, policy, record)
+	if err := sess.InitializeMailbox(context.Background(), store, ""); err != nil {
+		t.Errorf("login after delay: %v", err)
+	}
+}
+
+func TestInitializeMailbox_ExpiresRetrievedMessages(t *testing.T) {
+	record, _ := LoadAccessRecord("", time.Hour)
+	store := &recordingStore{messages: []msgstore.MessageInfo{{UID: 1, Size: 10}, {UID: 2, Size: 20}, {UID: 3, Size: 30}}}
+	record.RecordRetrieved("testuser", 1, time.Now().Add(-8*24*time.Hour))
+	record.RecordRetrieved("testuser", 2, time.Now().Add(-time.Hour))
+	record.RecordRetrieved("testuser", 99, time.Now().Add(-30*24*time.Hour)) // already gone
+
+	sess := newPolicySession(t, config.PolicyConfig{Expire: "7"}, record)
+	if err := sess.InitializeMailbox(context.Background(), store, ""); err != nil {
+		t.Fatalf("InitializeMailbox: %v", err)
+	}
+
+	if !slices.Equal(store.deleted, []uint32{1}) || !store.expunged {
+		t.Errorf("deleted = %v, expunged = %v; want [1], true", store.deleted, store.expunged)
+	}
+	if sess.MessageCount() != 2 {
+		t.Errorf("MessageCount() = %d, want 2", sess.MessageCount())
+	}
+	if got := record.Expired("testuser", 0, time.Now()); !slices.Equal(got, []uint32{2}) {
+		t.Errorf("record after expiry = %v, want only [2]", got)
+	}
+
+	// RETR starts the clock for message 3, but only once it has been sent.
+	resp, err := (&retrCommand{}).Execute(context.Background(), sess, newMockConnection(), []string{"2"})
+	if err != nil || !resp.OK || resp.Sent == nil {
+		t.Fatalf("RETR = %+v, %v; want a response to be sent", resp, err)
+	}
+	_ = resp.Body.Close()
+	if got := record.Expired("testuser", 0, time.Now()); len(got) != 1 {
+		t.Errorf("record before the message was sent = %v, want 1 entry", got)
+	}
+	resp.Sent()
+	if got := record.Expired("testuser", 0, time.Now()); len(got) != 2 {
+		t.Errorf("record after the message was sent = %v, want 2 entries", got)
+	}
+}
+
+func TestCapabilitiesPolicy(t *testing.T) {
+	record, _ := LoadAccessRecord("", time.Hour)
+	sess := newPolicySession(t, config.PolicyConfig{
+		LoginDelay: "15m",
+		Users:      map[string]config.PolicyOverride{"testuser": {Expire: "0"}},
+	}, record)
+	sess.state = StateAuthorization
+
+	if caps := sess.Capabilities(); !slices.Contains(caps, "LOGIN-DELAY 900 USER") || !slices.Contains(caps, "EXPIRE NEVER USER") {
+		t.Errorf("AUTHORIZATION capabilities = %v", caps)
+	}
+
+	sess.state = StateTransaction
+	if caps := sess.Capabilities(); !slices.Contains(caps, "LOGIN-DELAY 900") || !slices.Contains(caps, "EXPIRE 0") {
+		t.Errorf("TRANSACTION capabilities = %v", caps)
+	}
+
+	plain := newTestSession(config.ModePop3s, true)
+	for _, c := range plain.Capabilities() {
+		if strings.HasPrefix(c, "LOGIN-DELAY") || strings.HasPrefix(c, "EXPIRE") {
+			t.Errorf("policy capability %q advertised without policies", c)
+		}
+	}
+}
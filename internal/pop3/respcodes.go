@@ -0,0 +1,115 @@
+package pop3
+
+import (
+	"errors"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// RespCode is an extended response code (RFC 2449 section 8). It is sent in
+// brackets at the start of a -ERR message so clients can tell why a command
+// failed without parsing the human-readable text.
+type RespCode string
+
+// Response codes from RFC 2449 and RFC 3206.
+const (
+	// RespCodeInUse means the maildrop is locked by another session.
+	RespCodeInUse RespCode = "IN-USE"
+
+	// RespCodeLoginDelay means the user is logging in too often.
+	RespCodeLoginDelay RespCode = "LOGIN-DELAY"
+
+	// RespCodeAuth means the credentials were rejected.
+	RespCodeAuth RespCode = "AUTH"
+
+	// RespCodeSysTemp means a temporary system problem; the client may retry.
+	RespCodeSysTemp RespCode = "SYS/TEMP"
+
+	// RespCodeSysPerm means a permanent problem that needs administrator
+	// attention; retrying will not help.
+	RespCodeSysPerm RespCode = "SYS/PERM"
+)
+
+// respCodeForError maps an authentication or mailbox error to a response code.
+// Local refusals have their own codes. Of the session-manager's gRPC statuses
+// only those it documents for Login are mapped: rejected credentials to
+// [AUTH] and a disabled account to [SYS/PERM]. Anything else, including
+// transport and internal errors, is [SYS/TEMP].
+func respCodeForError(err error) RespCode {
+	if errors.Is(err, ErrMaildropLocked) {
+		return RespCodeInUse
+	}
+	if errors.Is(err, ErrLoginDelay) {
+		return RespCodeLoginDelay
+	}
+	if errors.Is(err, ErrAuthFailed) {
+		return RespCodeAuth
+	}
+	if errors.Is(err, ErrAccessDenied) {
+		return RespCodeSysPerm
+	}
+	if errors.Is(err, ErrTooManyUserSessions) {
+		return RespCodeInUse
+	}
+	if errors.Is(err, ErrTooManyDomainSessions) {
+		return RespCodeSysTemp
+	}
+	mailbox := errors.Is(err, ErrMailboxUnavailable)
+
+	st, ok := status.FromError(err)
+	if !ok {
+		return RespCodeSysTemp
+	}
+
+	var code RespCode
+	switch st.Code() {
+	case codes.Unauthenticated, codes.NotFound, codes.InvalidArgument:
+		code = RespCodeAuth
+	case codes.PermissionDenied:
+		// The account is disabled
+		code = RespCodeSysPerm
+	default:
+		code = RespCodeSysTemp
+	}
+
+	// The user has already authenticated when the mailbox fails to open, so
+	// a credential code would mislead the client.
+	if mailbox && code == RespCodeAuth {
+		code = RespCodeSysTemp
+	}
+	return code
+}
+
+// authFailure builds the -ERR response for a failed login.
+func authFailure(err error) Response {
+	code := respCodeForError(err)
+	var msg string
+	switch code {
+	case RespCodeInUse:
+		if errors.Is(err, ErrTooManyUserSessions) {
+			msg = "Too many sessions for this user"
+		} else {
+			msg = "Mailbox is locked by another session"
+		}
+	case RespCodeLoginDelay:
+		msg = "Login attempted too soon, try again later"
+	case RespCodeSysTemp:
+		if errors.Is(err, ErrTooManyDomainSessions) {
+			msg = "Too many sessions for this domain, try again later"
+		} else if errors.Is(err, ErrMailboxUnavailable) {
+			msg = "Failed to access mailbox"
+		} else {
+			msg = "Temporary system problem, try again later"
+		}
+	case RespCodeSysPerm:
+		if errors.Is(err, ErrAccessDenied) {
+			msg = "Login not permitted from your address"
+		} else {
+			msg = "Login not permitted"
+		}
+	default:
+		msg = "Authentication failed"
+	}
+	return Response{OK: false, Code: code, Message: msg}
+}
@@ -0,0 +1,88 @@
+package pop3
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/infodancer/pop3d/internal/config"
+	smpb "github.com/infodancer/session-manager/proto/sessionmanager/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestRespCodeForError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want RespCode
+	}{
+		{"local credential check", ErrAuthFailed, RespCodeAuth},
+		{"unauthenticated", status.Error(codes.Unauthenticated, "bad password"), RespCodeAuth},
+		{"unknown user", status.Error(codes.NotFound, "no such user"), RespCodeAuth},
+		{"wrapped status", fmt.Errorf("session-manager login: %w", status.Error(codes.Unauthenticated, "x")), RespCodeAuth},
+		{"unavailable", status.Error(codes.Unavailable, "connection refused"), RespCodeSysTemp},
+		{"deadline", status.Error(codes.DeadlineExceeded, "timeout"), RespCodeSysTemp},
+		{"account disabled", status.Error(codes.PermissionDenied, "disabled"), RespCodeSysPerm},
+		{"internal", status.Error(codes.Internal, "boom"), RespCodeSysTemp},
+		{"unimplemented", status.Error(codes.Unimplemented, "no"), RespCodeSysTemp},
+		{"undocumented status", status.Error(codes.ResourceExhausted, "too many logins"), RespCodeSysTemp},
+		{"transport error", errors.New("connection reset"), RespCodeSysTemp},
+		{"access denied", ErrAccessDenied, RespCodeSysPerm},
+		{"user session limit", fmt.Errorf("%w: %w", ErrMailboxUnavailable, ErrTooManyUserSessions), RespCodeInUse},
+		{"domain session limit", fmt.Errorf("%w: %w", ErrMailboxUnavailable, ErrTooManyDomainSessions), RespCodeSysTemp},
+		{"mailbox error", fmt.Errorf("%w: %w", ErrMailboxUnavailable, errors.New("io")), RespCodeSysTemp},
+		{"mailbox not found", fmt.Errorf("%w: %w", ErrMailboxUnavailable, status.Error(codes.NotFound, "x")), RespCodeSysTemp},
+		{"maildrop locked", fmt.Errorf("%w: %w", ErrMailboxUnavailable, ErrMaildropLocked), RespCodeInUse},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := respCodeForError(tt.err); got != tt.want {
+				t.Errorf("respCodeForError() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResponseCodeFormatting(t *testing.T) {
+	resp := Response{OK: false, Code: RespCodeSysTemp, Message: "Try again later"}
+	if got, want := resp.String(), "-ERR [SYS/TEMP] Try again later\r\n"; got != want {
+		t.Errorf("String() = %q, want %q", got, want)
+	}
+}
+
+func TestPassResponseCodes(t *testing.T) {
+	tests := []struct {
+		name     string
+		loginErr error
+		want     string
+	}{
+		{"bad password", status.Error(codes.Unauthenticated, "bad password"), "-ERR [AUTH] "},
+		{"session-manager down", status.Error(codes.Unavailable, "down"), "-ERR [SYS/TEMP] "},
+		{"account disabled", status.Error(codes.PermissionDenied, "disabled"), "-ERR [SYS/PERM] "},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := &mockSessionService{
+				loginFunc: func(ctx context.Context, req *smpb.LoginRequest) (*smpb.LoginResponse, error) {
+					return nil, tt.loginErr
+				},
+			}
+			cmd := &passCommand{smClient: newTestSMClient(t, svc, &mockMailboxService{})}
+			sess := newTestSession(config.ModePop3s, true)
+			sess.SetUsername("testuser")
+
+			resp, err := cmd.Execute(context.Background(), sess, newMockConnection(), []string{"secret"})
+			if err != nil {
+				t.Fatalf("Execute() error = %v", err)
+			}
+			if got := resp.String(); !strings.HasPrefix(got, tt.want) {
+				t.Errorf("response = %q, want prefix %q", got, tt.want)
+			}
+		})
+	}
+}
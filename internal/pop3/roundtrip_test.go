@@ -226,6 +226,12 @@ func (s *testMailboxService) Expunge(ctx context.Context, req *pb.ExpungeRequest
 // newTestEnv starts a full POP3S server backed by a mock session-manager gRPC server.
 func newTestEnv(t *testing.T) *testEnv {
 	t.Helper()
+	return newTestEnvWithMaildrop(t, pop3.MaildropConfig{})
+}
+
+// newTestEnvWithMaildrop is newTestEnv with maildrop locking or policies enabled.
+func newTestEnvWithMaildrop(t *testing.T, maildrop pop3.MaildropConfig) *testEnv {
+	t.Helper()
 
 	smState := newTestSMState()
 
@@ -246,7 +252,7 @@ func newTestEnv(t *testing.T) *testEnv {
 
 	smCfg := config.SessionManagerConfig{Socket: smSocket}
 
-	handler := pop3.Handler("mail.test.local", mustSMClient(t, smCfg), serverTLS, &metrics.NoopCollector{})
+	handler := pop3.Handler("mail.test.local", mustSMClient(t, smCfg), serverTLS, &metrics.NoopCollector{}, pop3.AuthConfig{}, maildrop, nil)
 
 	// Bind on a random localhost port.
 	ln, err := tls.Listen("tcp", "127.0.0.1:0", serverTLS)
@@ -278,8 +284,8 @@ func newTestEnv(t *testing.T) *testEnv {
 				defer env.wg.Done()
 				connLogger := logging.NewLogger("error")
 				srvConn := server.NewConnection(c, server.ConnectionConfig{
+					PreAuthTimeout: 10 * time.Second,
 					IdleTimeout:    30 * time.Second,
-					CommandTimeout: 10 * time.Second,
 					Logger:         connLogger,
 				})
 				connCtx := logging.NewContext(ctx, connLogger)
@@ -1117,3 +1123,64 @@ func TestRoundTrip_PersistentMailboxAcrossSessions(t *testing.T) {
 		c.Quit(t)
 	}
 }
+
+func TestRoundTrip_MaildropLock_RejectsSecondSession(t *testing.T) {
+	env := newTestEnvWithMaildrop(t, pop3.MaildropConfig{Locks: pop3.NewMaildropLocks(config.LockPolicyReject)})
+	env.addUser(t, "alice", "testpass")
+
+	c1 := env.dial(t)
+	c1.Greet(t)
+	c1.Auth(t, "alice@test.local", "testpass")
+
+	c2 := env.dial(t)
+	c2.Greet(t)
+	c2.send(t, "USER alice@test.local")
+	c2.mustOK(t)
+	c2.send(t, "PASS testpass")
+	if msg := c2.mustErr(t); !strings.HasPrefix(msg, "[IN-USE]") {
+		t.Fatalf("second login: got %q, want [IN-USE]", msg)
+	}
+
+	// The rejected session stays in AUTHORIZATION and can log in once the
+	// first session has released the maildrop.
+	c1.Quit(t)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		c2.send(t, "PASS testpass")
+		line := c2.readLine()
+		if strings.HasPrefix(line, "+OK") {
+			break
+		}
+		if !strings.HasPrefix(line, "-ERR [IN-USE]") || time.Now().After(deadline) {
+			t.Fatalf("login after release: got %q", line)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c2.Quit(t)
+}
+
+func TestRoundTrip_MaildropLock_Takeover(t *testing.T) {
+	env := newTestEnvWithMaildrop(t, pop3.MaildropConfig{Locks: pop3.NewMaildropLocks(config.LockPolicyTakeover)})
+	env.addUser(t, "alice", "testpass")
+	env.deliverMessage(t, "alice", "Keep me", "body")
+
+	c1 := env.dial(t)
+	c1.Greet(t)
+	c1.Auth(t, "alice@test.local", "testpass")
+	c1.Dele(t, 1)
+
+	c2 := env.dial(t)
+	c2.Greet(t)
+	c2.Auth(t, "alice@test.local", "testpass")
+
+	// The older session is disconnected without entering UPDATE, so its
+	// deletion is never applied.
+	_ = c1.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := c1.r.ReadString('\n'); err == nil {
+		t.Error("older session still connected after takeover")
+	}
+	if count, _ := c2.Stat(t); count != 1 {
+		t.Errorf("STAT after takeover: got %d messages, want 1", count)
+	}
+	c2.Quit(t)
+}
@@ -6,9 +6,44 @@ import (
 	"github.com/emersion/go-sasl"
 )
 
-// SupportedSASLMechanisms returns the list of supported SASL mechanisms.
+// SupportedSASLMechanisms returns the list of SASL mechanisms this server
+// implements, in the order they are advertised. Which of them are offered on
+// a connection depends on the AuthConfig; see AuthConfig.Mechanisms.
 func SupportedSASLMechanisms() []string {
-	return []string{sasl.Plain}
+	return []string{sasl.Plain, sasl.Login}
+}
+
+// AuthConfig selects the optional authentication mechanisms offered by AUTH.
+// The zero value offers PLAIN only.
+type AuthConfig struct {
+	// Throttle delays the replies to failed logins, ends sessions with too
+	// many and bans addresses that keep failing. When nil, failures are
+	// not throttled.
+	Throttle *AuthThrottle
+
+	// Access holds the domains' rules for the addresses their users may
+	// log in from. When nil, logins are allowed from anywhere.
+	Access *DomainAccess
+
+	// Login enables the legacy LOGIN mechanism.
+	Login bool
+
+	// Subaddress splits user+folder@domain logins. The zero value disables
+	// it.
+	Subaddress Subaddressing
+}
+
+// Mechanisms returns the SASL mechanisms enabled by the configuration,
+// in the order they are advertised.
+func (c AuthConfig) Mechanisms() []string {
+	var mechs []string
+	for _, mech := range SupportedSASLMechanisms() {
+		if mech == sasl.Login && !c.Login {
+			continue
+		}
+		mechs = append(mechs, mech)
+	}
+	return mechs
 }
 
 // DecodeSASLResponse decodes a base64-encoded SASL response.
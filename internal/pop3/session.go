@@ -3,11 +3,19 @@ package pop3
 import (
 	"context"
 	"crypto/tls"
+	"fmt"
 	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/emersion/go-sasl"
 	"github.com/infodancer/msgstore"
 	"github.com/infodancer/pop3d/internal/config"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 // AuthenticatedUser holds the identity of a successfully authenticated user.
@@ -79,22 +87,45 @@ type Session struct {
 	hostname     string
 	listenerMode config.ListenerMode
 	tlsConfig    *tls.Config
-	insecureAuth bool // true when no TLS is configured (allows plaintext auth)
+	insecureAuth bool         // true when no TLS is configured (allows plaintext auth)
+	vhost        *VirtualHost // selected by SNI; nil is the default host
 
 	// Authentication state
-	clientIP          string // Client IP for rate limiting
+	clientIP          string // Client IP for login throttling
+	authFailures      int    // Failed logins in this session
+	badCommands       int    // Unknown, invalid or overlong commands
 	username          string
+	loginUser         string // Qualified username of the login being answered
 	authenticatedUser *AuthenticatedUser
 
 	// SASL state (for multi-step authentication exchanges)
-	saslServer sasl.Server // Active SASL server during exchange
-	saslMech   string      // Current mechanism name
+	saslMechanisms []string    // Mechanisms advertised in CAPA
+	listenerMechs  []string    // Mechanisms the listener allows; empty allows all
+	saslServer     sasl.Server // Active SASL server during exchange
+	saslMech       string      // Current mechanism name
 
 	// Transaction state (mailbox data)
 	mailbox     string                 // User's mailbox path
+	folder      string                 // Folder presented as the maildrop; "" is the inbox
 	store       msgstore.MessageStore  // Reference to message store
 	messageList []msgstore.MessageInfo // Loaded after auth
 	deletedSet  map[int]bool           // 1-based message numbers marked deleted
+
+	// Maildrop lock and policies
+	locks     *MaildropLocks // nil disables locking
+	terminate func()         // ends the session if another takes over its lock
+	unlock    func()         // releases the lock held in TRANSACTION
+	policies  *Policies      // LOGIN-DELAY and EXPIRE; nil disables them
+	record    *AccessRecord  // login and retrieval times for policies
+	retrieved bool           // messages were retrieved; record needs saving
+
+	// Per-user and per-domain session limits
+	sessions    *SessionLimits // nil disables them
+	releaseSlot func()         // ends the session's count while logged in
+
+	// Folders merged into an inbox maildrop
+	aggregate    []string
+	folderHeader string // header naming a merged message's folder; "" adds none
 }
 
 // NewSession creates a new POP3 session.
@@ -106,12 +137,13 @@ func NewSession(hostname string, mode config.ListenerMode, tlsConfig *tls.Config
 	}
 
 	return &Session{
-		state:        StateAuthorization,
-		tlsState:     tlsState,
-		hostname:     hostname,
-		listenerMode: mode,
-		tlsConfig:    tlsConfig,
-		insecureAuth: tlsConfig == nil,
+		state:          StateAuthorization,
+		tlsState:       tlsState,
+		hostname:       hostname,
+		listenerMode:   mode,
+		tlsConfig:      tlsConfig,
+		insecureAuth:   tlsConfig == nil,
+		saslMechanisms: AuthConfig{}.Mechanisms(),
 	}
 }
 
@@ -142,6 +174,13 @@ func (s *Session) InsecureAuth() bool {
 	return s.insecureAuth
 }
 
+// SetInsecureAuth overrides whether plaintext authentication is permitted
+// without TLS, for listeners configured with allow_insecure_auth or
+// require_tls_for_auth.
+func (s *Session) SetInsecureAuth(allow bool) {
+	s.insecureAuth = allow
+}
+
 // CanSTLS returns true if STLS command is available.
 // STLS is only available in StateAuthorization on ModePop3 listeners before TLS.
 func (s *Session) CanSTLS() bool {
@@ -156,16 +195,40 @@ func (s *Session) TLSConfig() *tls.Config {
 	return s.tlsConfig
 }
 
-// SetClientIP stores the client's IP address for rate limiting.
+// SetClientIP stores the client's IP address for login throttling.
 func (s *Session) SetClientIP(ip string) {
 	s.clientIP = ip
 }
 
+// RecordAuthFailure counts a failed login and returns the number of failures
+// in the session so far.
+func (s *Session) RecordAuthFailure() int {
+	s.authFailures++
+	return s.authFailures
+}
+
+// RecordBadCommand counts an unknown, invalid or overlong command and returns
+// the number in the session so far.
+func (s *Session) RecordBadCommand() int {
+	s.badCommands++
+	return s.badCommands
+}
+
 // ClientIP returns the client's IP address.
 func (s *Session) ClientIP() string {
 	return s.clientIP
 }
 
+// SetVirtualHost records the virtual host the session belongs to.
+func (s *Session) SetVirtualHost(vh *VirtualHost) {
+	s.vhost = vh
+}
+
+// VirtualHost returns the session's virtual host, or nil for the default host.
+func (s *Session) VirtualHost() *VirtualHost {
+	return s.vhost
+}
+
 // SetUsername stores the username from the USER command.
 func (s *Session) SetUsername(username string) {
 	s.username = username
@@ -176,6 +239,20 @@ func (s *Session) Username() string {
 	return s.username
 }
 
+// SetLoginUser records the qualified username, with any subaddress removed,
+// that a login attempt was made for.
+func (s *Session) SetLoginUser(username string) {
+	s.loginUser = username
+}
+
+// TakeLoginUser returns the username recorded by SetLoginUser and clears it,
+// so that it is never attributed to a later attempt.
+func (s *Session) TakeLoginUser() string {
+	username := s.loginUser
+	s.loginUser = ""
+	return username
+}
+
 // SetAuthenticated transitions to StateTransaction after successful authentication.
 func (s *Session) SetAuthenticated(user AuthenticatedUser) {
 	s.state = StateTransaction
@@ -199,6 +276,49 @@ func (s *Session) EnterUpdate() {
 	}
 }
 
+// SetMaildrop sets the locking and policies applied when the maildrop is
+// opened. terminate is called from another goroutine when a newer session
+// takes over the lock, and must end this session.
+func (s *Session) SetMaildrop(cfg MaildropConfig, terminate func()) {
+	s.locks = cfg.Locks
+	s.terminate = terminate
+	if cfg.Policies != nil && cfg.Record != nil {
+		s.policies = cfg.Policies
+		s.record = cfg.Record
+	}
+	s.aggregate = cfg.Aggregate
+	s.folderHeader = cfg.FolderHeader
+	s.sessions = cfg.Sessions
+}
+
+// SetSASLMechanisms sets the SASL mechanisms advertised in CAPA.
+func (s *Session) SetSASLMechanisms(mechs []string) {
+	s.saslMechanisms = mechs
+}
+
+// SetListenerMechanisms limits the SASL mechanisms to those the accepting
+// listener allows. Empty allows all.
+func (s *Session) SetListenerMechanisms(mechs []string) {
+	s.listenerMechs = mechs
+}
+
+// AllowsMechanism reports whether the listener and the virtual host allow the
+// SASL mechanism.
+func (s *Session) AllowsMechanism(mech string) bool {
+	if !s.vhost.AllowsMechanism(mech) {
+		return false
+	}
+	if len(s.listenerMechs) == 0 {
+		return true
+	}
+	for _, m := range s.listenerMechs {
+		if strings.EqualFold(m, mech) {
+			return true
+		}
+	}
+	return false
+}
+
 // SetSASLServer sets the active SASL server for a multi-step exchange.
 func (s *Session) SetSASLServer(mech string, server sasl.Server) {
 	s.saslMech = mech
@@ -229,16 +349,38 @@ func (s *Session) IsSASLInProgress() bool {
 // Capabilities returns the list of capabilities for this session.
 // Capabilities change based on TLS state and listener mode.
 func (s *Session) Capabilities() []string {
-	caps := []string{"TOP", "UIDL", "RESP-CODES"}
+	caps := []string{"TOP", "UIDL", "PIPELINING", "RESP-CODES", "AUTH-RESP-CODE"}
+
+	// Before login, the default policy is announced and USER flags that a
+	// user's own may differ; after login, the user's policy (RFC 2449).
+	if s.policies != nil {
+		if s.IsAuthenticated() && s.authenticatedUser != nil {
+			p := s.policies.For(s.authenticatedUser.Username)
+			caps = append(caps, loginDelayCapability(p.LoginDelay, false), expireCapability(p.ExpireDays, false))
+		} else {
+			p := s.policies.Default()
+			perUser := s.policies.VariesByUser()
+			caps = append(caps, loginDelayCapability(p.LoginDelay, perUser), expireCapability(p.ExpireDays, perUser))
+		}
+	}
 
 	// Only advertise USER if TLS is active
 	if s.tlsState == TLSStateActive {
 		caps = append([]string{"USER"}, caps...)
 	}
 
-	// Only advertise SASL PLAIN if TLS is active
+	// Only advertise SASL mechanisms if TLS is active
 	if s.tlsState == TLSStateActive {
-		caps = append(caps, "SASL PLAIN")
+		var mechs []string
+		for _, mech := range s.saslMechanisms {
+			if !s.AllowsMechanism(mech) {
+				continue
+			}
+			mechs = append(mechs, mech)
+		}
+		if len(mechs) > 0 {
+			caps = append(caps, "SASL "+strings.Join(mechs, " "))
+		}
 	}
 
 	// Only advertise STLS if it's available
@@ -251,59 +393,287 @@ func (s *Session) Capabilities() []string {
 
 // Cleanup performs cleanup when the session ends.
 // If the store implements io.Closer (e.g. session-manager store), it is closed
-// to release the remote session.
-func (s *Session) Cleanup() {
+// to release the remote session. The returned error is from saving the access
+// record; everything else is released regardless.
+func (s *Session) Cleanup() error {
+	var err error
 	if c, ok := s.store.(io.Closer); ok {
 		_ = c.Close()
 		s.store = nil
 	}
+	if s.retrieved {
+		err = s.record.Save()
+		s.retrieved = false
+	}
+	if s.unlock != nil {
+		s.unlock()
+		s.unlock = nil
+	}
+	s.ReleaseSessionSlot()
 	s.authenticatedUser = nil
+	return err
+}
+
+// AcquireSessionSlot counts a login of username against the per-user and
+// per-domain session limits. It is called before the credentials are
+// checked, so that a user over the limit never opens a session-manager
+// session. Cleanup releases the slot.
+func (s *Session) AcquireSessionSlot(username string) error {
+	if s.sessions == nil {
+		return nil
+	}
+	release, err := s.sessions.Acquire(username)
+	if err != nil {
+		return err
+	}
+	s.releaseSlot = release
+	return nil
+}
+
+// ReleaseSessionSlot releases the slot taken by AcquireSessionSlot, if any.
+func (s *Session) ReleaseSessionSlot() {
+	if s.releaseSlot != nil {
+		s.releaseSlot()
+		s.releaseSlot = nil
+	}
+}
+
+// AbortAuthentication returns the session to the AUTHORIZATION state when the
+// maildrop could not be opened after a successful login, releasing the
+// remote session and any maildrop lock.
+func (s *Session) AbortAuthentication() {
+	// Nothing has been retrieved yet, so there is no record to save.
+	_ = s.Cleanup()
+	s.store = nil
+	s.state = StateAuthorization
+	s.mailbox = ""
+	s.folder = ""
+	s.messageList = nil
+	s.deletedSet = nil
 }
 
 // InitializeMailbox loads the message list for the authenticated user's mailbox.
 // Should be called after successful authentication.
 //
 // If folder is non-empty (from a +extension subaddress), the session attempts to
-// present that folder as the inbox. If the store supports FolderStore and the
-// folder exists, all POP3 operations are transparently redirected to it.
-// If the folder does not exist or the store does not support folders, the session
-// falls back to the normal inbox — consistent with delivery behavior.
+// present that folder as the inbox. If the store supports FolderStore, or is a
+// session-manager store, and the folder exists, all POP3 operations are
+// transparently redirected to it. If the folder does not exist or the store
+// does not support folders, the session falls back to the normal inbox —
+// consistent with delivery behavior.
+//
+// An inbox session with aggregate folders configured presents the inbox and
+// those folders as a single virtual maildrop.
 func (s *Session) InitializeMailbox(ctx context.Context, store msgstore.MessageStore, folder string) error {
 	if s.authenticatedUser == nil {
 		return ErrMailboxNotInitialized
 	}
 
 	s.mailbox = s.authenticatedUser.Mailbox
+	s.folder = ""
 	s.deletedSet = make(map[int]bool)
+	username := s.authenticatedUser.Username
+	now := time.Now()
+
+	// LOGIN-DELAY is checked before taking the lock, so a login that comes
+	// too soon never takes over a running session.
+	if s.policies != nil {
+		delay := s.policies.For(username).LoginDelay
+		if last, ok := s.record.LastLogin(username); ok && delay > 0 && now.Sub(last) < delay {
+			return ErrLoginDelay
+		}
+	}
+
+	// The store is closed on cleanup even if opening the maildrop fails.
+	s.store = store
 
 	// If a +extension was specified, try to route to the corresponding folder.
 	effectiveStore := store
 	if folder != "" {
-		if fs, ok := store.(msgstore.FolderStore); ok {
-			folders, err := fs.ListFolders(ctx, s.mailbox)
-			if err == nil {
-				for _, f := range folders {
-					if f == folder {
-						effectiveStore = &folderMessageStore{fs: fs, folder: folder}
-						break
-					}
-				}
-			}
-			// If folder not found or ListFolders failed, fall through to inbox.
+		scoped, ok, err := s.openFolder(ctx, store, folder)
+		if err != nil {
+			return err
+		}
+		if ok {
+			effectiveStore = scoped
+			s.folder = folder
 		}
 	}
 	s.store = effectiveStore
 
-	// Load message list
-	messages, err := effectiveStore.List(ctx, s.mailbox)
-	if err != nil {
-		return err
+	parts := []aggregatePart{{folder: s.folder, store: effectiveStore}}
+	if s.folder == "" {
+		for _, f := range s.aggregate {
+			scoped, ok, err := s.openFolder(ctx, store, f)
+			if err != nil {
+				return err
+			}
+			if ok {
+				parts = append(parts, aggregatePart{folder: f, store: scoped})
+			}
+		}
+	}
+
+	// Lock the maildrop before taking the snapshot that DELE refers to.
+	// Each folder is its own maildrop.
+	if s.locks != nil {
+		if err := s.lockParts(ctx, parts); err != nil {
+			return err
+		}
+	}
+
+	// Load message lists
+	for i := range parts {
+		messages, err := parts[i].store.List(ctx, s.mailbox)
+		if err != nil {
+			return err
+		}
+		if s.policies != nil && !readOnly(parts[i].store) {
+			messages, err = s.expireMessages(ctx, parts[i].store, folderKey(userKey(username), parts[i].folder), messages, now)
+			if err != nil {
+				return err
+			}
+		}
+		parts[i].messages = messages
+	}
+
+	if s.policies != nil {
+		if err := s.record.RecordLogin(username, now); err != nil {
+			return err
+		}
 	}
-	s.messageList = messages
 
+	if len(parts) == 1 {
+		s.messageList = parts[0].messages
+		return nil
+	}
+	agg := newAggregateStore(parts, s.folderHeader)
+	s.store = agg
+	s.messageList = agg.list
+	return nil
+}
+
+// openFolder returns a store presenting folder of the user's mailbox, or false
+// if the folder does not exist or store does not support folders.
+func (s *Session) openFolder(ctx context.Context, store msgstore.MessageStore, folder string) (msgstore.MessageStore, bool, error) {
+	switch fs := store.(type) {
+	case msgstore.FolderStore:
+		folders, err := fs.ListFolders(ctx, s.mailbox)
+		if err != nil {
+			// Treat a failed listing like a missing folder.
+			return nil, false, nil
+		}
+		for _, f := range folders {
+			if f == folder {
+				return &folderMessageStore{fs: fs, folder: folder}, true, nil
+			}
+		}
+	case *sessionManagerStore:
+		// The session-manager cannot list folders; probe this one.
+		scoped := fs.inFolder(folder)
+		if _, _, err := scoped.Stat(ctx, s.mailbox); err != nil {
+			if status.Code(err) == codes.NotFound {
+				return nil, false, nil
+			}
+			return nil, false, err
+		}
+		return scoped, true, nil
+	}
+	return nil, false, nil
+}
+
+// lockParts locks every folder of the maildrop, or none of them.
+func (s *Session) lockParts(ctx context.Context, parts []aggregatePart) error {
+	unlocks := make([]func(), 0, len(parts))
+	unlockAll := func() {
+		for _, unlock := range unlocks {
+			unlock()
+		}
+	}
+	for _, p := range parts {
+		unlock, err := s.locks.Acquire(ctx, folderKey(s.mailbox, p.folder), s.terminate)
+		if err != nil {
+			unlockAll()
+			return err
+		}
+		unlocks = append(unlocks, unlock)
+	}
+	s.unlock = unlockAll
 	return nil
 }
 
+// expireMessages deletes messages that were retrieved longer ago than the
+// user's EXPIRE period and returns the remaining messages. key identifies the
+// folder's retrievals in the access record.
+func (s *Session) expireMessages(ctx context.Context, store msgstore.MessageStore, key string, messages []msgstore.MessageInfo, now time.Time) ([]msgstore.MessageInfo, error) {
+	username := s.authenticatedUser.Username
+
+	present := make(map[uint32]bool, len(messages))
+	for _, m := range messages {
+		present[m.UID] = true
+	}
+
+	var expired []uint32
+	for _, uid := range s.record.Expired(key, s.policies.For(username).ExpireDays, now) {
+		if present[uid] {
+			expired = append(expired, uid)
+		}
+	}
+	if failed := deleteMessages(ctx, store, s.mailbox, expired); len(failed) > 0 {
+		return nil, fmt.Errorf("expire messages: %w", &DeleteError{Failed: failed})
+	}
+	for _, uid := range expired {
+		delete(present, uid)
+	}
+
+	if len(expired) > 0 {
+		if err := store.Expunge(ctx, s.mailbox); err != nil {
+			return nil, fmt.Errorf("expire messages: %w", err)
+		}
+		kept := messages[:0]
+		for _, m := range messages {
+			if present[m.UID] {
+				kept = append(kept, m)
+			}
+		}
+		messages = kept
+	}
+
+	s.record.Prune(key, present)
+	return messages, nil
+}
+
+// folderKey qualifies a mailbox or username with a folder, so that each
+// folder is locked and expired on its own. The inbox is the bare name.
+func folderKey(name, folder string) string {
+	if folder == "" {
+		return name
+	}
+	return name + "/" + folder
+}
+
+// messageStore returns the store holding the message with uid.
+func (s *Session) messageStore(uid uint32) msgstore.MessageStore {
+	if agg, ok := s.store.(*aggregateStore); ok {
+		return agg.storeOf(uid)
+	}
+	return s.store
+}
+
+// MarkRetrieved records that a message was retrieved, starting its EXPIRE
+// period. Messages that cannot be deleted never expire, so are not recorded.
+func (s *Session) MarkRetrieved(uid uint32) {
+	if s.record == nil || s.authenticatedUser == nil || readOnly(s.messageStore(uid)) {
+		return
+	}
+	folder := s.folder
+	if agg, ok := s.store.(*aggregateStore); ok {
+		folder, uid = agg.locate(uid)
+	}
+	s.record.RecordRetrieved(folderKey(userKey(s.authenticatedUser.Username), folder), uid, time.Now())
+	s.retrieved = true
+}
+
 // MessageCount returns the count of non-deleted messages.
 func (s *Session) MessageCount() int {
 	if s.messageList == nil {
@@ -358,6 +728,9 @@ func (s *Session) MarkDeleted(msgNum int) error {
 	if s.deletedSet[msgNum] {
 		return ErrMessageDeleted
 	}
+	if readOnly(s.messageStore(s.messageList[msgNum-1].UID)) {
+		return ErrFolderReadOnly
+	}
 	s.deletedSet[msgNum] = true
 	return nil
 }
@@ -381,6 +754,34 @@ func (s *Session) GetDeletedUIDs() []uint32 {
 	return uids
 }
 
+// CommitDeletions removes the messages marked for deletion from the maildrop.
+// It is called in the UPDATE state. Messages are deleted with bounded
+// parallelism, then expunged. If any could not be removed, the returned
+// *DeleteError lists them by UID.
+func (s *Session) CommitDeletions(ctx context.Context) error {
+	uids := s.GetDeletedUIDs()
+	if len(uids) == 0 || s.store == nil {
+		return nil
+	}
+
+	failed := deleteMessages(ctx, s.store, s.mailbox, uids)
+	if len(failed) == len(uids) {
+		return &DeleteError{Failed: failed}
+	}
+	if err := s.store.Expunge(ctx, s.mailbox); err != nil {
+		// Nothing was removed.
+		for _, uid := range uids {
+			if _, ok := failed[uid]; !ok {
+				failed[uid] = err
+			}
+		}
+	}
+	if len(failed) > 0 {
+		return &DeleteError{Failed: failed}
+	}
+	return nil
+}
+
 // Store returns the message store for this session.
 func (s *Session) Store() msgstore.MessageStore {
 	return s.store
@@ -391,6 +792,20 @@ func (s *Session) Mailbox() string {
 	return s.mailbox
 }
 
+// UIDL returns the unique-id listing of a message. Messages merged from other
+// folders get folder-qualified ids so they never collide with the inbox.
+func (s *Session) UIDL(msg msgstore.MessageInfo) string {
+	if agg, ok := s.store.(*aggregateStore); ok {
+		return agg.uidl(msg.UID)
+	}
+	return strconv.FormatUint(uint64(msg.UID), 10)
+}
+
+// Folder returns the folder presented as the maildrop; "" is the inbox.
+func (s *Session) Folder() string {
+	return s.folder
+}
+
 // AllMessages returns iterating info for all messages (for LIST/UIDL).
 // Returns slice of (msgNum, msgInfo) where msgNum is 1-based.
 func (s *Session) AllMessages() []struct {
@@ -414,3 +829,50 @@ func (s *Session) AllMessages() []struct {
 	}
 	return result
 }
+
+// deleteParallelism bounds the concurrent Delete calls when committing.
+const deleteParallelism = 8
+
+// deleteMessages deletes uids from mailbox, at most deleteParallelism at a
+// time, and returns the errors by UID.
+func deleteMessages(ctx context.Context, store msgstore.MessageStore, mailbox string, uids []uint32) map[uint32]error {
+	failed := make(map[uint32]error)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, deleteParallelism)
+	for _, uid := range uids {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			if err := store.Delete(ctx, mailbox, uid); err != nil {
+				mu.Lock()
+				failed[uid] = err
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return failed
+}
+
+// DeleteError reports messages that could not be removed in the UPDATE state.
+type DeleteError struct {
+	// Failed maps each UID that was not removed to the reason.
+	Failed map[uint32]error
+}
+
+// UIDs returns the UIDs that were not removed, in ascending order.
+func (e *DeleteError) UIDs() []uint32 {
+	uids := make([]uint32, 0, len(e.Failed))
+	for uid := range e.Failed {
+		uids = append(uids, uid)
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+	return uids
+}
+
+func (e *DeleteError) Error() string {
+	return fmt.Sprintf("%d deleted messages not removed", len(e.Failed))
+}
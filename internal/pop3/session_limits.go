@@ -0,0 +1,85 @@
+package pop3
+
+import (
+	"strings"
+	"sync"
+
+	"github.com/infodancer/pop3d/internal/config"
+	"github.com/infodancer/pop3d/internal/metrics"
+)
+
+// SessionLimits counts the logged-in sessions of each user and each domain
+// and caps them, so that a client opening many parallel sessions for one
+// account cannot exhaust the session-manager. The limits can be changed
+// while the server runs; sessions over a lowered limit are not ended.
+type SessionLimits struct {
+	collector metrics.Collector
+
+	mu        sync.Mutex
+	maxUser   int
+	maxDomain int
+	users     map[string]int
+	domains   map[string]int
+}
+
+// NewSessionLimits creates session limits from configuration.
+func NewSessionLimits(cfg config.LimitsConfig, collector metrics.Collector) *SessionLimits {
+	if collector == nil {
+		collector = &metrics.NoopCollector{}
+	}
+	l := &SessionLimits{
+		collector: collector,
+		users:     make(map[string]int),
+		domains:   make(map[string]int),
+	}
+	l.SetLimits(cfg)
+	return l
+}
+
+// SetLimits applies the session limits of a reloaded configuration.
+func (l *SessionLimits) SetLimits(cfg config.LimitsConfig) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.maxUser = cfg.MaxSessionsPerUser
+	l.maxDomain = cfg.MaxSessionsPerDomain
+}
+
+// Acquire counts a session of username and returns the function that ends
+// it. It returns ErrTooManyUserSessions or ErrTooManyDomainSessions if the
+// user or their domain already has as many as allowed.
+func (l *SessionLimits) Acquire(username string) (release func(), err error) {
+	user := strings.ToLower(username)
+	domain := strings.ToLower(extractDomain(username))
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.maxUser > 0 && l.users[user] >= l.maxUser {
+		l.collector.SessionLimitReached("user")
+		return nil, ErrTooManyUserSessions
+	}
+	if l.maxDomain > 0 && domain != "unknown" && l.domains[domain] >= l.maxDomain {
+		l.collector.SessionLimitReached("domain")
+		return nil, ErrTooManyDomainSessions
+	}
+	l.users[user]++
+	l.domains[domain]++
+	l.collector.ActiveSessions(domain, l.domains[domain])
+
+	var once sync.Once
+	return func() { once.Do(func() { l.release(user, domain) }) }, nil
+}
+
+// release ends a session counted by Acquire.
+func (l *SessionLimits) release(user, domain string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.users[user]--; l.users[user] <= 0 {
+		delete(l.users, user)
+	}
+	if l.domains[domain]--; l.domains[domain] <= 0 {
+		delete(l.domains, domain)
+	}
+	l.collector.ActiveSessions(domain, l.domains[domain])
+}
@@ -0,0 +1,137 @@
+package pop3
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/infodancer/pop3d/internal/config"
+	"github.com/infodancer/pop3d/internal/metrics"
+	smpb "github.com/infodancer/session-manager/proto/sessionmanager/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// sessionCollector records the session counts and limit rejections.
+type sessionCollector struct {
+	metrics.NoopCollector
+	mu       sync.Mutex
+	active   map[string]int
+	rejected map[string]int
+}
+
+func (c *sessionCollector) ActiveSessions(domain string, count int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.active[domain] = count
+}
+
+func (c *sessionCollector) SessionLimitReached(limit string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rejected[limit]++
+}
+
+func TestSessionLimits(t *testing.T) {
+	collector := &sessionCollector{active: map[string]int{}, rejected: map[string]int{}}
+	limits := NewSessionLimits(config.LimitsConfig{MaxSessionsPerUser: 2, MaxSessionsPerDomain: 3}, collector)
+
+	releaseA1, err := limits.Acquire("alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := limits.Acquire("Alice@Example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := limits.Acquire("alice@example.com"); !errors.Is(err, ErrTooManyUserSessions) {
+		t.Fatalf("third session of user: err = %v, want ErrTooManyUserSessions", err)
+	}
+	if _, err := limits.Acquire("bob@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := limits.Acquire("carol@example.com"); !errors.Is(err, ErrTooManyDomainSessions) {
+		t.Fatalf("fourth session of domain: err = %v, want ErrTooManyDomainSessions", err)
+	}
+	if _, err := limits.Acquire("carol@example.org"); err != nil {
+		t.Errorf("another domain was limited: %v", err)
+	}
+	if collector.active["example.com"] != 3 {
+		t.Errorf("active sessions of example.com = %d, want 3", collector.active["example.com"])
+	}
+
+	releaseA1()
+	releaseA1() // releasing twice is harmless
+	if _, err := limits.Acquire("carol@example.com"); err != nil {
+		t.Errorf("after release: %v", err)
+	}
+	if collector.rejected["user"] != 1 || collector.rejected["domain"] != 1 {
+		t.Errorf("rejections = %v, want one per limit", collector.rejected)
+	}
+
+	// A raised limit applies to the next login.
+	limits.SetLimits(config.LimitsConfig{MaxSessionsPerUser: 3})
+	if _, err := limits.Acquire("alice@example.com"); err != nil {
+		t.Errorf("after raising the limits: %v", err)
+	}
+}
+
+func TestSessionLimitLogin(t *testing.T) {
+	limits := NewSessionLimits(config.LimitsConfig{MaxSessionsPerUser: 1}, nil)
+	var logouts int
+	svc := &mockSessionService{
+		loginFunc: func(ctx context.Context, req *smpb.LoginRequest) (*smpb.LoginResponse, error) {
+			if req.Password != "secret" {
+				return nil, status.Error(codes.Unauthenticated, "invalid credentials")
+			}
+			return &smpb.LoginResponse{SessionToken: "tok", Mailbox: req.Username}, nil
+		},
+		logoutFunc: func(ctx context.Context, req *smpb.LogoutRequest) (*smpb.LogoutResponse, error) {
+			logouts++
+			return &smpb.LogoutResponse{}, nil
+		},
+	}
+	cmd := &passCommand{smClient: newTestSMClient(t, svc, &mockMailboxService{})}
+
+	login := func(password string) (*Session, Response) {
+		sess := newTestSession(config.ModePop3s, true)
+		sess.SetMaildrop(MaildropConfig{Sessions: limits}, nil)
+		sess.SetUsername("alice@example.com")
+		resp, err := cmd.Execute(context.Background(), sess, newMockConnection(), []string{password})
+		if err != nil {
+			t.Fatalf("Execute() error = %v", err)
+		}
+		return sess, resp
+	}
+
+	// A failed login gives its slot back.
+	if _, resp := login("wrong"); resp.OK {
+		t.Fatalf("login with wrong password = %+v", resp)
+	}
+
+	first, resp := login("secret")
+	if !resp.OK {
+		t.Fatalf("first login = %+v", resp)
+	}
+
+	// A wrong password over the limit tells nothing about the account.
+	if _, resp := login("wrong"); resp.OK || resp.Code != RespCodeAuth {
+		t.Fatalf("wrong password over the limit = %+v, want -ERR [AUTH]", resp)
+	}
+
+	second, resp := login("secret")
+	if resp.OK || resp.Code != RespCodeInUse {
+		t.Fatalf("second login = %+v, want -ERR [IN-USE]", resp)
+	}
+	if logouts != 1 {
+		t.Errorf("session-manager logouts over the limit = %d, want 1", logouts)
+	}
+	if second.State() != StateAuthorization {
+		t.Errorf("second session state = %v, want AUTHORIZATION", second.State())
+	}
+
+	first.Cleanup()
+	if _, resp := login("secret"); !resp.OK {
+		t.Errorf("login after Cleanup = %+v", resp)
+	}
+}
@@ -1,9 +1,14 @@
 package pop3
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
+	"slices"
+	"strings"
 	"testing"
 
+	"github.com/infodancer/msgstore"
 	"github.com/infodancer/pop3d/internal/config"
 )
 
@@ -216,7 +221,7 @@ func TestCapabilities(t *testing.T) {
 			mode:         config.ModePop3,
 			isTLS:        false,
 			tlsConfig:    nil,
-			wantCapCount: 3, // TOP, UIDL, RESP-CODES
+			wantCapCount: 5, // TOP, UIDL, PIPELINING, RESP-CODES, AUTH-RESP-CODE
 			wantHasUser:  false,
 			wantHasSTLS:  false,
 		},
@@ -225,7 +230,7 @@ func TestCapabilities(t *testing.T) {
 			mode:         config.ModePop3,
 			isTLS:        false,
 			tlsConfig:    &tls.Config{},
-			wantCapCount: 4, // TOP, UIDL, RESP-CODES, STLS
+			wantCapCount: 6, // TOP, UIDL, PIPELINING, RESP-CODES, AUTH-RESP-CODE, STLS
 			wantHasUser:  false,
 			wantHasSTLS:  true,
 		},
@@ -234,7 +239,7 @@ func TestCapabilities(t *testing.T) {
 			mode:         config.ModePop3s,
 			isTLS:        true,
 			tlsConfig:    &tls.Config{},
-			wantCapCount: 5, // USER, TOP, UIDL, RESP-CODES, SASL PLAIN
+			wantCapCount: 7, // USER, TOP, UIDL, PIPELINING, RESP-CODES, AUTH-RESP-CODE, SASL PLAIN
 			wantHasUser:  true,
 			wantHasSTLS:  false,
 		},
@@ -243,7 +248,7 @@ func TestCapabilities(t *testing.T) {
 			mode:         config.ModePop3,
 			isTLS:        true,
 			tlsConfig:    &tls.Config{},
-			wantCapCount: 5, // USER, TOP, UIDL, RESP-CODES, SASL PLAIN
+			wantCapCount: 7, // USER, TOP, UIDL, PIPELINING, RESP-CODES, AUTH-RESP-CODE, SASL PLAIN
 			wantHasUser:  true,
 			wantHasSTLS:  false,
 		},
@@ -280,6 +285,25 @@ func TestCapabilities(t *testing.T) {
 	}
 }
 
+func TestCapabilitiesListenerMechanisms(t *testing.T) {
+	sess := NewSession("test.example.com", config.ModePop3s, &tls.Config{}, true)
+	sess.SetSASLMechanisms([]string{"PLAIN", "LOGIN"})
+	sess.SetListenerMechanisms([]string{"login"})
+
+	var sasl string
+	for _, c := range sess.Capabilities() {
+		if strings.HasPrefix(c, "SASL ") {
+			sasl = c
+		}
+	}
+	if sasl != "SASL LOGIN" {
+		t.Errorf("SASL capability = %q, want only the listener's mechanism", sasl)
+	}
+	if sess.AllowsMechanism("PLAIN") {
+		t.Error("AllowsMechanism(PLAIN) = true, want false")
+	}
+}
+
 func TestSessionCleanup(t *testing.T) {
 	sess := NewSession("test.example.com", config.ModePop3s, nil, true)
 
@@ -287,7 +311,9 @@ func TestSessionCleanup(t *testing.T) {
 	sess.SetAuthenticated(AuthenticatedUser{Username: "test"})
 
 	// Cleanup should clear the authenticated user
-	sess.Cleanup()
+	if err := sess.Cleanup(); err != nil {
+		t.Fatal(err)
+	}
 
 	if sess.AuthenticatedUser() != nil {
 		t.Error("AuthenticatedUser should be nil after Cleanup()")
@@ -332,3 +358,72 @@ func TestTLSStateString(t *testing.T) {
 		})
 	}
 }
+
+func TestCommitDeletions(t *testing.T) {
+	messages := []msgstore.MessageInfo{{UID: 1}, {UID: 2}, {UID: 3}, {UID: 4}}
+
+	tests := []struct {
+		name       string
+		store      *recordingStore
+		dele       []int
+		wantFailed []uint32
+		wantGone   []uint32
+	}{
+		{
+			name:     "all removed",
+			store:    &recordingStore{messages: messages},
+			dele:     []int{1, 3},
+			wantGone: []uint32{1, 3},
+		},
+		{
+			name:       "one delete fails",
+			store:      &recordingStore{messages: messages, failDelete: map[uint32]bool{3: true}},
+			dele:       []int{1, 3, 4},
+			wantFailed: []uint32{3},
+			wantGone:   []uint32{1, 4},
+		},
+		{
+			name:       "expunge fails",
+			store:      &recordingStore{messages: messages, expungeErr: errors.New("disk full")},
+			dele:       []int{2, 4},
+			wantFailed: []uint32{2, 4},
+		},
+		{
+			name:  "nothing deleted",
+			store: &recordingStore{messages: messages},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sess := newAuthenticatedSession()
+			if err := sess.InitializeMailbox(context.Background(), tt.store, ""); err != nil {
+				t.Fatalf("InitializeMailbox: %v", err)
+			}
+			for _, n := range tt.dele {
+				if err := sess.MarkDeleted(n); err != nil {
+					t.Fatalf("MarkDeleted(%d): %v", n, err)
+				}
+			}
+
+			err := sess.CommitDeletions(context.Background())
+
+			var derr *DeleteError
+			if tt.wantFailed == nil {
+				if err != nil {
+					t.Fatalf("CommitDeletions() error = %v", err)
+				}
+			} else if !errors.As(err, &derr) || !slices.Equal(derr.UIDs(), tt.wantFailed) {
+				t.Fatalf("CommitDeletions() error = %v, want failures %v", err, tt.wantFailed)
+			}
+
+			slices.Sort(tt.store.deleted)
+			if tt.store.expunged && !slices.Equal(tt.store.deleted, tt.wantGone) {
+				t.Errorf("removed %v, want %v", tt.store.deleted, tt.wantGone)
+			}
+			if (len(tt.wantGone) > 0) != tt.store.expunged {
+				t.Errorf("expunged = %v, want %v", tt.store.expunged, len(tt.wantGone) > 0)
+			}
+		})
+	}
+}
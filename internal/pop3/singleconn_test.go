@@ -19,8 +19,9 @@ import (
 )
 
 // newSingleConnStack creates a minimal Stack (no listeners) backed by a mock
-// session-manager for use with RunSingleConn tests.
-func newSingleConnStack(t *testing.T) *pop3.Stack {
+// session-manager for use with RunSingleConn tests. configure, if given,
+// adjusts the configuration first.
+func newSingleConnStack(t *testing.T, configure ...func(*config.Config)) *pop3.Stack {
 	t.Helper()
 
 	// Start a mock session-manager gRPC server.
@@ -39,6 +40,9 @@ func newSingleConnStack(t *testing.T) *pop3.Stack {
 	cfg := config.Default()
 	cfg.Hostname = "single.local"
 	cfg.SessionManager = config.SessionManagerConfig{Socket: smSocket}
+	for _, fn := range configure {
+		fn(&cfg)
+	}
 
 	logger := logging.NewLogger("error")
 	stack, err := pop3.NewStack(pop3.StackConfig{
@@ -173,3 +177,40 @@ func TestRunSingleConn_ConcurrentSessions(t *testing.T) {
 	}
 	wg.Wait()
 }
+
+// TestRunSingleConn_AccessDenied verifies that a connection passed by inetd
+// is subject to the access rules of the listeners for its mode.
+func TestRunSingleConn_AccessDenied(t *testing.T) {
+	t.Parallel()
+
+	stack := newSingleConnStack(t, func(cfg *config.Config) {
+		cfg.Listeners = []config.ListenerConfig{{Address: ":110", Mode: config.ModePop3, Access: []string{"deny 127.0.0.0/8"}}}
+	})
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	clientConn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer clientConn.Close()
+	serverConn, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- stack.RunSingleConn(serverConn, config.ModePop3, nil) }()
+
+	_ = clientConn.SetDeadline(time.Now().Add(5 * time.Second))
+	c := &pop3Pipe{conn: clientConn, r: bufio.NewReader(clientConn)}
+	if line := c.readLine(); line != "-ERR [SYS/PERM] Connections from your address are not permitted" {
+		t.Errorf("denied client got %q, want an access denied response", line)
+	}
+	if err := <-done; err != nil {
+		t.Errorf("RunSingleConn() error = %v", err)
+	}
+}
@@ -1,7 +1,6 @@
 package pop3
 
 import (
-	"bytes"
 	"context"
 	"crypto/tls"
 	"crypto/x509"
@@ -114,32 +113,80 @@ func (c *SessionManagerClient) StatMailbox(ctx context.Context, token, folder st
 	return resp.Count, resp.TotalBytes, nil
 }
 
-// FetchMessage retrieves a message by UID. The returned ReadCloser assembles
-// the server-streamed chunks into a contiguous byte stream.
+// FetchMessage retrieves a message by UID. The returned ReadCloser yields the
+// server-streamed chunks as they arrive rather than buffering the message.
+// The first chunk is received before returning so that errors such as
+// NotFound are reported here, before the caller commits to a response.
+// Closing the reader early cancels the stream.
 func (c *SessionManagerClient) FetchMessage(ctx context.Context, token, folder string, uid uint32) (io.ReadCloser, error) {
-	stream, err := c.mailbox.Fetch(tokenCtx(ctx, token), &pb.FetchRequest{
+	ctx, cancel := context.WithCancel(tokenCtx(ctx, token))
+	stream, err := c.mailbox.Fetch(ctx, &pb.FetchRequest{
 		Folder: folder,
 		Uid:    uid,
 	})
 	if err != nil {
+		cancel()
 		return nil, err
 	}
 
-	var buf bytes.Buffer
-	for {
-		chunk, err := stream.Recv()
-		if err == io.EOF {
-			break
-		}
-		if err != nil {
-			return nil, fmt.Errorf("fetch stream: %w", err)
+	r := &fetchReader{stream: stream, cancel: cancel}
+	if err := r.fill(); err != nil && err != io.EOF {
+		cancel()
+		return nil, err
+	}
+	return r, nil
+}
+
+// fetchStream is the receive side of a MailboxService Fetch stream.
+type fetchStream interface {
+	Recv() (*pb.FetchResponse, error)
+}
+
+// fetchReader adapts a Fetch stream to io.ReadCloser, holding at most one
+// chunk in memory at a time.
+type fetchReader struct {
+	stream fetchStream
+	cancel context.CancelFunc
+	buf    []byte
+	err    error
+}
+
+func (r *fetchReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if err := r.fill(); err != nil {
+			return 0, err
 		}
-		buf.Write(chunk.Data)
 	}
-	return io.NopCloser(&buf), nil
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// fill receives the next chunk into buf. Once the stream has ended or failed,
+// fill keeps returning the same error.
+func (r *fetchReader) fill() error {
+	if r.err != nil {
+		return r.err
+	}
+	chunk, err := r.stream.Recv()
+	switch {
+	case err == io.EOF:
+		r.err = io.EOF
+	case err != nil:
+		r.err = fmt.Errorf("fetch stream: %w", err)
+	default:
+		r.buf = chunk.Data
+	}
+	return r.err
+}
+
+// Close cancels the stream if it has not been fully consumed.
+func (r *fetchReader) Close() error {
+	r.cancel()
+	return nil
 }
 
-// DeleteMessage marks a message for POP3-style deletion.
+// DeleteMessage marks an inbox message for POP3-style deletion.
 func (c *SessionManagerClient) DeleteMessage(ctx context.Context, token string, uid uint32) error {
 	_, err := c.mailbox.Delete(tokenCtx(ctx, token), &pb.DeleteRequest{Uid: uid})
 	return err
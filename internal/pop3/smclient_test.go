@@ -5,7 +5,9 @@ import (
 	"io"
 	"net"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	pb "github.com/infodancer/mail-session/proto/mailsession/v1"
 	"github.com/infodancer/pop3d/internal/config"
@@ -285,6 +287,78 @@ func TestSessionManagerClient_FetchMessage(t *testing.T) {
 	}
 }
 
+func TestSessionManagerClient_FetchMessage_Streams(t *testing.T) {
+	chunks := []string{"Subject: big\r\n\r\n", "part one\r\n", "part two\r\n"}
+	mailboxSvc := &mockMailboxService{
+		fetchFunc: func(req *pb.FetchRequest, stream grpc.ServerStreamingServer[pb.FetchResponse]) error {
+			for _, c := range chunks {
+				if err := stream.Send(&pb.FetchResponse{Data: []byte(c)}); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	}
+	client := newTestSMClient(t, &mockSessionService{}, mailboxSvc)
+
+	rc, err := client.FetchMessage(context.Background(), "tok", "", 1)
+	if err != nil {
+		t.Fatalf("FetchMessage: %v", err)
+	}
+	defer func() { _ = rc.Close() }()
+
+	data, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatalf("ReadAll: %v", err)
+	}
+	if want := strings.Join(chunks, ""); string(data) != want {
+		t.Errorf("body = %q, want %q", string(data), want)
+	}
+}
+
+func TestSessionManagerClient_FetchMessage_NotFound(t *testing.T) {
+	mailboxSvc := &mockMailboxService{
+		fetchFunc: func(req *pb.FetchRequest, stream grpc.ServerStreamingServer[pb.FetchResponse]) error {
+			return status.Error(codes.NotFound, "no such message")
+		},
+	}
+	client := newTestSMClient(t, &mockSessionService{}, mailboxSvc)
+
+	// The error must surface from FetchMessage itself, before any +OK is sent.
+	if _, err := client.FetchMessage(context.Background(), "tok", "", 99); err == nil {
+		t.Fatal("FetchMessage should fail for a missing message")
+	}
+}
+
+func TestSessionManagerClient_FetchMessage_CloseCancelsStream(t *testing.T) {
+	cancelled := make(chan struct{})
+	mailboxSvc := &mockMailboxService{
+		fetchFunc: func(req *pb.FetchRequest, stream grpc.ServerStreamingServer[pb.FetchResponse]) error {
+			if err := stream.Send(&pb.FetchResponse{Data: []byte("first\r\n")}); err != nil {
+				return err
+			}
+			<-stream.Context().Done()
+			close(cancelled)
+			return stream.Context().Err()
+		},
+	}
+	client := newTestSMClient(t, &mockSessionService{}, mailboxSvc)
+
+	rc, err := client.FetchMessage(context.Background(), "tok", "", 1)
+	if err != nil {
+		t.Fatalf("FetchMessage: %v", err)
+	}
+	if err := rc.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("server stream was not cancelled after Close")
+	}
+}
+
 func TestSessionManagerClient_DeleteAndExpunge(t *testing.T) {
 	var deletedUID uint32
 	var expungedFolder string
@@ -315,7 +389,7 @@ func TestSessionManagerClient_DeleteAndExpunge(t *testing.T) {
 		t.Fatalf("DeleteMessage: %v", err)
 	}
 	if deletedUID != 1 {
-		t.Errorf("deleted UID = %d, want 1", deletedUID)
+		t.Errorf("deleted UID %d, want 1", deletedUID)
 	}
 
 	if err := client.ExpungeMailbox(ctx, "tok", "INBOX"); err != nil {
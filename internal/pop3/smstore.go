@@ -16,9 +16,13 @@ var (
 // sessionManagerStore adapts a SessionManagerClient into a msgstore.MessageStore.
 // All operations are proxied through the session-manager's MailboxService using
 // the session token obtained during Login. Closing the store calls Logout.
+//
+// The store presents one folder of the user's mailbox; the empty folder is
+// the inbox.
 type sessionManagerStore struct {
 	client *SessionManagerClient
 	token  string
+	folder string
 }
 
 // newSessionManagerStore creates a store backed by the given client and session token.
@@ -26,8 +30,13 @@ func newSessionManagerStore(client *SessionManagerClient, token string) *session
 	return &sessionManagerStore{client: client, token: token}
 }
 
+// inFolder returns a store for folder that shares this store's session.
+func (s *sessionManagerStore) inFolder(folder string) msgstore.MessageStore {
+	return &sessionManagerStore{client: s.client, token: s.token, folder: folder}
+}
+
 func (s *sessionManagerStore) List(ctx context.Context, mailbox string) ([]msgstore.MessageInfo, error) {
-	msgs, err := s.client.ListMessages(ctx, s.token, "")
+	msgs, err := s.client.ListMessages(ctx, s.token, s.folder)
 	if err != nil {
 		return nil, err
 	}
@@ -42,7 +51,7 @@ func (s *sessionManagerStore) List(ctx context.Context, mailbox string) ([]msgst
 }
 
 func (s *sessionManagerStore) Stat(ctx context.Context, mailbox string) (int, int64, error) {
-	count, totalBytes, err := s.client.StatMailbox(ctx, s.token, "")
+	count, totalBytes, err := s.client.StatMailbox(ctx, s.token, s.folder)
 	if err != nil {
 		return 0, 0, err
 	}
@@ -50,15 +59,31 @@ func (s *sessionManagerStore) Stat(ctx context.Context, mailbox string) (int, in
 }
 
 func (s *sessionManagerStore) Retrieve(ctx context.Context, mailbox string, uid uint32) (io.ReadCloser, error) {
-	return s.client.FetchMessage(ctx, s.token, "", uid)
+	return s.client.FetchMessage(ctx, s.token, s.folder, uid)
 }
 
+// Delete and Expunge act on the inbox only. The Delete RPC has no folder, and
+// expunging a folder would remove every message flagged \Deleted in it, not
+// only those this session deleted.
 func (s *sessionManagerStore) Delete(ctx context.Context, mailbox string, uid uint32) error {
+	if s.folder != "" {
+		return ErrFolderReadOnly
+	}
 	return s.client.DeleteMessage(ctx, s.token, uid)
 }
 
 func (s *sessionManagerStore) Expunge(ctx context.Context, mailbox string) error {
-	return s.client.ExpungeMailbox(ctx, s.token, "")
+	if s.folder != "" {
+		return ErrFolderReadOnly
+	}
+	return s.client.ExpungeMailbox(ctx, s.token, s.folder)
+}
+
+// readOnly reports whether messages in store cannot be deleted: it is a
+// session-manager folder other than the inbox (see ErrFolderReadOnly).
+func readOnly(store msgstore.MessageStore) bool {
+	sm, ok := store.(*sessionManagerStore)
+	return ok && sm.folder != ""
 }
 
 // Close releases the session by calling Logout on the session-manager.
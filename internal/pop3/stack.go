@@ -8,6 +8,7 @@ import (
 	"io"
 	"log/slog"
 	"net"
+	"time"
 
 	"github.com/infodancer/pop3d/internal/config"
 	"github.com/infodancer/pop3d/internal/metrics"
@@ -21,13 +22,20 @@ type StackConfig struct {
 	TLSConfig *tls.Config
 	Collector metrics.Collector // nil → NoopCollector
 	Logger    *slog.Logger      // nil → slog.Default()
+
+	// Activated holds sockets passed in by systemd; when set they replace
+	// the configured listeners.
+	Activated []server.ActivatedListener
 }
 
 // Stack owns all components of a running pop3d instance and manages their lifecycle.
 type Stack struct {
-	server  *server.Server
-	closers []io.Closer
-	logger  *slog.Logger
+	server   *server.Server
+	access   *DomainAccess
+	sessions *SessionLimits
+	throttle *AuthThrottle
+	closers  []io.Closer
+	logger   *slog.Logger
 }
 
 // NewStack creates a Stack from the given configuration, wiring up all components.
@@ -60,22 +68,69 @@ func NewStack(cfg StackConfig) (*Stack, error) {
 		"socket", cfg.Config.SessionManager.Socket,
 		"address", cfg.Config.SessionManager.Address)
 
+	auth := AuthConfig{
+		Login:      cfg.Config.SASL.Login,
+		Subaddress: NewSubaddressing(cfg.Config.Subaddress),
+	}
+	if throttleCfg := cfg.Config.AuthThrottle; throttleCfg.IsEnabled() {
+		throttle, err := NewAuthThrottle(throttleCfg, collector)
+		if err != nil {
+			s.Close() //nolint:errcheck
+			return nil, err
+		}
+		auth.Throttle = throttle
+	}
+	access, err := NewDomainAccess(cfg.Config.Domains)
+	if err != nil {
+		s.Close() //nolint:errcheck
+		return nil, fmt.Errorf("domain access: %w", err)
+	}
+	auth.Access = access
+	s.access = access
+
 	// Create server.
 	srv, err := server.New(server.Config{
 		Cfg:       &cfg.Config,
 		TLSConfig: cfg.TLSConfig,
 		Logger:    logger,
+		Collector: collector,
+		Activated: cfg.Activated,
+		Banned:    auth.Throttle.Banned,
 	})
 	if err != nil {
 		s.Close() //nolint:errcheck
 		return nil, err
 	}
 
+	maildrop := MaildropConfig{
+		Locks:        NewMaildropLocks(cfg.Config.Lock.LockPolicy()),
+		Aggregate:    cfg.Config.Aggregate.Folders,
+		FolderHeader: cfg.Config.Aggregate.Header,
+		Sessions:     NewSessionLimits(cfg.Config.Limits, collector),
+	}
+	if policyCfg := cfg.Config.Policy; policyCfg.IsEnabled() {
+		policies, err := NewPolicies(policyCfg)
+		if err != nil {
+			s.Close() //nolint:errcheck
+			return nil, fmt.Errorf("policy: %w", err)
+		}
+		record, err := LoadAccessRecord(policyCfg.RecordFile, policies.MaxLoginDelay())
+		if err != nil {
+			s.Close() //nolint:errcheck
+			return nil, err
+		}
+		s.closers = append(s.closers, record)
+		maildrop.Policies = policies
+		maildrop.Record = record
+	}
+
 	// Set POP3 protocol handler.
-	handler := Handler(cfg.Config.Hostname, smClient, cfg.TLSConfig, collector)
+	handler := Handler(cfg.Config.Hostname, smClient, cfg.TLSConfig, collector, auth, maildrop, NewVirtualHosts(cfg.Config.Domains))
 	srv.SetHandler(handler)
 
 	s.server = srv
+	s.throttle = auth.Throttle
+	s.sessions = maildrop.Sessions
 	return s, nil
 }
 
@@ -84,6 +139,28 @@ func (s *Stack) Run(ctx context.Context) error {
 	return s.server.Run(ctx)
 }
 
+// Reload applies a new configuration to the running server: connection and
+// session limits, timeouts, listeners and access rules. Other settings take
+// effect on restart. The current configuration is kept if the new one cannot
+// be applied.
+func (s *Stack) Reload(cfg config.Config) error {
+	// Check the domains' rules before anything is applied
+	if _, err := NewDomainAccess(cfg.Domains); err != nil {
+		return fmt.Errorf("domain access: %w", err)
+	}
+	if err := s.server.Reload(&cfg); err != nil {
+		return err
+	}
+	s.sessions.SetLimits(cfg.Limits)
+	return s.access.Set(cfg.Domains)
+}
+
+// DrainTimeout returns how long sessions are given to finish on shutdown
+// under the configuration in force.
+func (s *Stack) DrainTimeout() time.Duration {
+	return s.server.Config().Timeouts.DrainTimeout()
+}
+
 // Close shuts down all closeable components in reverse registration order.
 func (s *Stack) Close() error {
 	var errs []error
@@ -100,12 +177,41 @@ func (s *Stack) Close() error {
 func (s *Stack) RunSingleConn(conn net.Conn, mode config.ListenerMode, tlsConfig *tls.Config) error {
 	cfg := s.server.Config()
 	connCfg := server.ConnectionConfig{
-		IdleTimeout:    cfg.Timeouts.ConnectionTimeout(),
-		CommandTimeout: cfg.Timeouts.CommandTimeout(),
+		TLSConfig:      tlsConfig,
+		PreAuthTimeout: cfg.Timeouts.PreAuthTimeout(),
+		IdleTimeout:    cfg.Timeouts.IdleTimeout(),
+		WriteTimeout:   cfg.Timeouts.WriteTimeout(),
+		SessionTimeout: cfg.Timeouts.SessionTimeout(),
+		MaxAuthLine:    cfg.Limits.MaxAuthLine,
+		MaxBadCommands: cfg.Limits.MaxBadCommands,
 		LogTransaction: cfg.LogLevel == "debug",
 		Logger:         s.logger,
 	}
+	// A denied or banned client is turned away before any TLS handshake;
+	// over POP3S it gets no plaintext reply.
+	allowed, rule, err := s.server.CheckAccess(conn.RemoteAddr(), mode)
+	if err != nil {
+		_ = conn.Close()
+		return fmt.Errorf("access rules: %w", err)
+	}
+	if !allowed {
+		s.logger.Warn("connection rejected: access denied", "remote_addr", conn.RemoteAddr().String(), "rule", rule)
+		if mode != config.ModePop3s {
+			_, _ = io.WriteString(conn, "-ERR [SYS/PERM] Connections from your address are not permitted\r\n")
+		}
+		return conn.Close()
+	}
+	if host, _, err := net.SplitHostPort(conn.RemoteAddr().String()); err == nil && s.throttle.Banned(host) {
+		s.logger.Info("connection rejected: address banned", "remote_addr", conn.RemoteAddr().String())
+		if mode != config.ModePop3s {
+			_, _ = io.WriteString(conn, "-ERR [SYS/TEMP] Too many failed logins, try again later\r\n")
+		}
+		return conn.Close()
+	}
 	c := server.NewConnection(conn, connCfg)
+	if err := c.SetCommandTimeout(false); err != nil {
+		return fmt.Errorf("set timeout: %w", err)
+	}
 	if mode == config.ModePop3s {
 		if tlsConfig == nil {
 			return fmt.Errorf("POP3S mode requires TLS configuration")
@@ -0,0 +1,26 @@
+package pop3
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// writeStateFile replaces the file at path with data. The data is written to
+// a temporary file in the same directory and renamed into place, so readers
+// never see a partly written file.
+func writeStateFile(path string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name()) //nolint:errcheck
+
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,69 @@
+package pop3
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/infodancer/pop3d/internal/config"
+)
+
+// Subaddressing splits subaddressed logins (user+folder@domain) into the user
+// to authenticate and the folder to present as the maildrop. The zero value
+// disables it.
+type Subaddressing struct {
+	// Separators lists the characters that separate the user from the folder.
+	Separators string
+
+	// FolderCase is the case folding applied to the folder name
+	// (see config.SubaddressConfig).
+	FolderCase string
+}
+
+// NewSubaddressing builds the subaddressing rules from configuration.
+func NewSubaddressing(cfg config.SubaddressConfig) Subaddressing {
+	return Subaddressing{Separators: cfg.Separator, FolderCase: cfg.FolderCase}
+}
+
+// Split returns the login without its subaddress and the folder it names.
+// Logins without a subaddress, and subaddresses naming INBOX, yield an empty
+// folder. A separator at the start of the local part is not a subaddress.
+func (s Subaddressing) Split(login string) (user, folder string) {
+	if s.Separators == "" {
+		return login, ""
+	}
+
+	local, domain := login, ""
+	if at := strings.LastIndex(login, "@"); at >= 0 {
+		local, domain = login[:at], login[at:]
+	}
+	i := strings.IndexAny(local, s.Separators)
+	if i <= 0 {
+		return login, ""
+	}
+
+	folder = s.foldCase(local[i+1:])
+	if strings.EqualFold(folder, "INBOX") {
+		folder = ""
+	}
+	return local[:i] + domain, folder
+}
+
+// foldCase applies the configured case folding to a folder name.
+func (s Subaddressing) foldCase(folder string) string {
+	switch s.FolderCase {
+	case config.FolderCaseLower:
+		return strings.ToLower(folder)
+	case config.FolderCaseUpper:
+		return strings.ToUpper(folder)
+	case config.FolderCaseTitle:
+		lower := strings.ToLower(folder)
+		r, size := utf8.DecodeRuneInString(lower)
+		if size == 0 {
+			return lower
+		}
+		return string(unicode.ToUpper(r)) + lower[size:]
+	default:
+		return folder
+	}
+}
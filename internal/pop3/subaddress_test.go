@@ -0,0 +1,205 @@
+package pop3
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"github.com/emersion/go-sasl"
+	pb "github.com/infodancer/mail-session/proto/mailsession/v1"
+	"github.com/infodancer/pop3d/internal/config"
+	smpb "github.com/infodancer/session-manager/proto/sessionmanager/v1"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestSubaddressingSplit(t *testing.T) {
+	tests := []struct {
+		name       string
+		rules      Subaddressing
+		login      string
+		wantUser   string
+		wantFolder string
+	}{
+		{"disabled", Subaddressing{}, "alice+Work@example.com", "alice+Work@example.com", ""},
+		{"plus", Subaddressing{Separators: "+"}, "alice+Work@example.com", "alice@example.com", "Work"},
+		{"no subaddress", Subaddressing{Separators: "+"}, "alice@example.com", "alice@example.com", ""},
+		{"no domain", Subaddressing{Separators: "+"}, "alice+Work", "alice", "Work"},
+		{"second separator", Subaddressing{Separators: "+-"}, "alice-Work@example.com", "alice@example.com", "Work"},
+		{"first separator wins", Subaddressing{Separators: "+"}, "alice+a+b@example.com", "alice@example.com", "a+b"},
+		{"leading separator", Subaddressing{Separators: "+"}, "+alice@example.com", "+alice@example.com", ""},
+		{"empty folder", Subaddressing{Separators: "+"}, "alice+@example.com", "alice@example.com", ""},
+		{"inbox", Subaddressing{Separators: "+"}, "alice+inbox@example.com", "alice@example.com", ""},
+		{"lower", Subaddressing{Separators: "+", FolderCase: config.FolderCaseLower}, "alice+Work@example.com", "alice@example.com", "work"},
+		{"upper", Subaddressing{Separators: "+", FolderCase: config.FolderCaseUpper}, "alice+Work@example.com", "alice@example.com", "WORK"},
+		{"title", Subaddressing{Separators: "+", FolderCase: config.FolderCaseTitle}, "alice+wORK@example.com", "alice@example.com", "Work"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user, folder := tt.rules.Split(tt.login)
+			if user != tt.wantUser || folder != tt.wantFolder {
+				t.Errorf("Split(%q) = (%q, %q), want (%q, %q)", tt.login, user, folder, tt.wantUser, tt.wantFolder)
+			}
+		})
+	}
+}
+
+// folderMailboxSvc returns a mailbox service with messages in the inbox and in
+// the Work folder, recording the folders that were accessed.
+func folderMailboxSvc(folders *[]string) *mockMailboxService {
+	var mu sync.Mutex
+	record := func(folder string) {
+		mu.Lock()
+		*folders = append(*folders, folder)
+		mu.Unlock()
+	}
+	return &mockMailboxService{
+		statFunc: func(ctx context.Context, req *pb.StatRequest) (*pb.StatResponse, error) {
+			record(req.Folder)
+			if req.Folder != "" && req.Folder != "Work" {
+				return nil, status.Error(codes.NotFound, "no such folder")
+			}
+			return &pb.StatResponse{Count: 1, TotalBytes: 100}, nil
+		},
+		listFunc: func(ctx context.Context, req *pb.ListRequest) (*pb.ListResponse, error) {
+			record(req.Folder)
+			if req.Folder == "Work" {
+				return &pb.ListResponse{Messages: []*pb.MessageInfo{{Uid: 7, Size: 100}}}, nil
+			}
+			return &pb.ListResponse{Messages: []*pb.MessageInfo{{Uid: 1, Size: 10}, {Uid: 2, Size: 20}}}, nil
+		},
+	}
+}
+
+func TestPassSubaddressFolder(t *testing.T) {
+	tests := []struct {
+		name       string
+		login      string
+		wantFolder string
+		wantCount  int
+	}{
+		{"existing folder", "alice+Work@example.com", "Work", 1},
+		{"missing folder falls back to inbox", "alice+Play@example.com", "", 2},
+		{"no subaddress", "alice@example.com", "", 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var loginUser string
+			svc := &mockSessionService{
+				loginFunc: func(ctx context.Context, req *smpb.LoginRequest) (*smpb.LoginResponse, error) {
+					loginUser = req.Username
+					return &smpb.LoginResponse{SessionToken: "tok", Mailbox: req.Username}, nil
+				},
+			}
+			var folders []string
+			cmd := &passCommand{
+				smClient: newTestSMClient(t, svc, folderMailboxSvc(&folders)),
+				auth:     AuthConfig{Subaddress: Subaddressing{Separators: "+"}},
+			}
+			sess := newTestSession(config.ModePop3s, true)
+			sess.SetUsername(tt.login)
+
+			resp, err := cmd.Execute(context.Background(), sess, newMockConnection(), []string{"secret"})
+			if err != nil || !resp.OK {
+				t.Fatalf("Execute() = %+v, %v", resp, err)
+			}
+			if loginUser != "alice@example.com" {
+				t.Errorf("login username = %q, want alice@example.com", loginUser)
+			}
+			if sess.Folder() != tt.wantFolder {
+				t.Errorf("Folder() = %q, want %q", sess.Folder(), tt.wantFolder)
+			}
+			if sess.MessageCount() != tt.wantCount {
+				t.Errorf("MessageCount() = %d, want %d (folders accessed %q)", sess.MessageCount(), tt.wantCount, folders)
+			}
+		})
+	}
+}
+
+func TestAuthPlainSubaddressFolder(t *testing.T) {
+	var loginUser string
+	svc := &mockSessionService{
+		loginFunc: func(ctx context.Context, req *smpb.LoginRequest) (*smpb.LoginResponse, error) {
+			loginUser = req.Username
+			return &smpb.LoginResponse{SessionToken: "tok", Mailbox: req.Username}, nil
+		},
+	}
+	var folders []string
+	cmd := &authCommand{
+		smClient: newTestSMClient(t, svc, folderMailboxSvc(&folders)),
+		auth:     AuthConfig{Subaddress: Subaddressing{Separators: "+", FolderCase: config.FolderCaseTitle}},
+	}
+	sess := newTestSession(config.ModePop3s, true)
+
+	ir := EncodeSASLChallenge([]byte("\x00alice+work@example.com\x00secret"))
+	resp, err := cmd.Execute(context.Background(), sess, newMockConnection(), []string{sasl.Plain, ir})
+	if err != nil || !resp.OK {
+		t.Fatalf("Execute() = %+v, %v", resp, err)
+	}
+	if loginUser != "alice@example.com" || sess.Username() != "alice@example.com" {
+		t.Errorf("login username = %q, session username = %q, want alice@example.com", loginUser, sess.Username())
+	}
+	if sess.Folder() != "Work" || sess.MessageCount() != 1 {
+		t.Errorf("folder = %q with %d messages, want Work with 1", sess.Folder(), sess.MessageCount())
+	}
+}
+
+func TestSubaddressFolderLockedSeparately(t *testing.T) {
+	locks := NewMaildropLocks(config.LockPolicyReject)
+	var folders []string
+	smClient := newTestSMClient(t, defaultSessionSvc(), folderMailboxSvc(&folders))
+	cmd := &passCommand{smClient: smClient, auth: AuthConfig{Subaddress: Subaddressing{Separators: "+"}}}
+
+	login := func(user string) Response {
+		t.Helper()
+		sess := newTestSession(config.ModePop3s, true)
+		sess.SetMaildrop(MaildropConfig{Locks: locks}, nil)
+		sess.SetUsername(user)
+		resp, err := cmd.Execute(context.Background(), sess, newMockConnection(), []string{"secret"})
+		if err != nil {
+			t.Fatalf("Execute() error = %v", err)
+		}
+		return resp
+	}
+
+	if resp := login("alice@example.com"); !resp.OK {
+		t.Fatalf("inbox login = %+v", resp)
+	}
+	if resp := login("alice+Work@example.com"); !resp.OK {
+		t.Errorf("folder login while inbox is locked = %+v, want OK", resp)
+	}
+	if resp := login("alice+Work@example.com"); resp.OK || resp.Code != RespCodeInUse {
+		t.Errorf("second folder login = %+v, want [IN-USE]", resp)
+	}
+}
+
+func TestSubaddressFolderIsReadOnly(t *testing.T) {
+	var folders []string
+	svc := folderMailboxSvc(&folders)
+	svc.deleteFunc = func(ctx context.Context, req *pb.DeleteRequest) (*pb.DeleteResponse, error) {
+		t.Errorf("Delete called for uid %d in a folder session", req.Uid)
+		return &pb.DeleteResponse{}, nil
+	}
+	svc.expungeFunc = func(ctx context.Context, req *pb.ExpungeRequest) (*pb.ExpungeResponse, error) {
+		t.Errorf("Expunge called for folder %q", req.Folder)
+		return &pb.ExpungeResponse{}, nil
+	}
+	smClient := newTestSMClient(t, defaultSessionSvc(), svc)
+	sess := newTestSession(config.ModePop3s, true)
+	sess.SetUsername("alice+Work@example.com")
+	ctx := context.Background()
+	conn := newMockConnection()
+
+	cmd := &passCommand{smClient: smClient, auth: AuthConfig{Subaddress: Subaddressing{Separators: "+"}}}
+	if resp, err := cmd.Execute(ctx, sess, conn, []string{"secret"}); err != nil || !resp.OK {
+		t.Fatalf("PASS = %+v, %v", resp, err)
+	}
+	if resp, _ := (&deleCommand{}).Execute(ctx, sess, conn, []string{"1"}); resp.OK {
+		t.Errorf("DELE 1 = %+v, want messages in folders refused", resp)
+	}
+	if resp, _ := (&quitCommand{}).Execute(ctx, sess, conn, nil); !resp.OK {
+		t.Errorf("QUIT = %+v", resp)
+	}
+}
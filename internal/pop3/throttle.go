@@ -0,0 +1,270 @@
+package pop3
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/infodancer/pop3d/internal/config"
+	"github.com/infodancer/pop3d/internal/metrics"
+)
+
+// Defaults for login throttling.
+const (
+	defaultThrottleDelay    = time.Second
+	defaultThrottleMaxDelay = 30 * time.Second
+	defaultThrottleWindow   = 15 * time.Minute
+	defaultBanDuration      = time.Hour
+)
+
+// AuthThrottle slows down clients that fail to log in and bans addresses
+// that keep failing. Failures are counted per client address and per
+// username across sessions, and forgotten once none has occurred for the
+// window. Bans are optionally persisted as a small JSON file.
+type AuthThrottle struct {
+	delay        time.Duration
+	maxDelay     time.Duration
+	maxFailures  int
+	banThreshold int
+	window       time.Duration
+	banDuration  time.Duration
+	collector    metrics.Collector
+	path         string
+	saveMu       sync.Mutex // serializes Save so an older snapshot never wins
+	now          func() time.Time
+
+	mu        sync.Mutex
+	ips       map[string]*failureCount
+	users     map[string]*failureCount
+	bans      map[string]time.Time // address → end of ban
+	lastSweep time.Time
+}
+
+// failureCount is the number of recent failures of an address or user.
+type failureCount struct {
+	n    int
+	last time.Time
+}
+
+// throttleState is the persisted form of the bans.
+type throttleState struct {
+	Bans map[string]time.Time `json:"bans"`
+}
+
+// AuthFailure is the outcome of a failed login.
+type AuthFailure struct {
+	// Delay is how long to wait before replying.
+	Delay time.Duration
+	// Banned is set if the failure got the client's address banned.
+	Banned bool
+}
+
+// NewAuthThrottle creates a throttle from configuration, loading the bans
+// from its state file if there is one.
+func NewAuthThrottle(cfg config.AuthThrottleConfig, collector metrics.Collector) (*AuthThrottle, error) {
+	if collector == nil {
+		collector = &metrics.NoopCollector{}
+	}
+	t := &AuthThrottle{
+		maxFailures:  cfg.MaxFailures,
+		banThreshold: cfg.BanThreshold,
+		collector:    collector,
+		path:         cfg.StateFile,
+		now:          time.Now,
+		ips:          make(map[string]*failureCount),
+		users:        make(map[string]*failureCount),
+		bans:         make(map[string]time.Time),
+	}
+
+	var err error
+	durations := []struct {
+		dst  *time.Duration
+		name string
+		v    string
+		def  time.Duration
+	}{
+		{&t.delay, "delay", cfg.Delay, defaultThrottleDelay},
+		{&t.maxDelay, "max_delay", cfg.MaxDelay, defaultThrottleMaxDelay},
+		{&t.window, "window", cfg.Window, defaultThrottleWindow},
+		{&t.banDuration, "ban_duration", cfg.BanDuration, defaultBanDuration},
+	}
+	for _, d := range durations {
+		*d.dst = d.def
+		if d.v == "" {
+			continue
+		}
+		if *d.dst, err = time.ParseDuration(d.v); err != nil {
+			return nil, fmt.Errorf("auth_throttle %s: %w", d.name, err)
+		}
+	}
+
+	if err := t.load(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// load reads the bans still in force from the state file. A missing file
+// yields no bans.
+func (t *AuthThrottle) load() error {
+	if t.path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(t.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("auth_throttle state: %w", err)
+	}
+	var state throttleState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("auth_throttle state %s: %w", t.path, err)
+	}
+	now := t.now()
+	for ip, until := range state.Bans {
+		if until.After(now) {
+			t.bans[ip] = until
+		}
+	}
+	t.collector.ActiveBans(len(t.bans))
+	return nil
+}
+
+// MaxFailures returns how many failed logins end a session, or zero.
+func (t *AuthThrottle) MaxFailures() int {
+	if t == nil {
+		return 0
+	}
+	return t.maxFailures
+}
+
+// Banned reports whether ip is banned.
+func (t *AuthThrottle) Banned(ip string) bool {
+	if t == nil || ip == "" {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	until, ok := t.bans[ip]
+	if !ok {
+		return false
+	}
+	if t.now().Before(until) {
+		return true
+	}
+	delete(t.bans, ip)
+	t.collector.ActiveBans(len(t.bans))
+	return false
+}
+
+// Failure records a failed login by username from ip and returns how long to
+// delay the reply and whether ip is now banned. An error means the bans
+// could not be saved; the result is valid regardless.
+func (t *AuthThrottle) Failure(ip, username string) (AuthFailure, error) {
+	now := t.now()
+
+	t.mu.Lock()
+	t.sweep(now)
+	ipFailures := t.count(t.ips, ip, now)
+	recent := max(ipFailures, t.count(t.users, strings.ToLower(username), now))
+
+	var result AuthFailure
+	if recent > 0 {
+		result.Delay = t.delay
+		for i := 1; i < recent && result.Delay < t.maxDelay; i++ {
+			result.Delay *= 2
+		}
+		result.Delay = min(result.Delay, t.maxDelay)
+	}
+	if ip != "" && t.banThreshold > 0 && ipFailures >= t.banThreshold {
+		t.bans[ip] = now.Add(t.banDuration)
+		delete(t.ips, ip)
+		result.Banned = true
+	}
+	active := len(t.bans)
+	t.mu.Unlock()
+
+	if !result.Banned {
+		return result, nil
+	}
+	t.collector.IPBanned()
+	t.collector.ActiveBans(active)
+	return result, t.Save()
+}
+
+// Success forgets the failures of a user who has now logged in. The
+// address's failures are kept, so that one valid account does not let a
+// client go on guessing others.
+func (t *AuthThrottle) Success(username string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.users, strings.ToLower(username))
+}
+
+// count adds a failure for key and returns the number of recent ones. An
+// empty key is not counted. The caller must hold t.mu.
+func (t *AuthThrottle) count(counts map[string]*failureCount, key string, now time.Time) int {
+	if key == "" {
+		return 0
+	}
+	c, ok := counts[key]
+	if !ok || now.Sub(c.last) > t.window {
+		c = &failureCount{}
+		counts[key] = c
+	}
+	c.n++
+	c.last = now
+	return c.n
+}
+
+// sweep forgets, about once a minute, failures older than the window and
+// bans that have ended. The caller must hold t.mu.
+func (t *AuthThrottle) sweep(now time.Time) {
+	if now.Sub(t.lastSweep) < time.Minute {
+		return
+	}
+	t.lastSweep = now
+	for _, counts := range []map[string]*failureCount{t.ips, t.users} {
+		for key, c := range counts {
+			if now.Sub(c.last) > t.window {
+				delete(counts, key)
+			}
+		}
+	}
+	for ip, until := range t.bans {
+		if !now.Before(until) {
+			delete(t.bans, ip)
+		}
+	}
+	t.collector.ActiveBans(len(t.bans))
+}
+
+// Save writes the bans to the state file, replacing it atomically.
+func (t *AuthThrottle) Save() error {
+	if t.path == "" {
+		return nil
+	}
+
+	t.saveMu.Lock()
+	defer t.saveMu.Unlock()
+
+	t.mu.Lock()
+	data, err := json.Marshal(throttleState{Bans: t.bans})
+	t.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("auth_throttle state: %w", err)
+	}
+
+	if err := writeStateFile(t.path, data); err != nil {
+		return fmt.Errorf("auth_throttle state: %w", err)
+	}
+	return nil
+}
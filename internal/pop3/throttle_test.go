@@ -0,0 +1,173 @@
+package pop3
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/infodancer/pop3d/internal/config"
+	"github.com/infodancer/pop3d/internal/metrics"
+	"github.com/infodancer/pop3d/internal/server"
+)
+
+// banCollector records the ban metrics.
+type banCollector struct {
+	metrics.NoopCollector
+	banned, active int
+}
+
+func (c *banCollector) IPBanned()            { c.banned++ }
+func (c *banCollector) ActiveBans(count int) { c.active = count }
+
+func newTestThrottle(t *testing.T, cfg config.AuthThrottleConfig, collector metrics.Collector) (*AuthThrottle, *time.Time) {
+	t.Helper()
+	throttle, err := NewAuthThrottle(cfg, collector)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	throttle.now = func() time.Time { return now }
+	return throttle, &now
+}
+
+func TestAuthThrottleDelay(t *testing.T) {
+	throttle, _ := newTestThrottle(t, config.AuthThrottleConfig{Delay: "1s", MaxDelay: "5s"}, nil)
+
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for i, w := range want {
+		result, err := throttle.Failure("192.0.2.1", "alice@example.com")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if result.Delay != w {
+			t.Errorf("failure %d: delay = %v, want %v", i+1, result.Delay, w)
+		}
+	}
+
+	// Failures of the same user from another address are delayed too.
+	if result, _ := throttle.Failure("192.0.2.2", "Alice@example.com"); result.Delay != 5*time.Second {
+		t.Errorf("other address: delay = %v, want the user's 5s", result.Delay)
+	}
+}
+
+func TestAuthThrottleWindow(t *testing.T) {
+	throttle, now := newTestThrottle(t, config.AuthThrottleConfig{Delay: "1s", Window: "10m"}, nil)
+
+	_, _ = throttle.Failure("192.0.2.1", "alice@example.com")
+	_, _ = throttle.Failure("192.0.2.1", "alice@example.com")
+
+	*now = now.Add(11 * time.Minute)
+	if result, _ := throttle.Failure("192.0.2.1", "alice@example.com"); result.Delay != time.Second {
+		t.Errorf("after the window: delay = %v, want 1s", result.Delay)
+	}
+}
+
+func TestAuthThrottleSuccessClearsUser(t *testing.T) {
+	throttle, _ := newTestThrottle(t, config.AuthThrottleConfig{Delay: "1s"}, nil)
+
+	_, _ = throttle.Failure("", "alice@example.com")
+	_, _ = throttle.Failure("", "alice@example.com")
+	throttle.Success("alice@example.com")
+
+	if result, _ := throttle.Failure("", "alice@example.com"); result.Delay != time.Second {
+		t.Errorf("after success: delay = %v, want 1s", result.Delay)
+	}
+}
+
+func TestAuthThrottleBan(t *testing.T) {
+	collector := &banCollector{}
+	state := filepath.Join(t.TempDir(), "bans.json")
+	cfg := config.AuthThrottleConfig{BanThreshold: 3, BanDuration: "1h", StateFile: state}
+	throttle, now := newTestThrottle(t, cfg, collector)
+
+	for i := 0; i < 2; i++ {
+		if result, _ := throttle.Failure("192.0.2.1", "alice@example.com"); result.Banned {
+			t.Fatalf("banned after %d failures", i+1)
+		}
+	}
+	result, err := throttle.Failure("192.0.2.1", "bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Banned || !throttle.Banned("192.0.2.1") {
+		t.Fatal("address not banned at the threshold")
+	}
+	if throttle.Banned("192.0.2.2") {
+		t.Error("another address is banned")
+	}
+	if collector.banned != 1 || collector.active != 1 {
+		t.Errorf("metrics: banned = %d, active = %d; want 1, 1", collector.banned, collector.active)
+	}
+
+	// The ban survives a restart, and ends after its duration.
+	restarted, err := NewAuthThrottle(cfg, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	restarted.now = throttle.now
+	if !restarted.Banned("192.0.2.1") {
+		t.Error("ban was not loaded from the state file")
+	}
+	*now = now.Add(time.Hour)
+	if restarted.Banned("192.0.2.1") {
+		t.Error("ban did not end")
+	}
+}
+
+func TestThrottleAuthEndsSession(t *testing.T) {
+	srv, cli := net.Pipe()
+	defer cli.Close()
+	conn := server.NewConnection(srv, server.ConnectionConfig{})
+	defer conn.Close()
+
+	throttle, _ := newTestThrottle(t, config.AuthThrottleConfig{Delay: "1ms", MaxDelay: "1ms", MaxFailures: 2}, nil)
+	sess := NewSession("test.example.com", config.ModePop3s, nil, true)
+	sess.SetClientIP("192.0.2.1")
+	sess.SetUsername("alice@example.com")
+	failed := authFailure(ErrAuthFailed)
+
+	if throttleAuth(context.Background(), conn, sess, throttle, Response{OK: false, Code: RespCodeInUse}) {
+		t.Error("a locked maildrop counted as a failed login")
+	}
+	if throttleAuth(context.Background(), conn, sess, throttle, authFailure(ErrAccessDenied)) {
+		t.Error("an access denial counted as a failed login")
+	}
+	if throttleAuth(context.Background(), conn, sess, throttle, failed) {
+		t.Error("session ended after the first failure")
+	}
+	if !throttleAuth(context.Background(), conn, sess, throttle, failed) {
+		t.Error("session not ended after max_failures")
+	}
+}
+
+func TestThrottleAuthKeysOnLoginUser(t *testing.T) {
+	srv, cli := net.Pipe()
+	defer cli.Close()
+	conn := server.NewConnection(srv, server.ConnectionConfig{})
+	defer conn.Close()
+
+	throttle, _ := newTestThrottle(t, config.AuthThrottleConfig{Delay: "1ms", MaxDelay: "1ms"}, nil)
+	sess := newTestSession(config.ModePop3s, true)
+	sess.SetUsername("alice+Work@example.com")
+	cmd := &passCommand{
+		smClient: newTestSMClient(t, failingSessionSvc(), &mockMailboxService{}),
+		auth:     AuthConfig{Subaddress: Subaddressing{Separators: "+"}},
+	}
+	resp, err := cmd.Execute(context.Background(), sess, newMockConnection(), []string{"wrong"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	throttleAuth(context.Background(), conn, sess, throttle, resp)
+
+	if _, ok := throttle.users["alice@example.com"]; !ok || len(throttle.users) != 1 {
+		t.Errorf("failures counted for %v, want alice@example.com", throttle.users)
+	}
+
+	// A failure without a login attempt is not pinned on the last user.
+	throttleAuth(context.Background(), conn, sess, throttle, authFailure(ErrAuthFailed))
+	if n := throttle.users["alice@example.com"].n; n != 1 {
+		t.Errorf("alice@example.com failures = %d, want 1", n)
+	}
+}
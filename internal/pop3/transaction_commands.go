@@ -1,13 +1,11 @@
 package pop3
 
 import (
-	"bufio"
 	"context"
 	"errors"
 	"fmt"
 	"io"
 	"strconv"
-	"strings"
 )
 
 // statCommand implements the STAT command (RFC 1939).
@@ -121,7 +119,7 @@ func (r *retrCommand) Execute(ctx context.Context, sess *Session, conn Connectio
 		return Response{OK: false, Message: "Message store not available"}, nil
 	}
 
-	// Retrieve message content
+	// Retrieve message content; the handler streams it to the client
 	reader, err := store.Retrieve(ctx, sess.Mailbox(), msg.UID)
 	if err != nil {
 		conn.Logger().Error("failed to retrieve message content",
@@ -131,28 +129,13 @@ func (r *retrCommand) Execute(ctx context.Context, sess *Session, conn Connectio
 		)
 		return Response{OK: false, Message: "Failed to retrieve message"}, nil
 	}
-	defer func() {
-		_ = reader.Close()
-	}()
-
-	// Read all content and convert to lines
-	content, err := io.ReadAll(reader)
-	if err != nil {
-		conn.Logger().Error("failed to read message content",
-			"msgNum", msgNum,
-			"uid", msg.UID,
-			"error", err.Error(),
-		)
-		return Response{OK: false, Message: "Failed to read message"}, nil
-	}
-
-	// Split content into lines (preserving original line endings as much as possible)
-	lines := splitMessageLines(string(content))
 
+	// The EXPIRE clock starts only once the client has the whole message
 	return Response{
 		OK:      true,
 		Message: fmt.Sprintf("%d octets", msg.Size),
-		Lines:   lines,
+		Body:    reader,
+		Sent:    func() { sess.MarkRetrieved(msg.UID) },
 	}, nil
 }
 
@@ -188,6 +171,9 @@ func (d *deleCommand) Execute(ctx context.Context, sess *Session, conn Connectio
 		if errors.Is(err, ErrMessageDeleted) {
 			return Response{OK: false, Message: "Message already deleted"}, nil
 		}
+		if errors.Is(err, ErrFolderReadOnly) {
+			return Response{OK: false, Message: "Messages in folders cannot be deleted"}, nil
+		}
 		return Response{OK: false, Message: "Failed to delete message"}, nil
 	}
 
@@ -254,7 +240,7 @@ func (u *uidlCommand) Execute(ctx context.Context, sess *Session, conn Connectio
 		messages := sess.AllMessages()
 		lines := make([]string, len(messages))
 		for i, m := range messages {
-			lines[i] = fmt.Sprintf("%d %d", m.MsgNum, m.Info.UID)
+			lines[i] = fmt.Sprintf("%d %s", m.MsgNum, sess.UIDL(m.Info))
 		}
 		return Response{
 			OK:      true,
@@ -281,7 +267,7 @@ func (u *uidlCommand) Execute(ctx context.Context, sess *Session, conn Connectio
 		return Response{OK: false, Message: "Failed to retrieve message"}, nil
 	}
 
-	return Response{OK: true, Message: fmt.Sprintf("%d %d", msgNum, msg.UID)}, nil
+	return Response{OK: true, Message: fmt.Sprintf("%d %s", msgNum, sess.UIDL(*msg))}, nil
 }
 
 // topCommand implements the TOP command (RFC 2449).
@@ -335,74 +321,74 @@ func (t *topCommand) Execute(ctx context.Context, sess *Session, conn Connection
 		)
 		return Response{OK: false, Message: "Failed to retrieve message"}, nil
 	}
-	lines, err := extractTopLines(reader, lineCount)
-	_ = reader.Close()
-	if err != nil {
-		conn.Logger().Error("failed to parse message",
-			"msgNum", msgNum,
-			"uid", msg.UID,
-			"error", err.Error(),
-		)
-		return Response{OK: false, Message: "Failed to read message"}, nil
-	}
 
 	return Response{
 		OK:      true,
 		Message: "",
-		Lines:   lines,
+		Body:    newTopReader(reader, lineCount),
 	}, nil
 }
 
-// splitMessageLines splits message content into lines for POP3 response.
-// Handles both LF and CRLF line endings.
-func splitMessageLines(content string) []string {
-	// Normalize line endings
-	content = strings.ReplaceAll(content, "\r\n", "\n")
-	content = strings.ReplaceAll(content, "\r", "\n")
-
-	// Split on newlines
-	rawLines := strings.Split(content, "\n")
-
-	// Remove trailing empty line if present (from trailing newline)
-	if len(rawLines) > 0 && rawLines[len(rawLines)-1] == "" {
-		rawLines = rawLines[:len(rawLines)-1]
-	}
+// topReader passes through the headers of a message and at most n lines of
+// its body, then reports io.EOF. Lines end as dotStuffWriter ends them, at
+// LF, CRLF or a bare CR, so that the lines counted are the lines sent.
+// Closing it closes the underlying reader, which for session-manager fetches
+// cancels the remaining stream.
+type topReader struct {
+	rc        io.ReadCloser
+	remaining int  // body lines still to send
+	inBody    bool // header/body separator has been seen
+	lineLen   int  // bytes of the current line so far
+	pendingCR bool // the last byte was a CR that may start a CRLF
+	done      bool
+}
 
-	return rawLines
+// newTopReader returns a topReader over rc that yields n body lines.
+func newTopReader(rc io.ReadCloser, n int) *topReader {
+	return &topReader{rc: rc, remaining: n}
 }
 
-// extractTopLines extracts headers and n lines of body from a message.
-func extractTopLines(reader io.Reader, bodyLines int) ([]string, error) {
-	scanner := bufio.NewScanner(reader)
-	var lines []string
-	inBody := false
-	bodyCount := 0
-
-	for scanner.Scan() {
-		line := scanner.Text()
-
-		if !inBody {
-			// We're in headers
-			lines = append(lines, line)
-			if line == "" {
-				// Empty line signals end of headers
-				inBody = true
-			}
-		} else {
-			// We're in body
-			if bodyCount >= bodyLines {
-				break
+func (t *topReader) Read(p []byte) (int, error) {
+	if t.done {
+		return 0, io.EOF
+	}
+	n, err := t.rc.Read(p)
+	for i, b := range p[:n] {
+		// A CR not followed by LF ends its line before b
+		if t.pendingCR && b != '\n' && t.endLine() {
+			return i, io.EOF
+		}
+		switch b {
+		case '\r':
+			t.pendingCR = true
+		case '\n':
+			if t.endLine() {
+				return i + 1, io.EOF
 			}
-			lines = append(lines, line)
-			bodyCount++
+		default:
+			t.lineLen++
 		}
 	}
+	return n, err
+}
 
-	if err := scanner.Err(); err != nil {
-		return nil, err
-	}
+// endLine counts the end of a line and reports whether the last line to
+// send has ended.
+func (t *topReader) endLine() bool {
+	if t.inBody {
+		t.remaining--
+	} else if t.lineLen == 0 {
+		t.inBody = true
+	}
+	t.lineLen = 0
+	t.pendingCR = false
+	t.done = t.inBody && t.remaining <= 0
+	return t.done
+}
 
-	return lines, nil
+// Close closes the underlying reader.
+func (t *topReader) Close() error {
+	return t.rc.Close()
 }
 
 // RegisterTransactionCommands registers all transaction-related commands.
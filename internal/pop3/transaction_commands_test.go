@@ -1,10 +1,12 @@
 package pop3
 
 import (
+	"bytes"
 	"context"
 	"io"
 	"strings"
 	"testing"
+	"testing/iotest"
 
 	"github.com/infodancer/msgstore"
 	"github.com/infodancer/pop3d/internal/config"
@@ -217,7 +219,7 @@ func TestRetrCommand(t *testing.T) {
 		args        []string
 		wantOK      bool
 		wantMessage string
-		wantLines   bool
+		wantBody    bool
 	}{
 		{
 			name:        "RETR in AUTHORIZATION state fails",
@@ -239,7 +241,7 @@ func TestRetrCommand(t *testing.T) {
 			args:        []string{"1"},
 			wantOK:      true,
 			wantMessage: "100 octets",
-			wantLines:   true,
+			wantBody:    true,
 		},
 		{
 			name:        "RETR invalid message fails",
@@ -267,8 +269,8 @@ func TestRetrCommand(t *testing.T) {
 				t.Errorf("Execute() Message = %q, want %q", resp.Message, tt.wantMessage)
 			}
 
-			if tt.wantLines && len(resp.Lines) == 0 {
-				t.Error("Execute() expected Lines, got none")
+			if tt.wantBody && resp.Body == nil {
+				t.Error("Execute() expected Body, got none")
 			}
 		})
 	}
@@ -634,8 +636,11 @@ func TestTopCommand(t *testing.T) {
 				t.Errorf("Execute() Message = %q, want %q", resp.Message, tt.wantMessage)
 			}
 
-			if tt.wantLines > 0 && len(resp.Lines) != tt.wantLines {
-				t.Errorf("Execute() Lines count = %d, want %d (lines: %v)", len(resp.Lines), tt.wantLines, resp.Lines)
+			if tt.wantLines > 0 {
+				lines := bodyLines(t, resp)
+				if len(lines) != tt.wantLines {
+					t.Errorf("Execute() body line count = %d, want %d (lines: %v)", len(lines), tt.wantLines, lines)
+				}
 			}
 		})
 	}
@@ -711,50 +716,177 @@ func TestTransactionCommandRegistry(t *testing.T) {
 	}
 }
 
-func TestSplitMessageLines(t *testing.T) {
+// bodyLines renders a streamed response body and returns its lines,
+// still dot-stuffed, without the terminating ".".
+func bodyLines(t *testing.T, resp Response) []string {
+	t.Helper()
+	if resp.Body == nil {
+		t.Fatal("response has no Body")
+	}
+	var buf bytes.Buffer
+	if _, err := resp.WriteTo(&buf); err != nil {
+		t.Fatalf("WriteTo: %v", err)
+	}
+	lines := strings.Split(buf.String(), "\r\n")
+	// Drop the status line, the "." terminator and the empty tail after it.
+	return lines[1 : len(lines)-2]
+}
+
+func TestDotStuffWriter(t *testing.T) {
+	tests := []struct {
+		name   string
+		chunks []string
+		want   string
+	}{
+		{
+			name:   "CRLF line endings",
+			chunks: []string{"line1\r\nline2\r\nline3\r\n"},
+			want:   "line1\r\nline2\r\nline3\r\n.\r\n",
+		},
+		{
+			name:   "LF line endings",
+			chunks: []string{"line1\nline2\nline3\n"},
+			want:   "line1\r\nline2\r\nline3\r\n.\r\n",
+		},
+		{
+			name:   "Mixed and bare CR line endings",
+			chunks: []string{"line1\r\nline2\nline3\rline4\r\n"},
+			want:   "line1\r\nline2\r\nline3\r\nline4\r\n.\r\n",
+		},
+		{
+			name:   "No trailing newline",
+			chunks: []string{"line1\r\nline2"},
+			want:   "line1\r\nline2\r\n.\r\n",
+		},
+		{
+			name:   "Empty content",
+			chunks: nil,
+			want:   ".\r\n",
+		},
+		{
+			name:   "Leading dots are stuffed",
+			chunks: []string{".hidden\nnormal\n..double\n.\nmid.dle\n"},
+			want:   "..hidden\r\nnormal\r\n...double\r\n..\r\nmid.dle\r\n.\r\n",
+		},
+		{
+			name:   "CRLF split across writes",
+			chunks: []string{"line1\r", "\nline2\r", "\n"},
+			want:   "line1\r\nline2\r\n.\r\n",
+		},
+		{
+			name:   "Dot at start of a later write",
+			chunks: []string{"line1\n", ".line2\n"},
+			want:   "line1\r\n..line2\r\n.\r\n",
+		},
+		{
+			name:   "Bare CR at end of a write",
+			chunks: []string{"line1\r", ".line2"},
+			want:   "line1\r\n..line2\r\n.\r\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w := newDotStuffWriter(&buf)
+			for _, c := range tt.chunks {
+				n, err := w.Write([]byte(c))
+				if err != nil {
+					t.Fatalf("Write(%q) error = %v", c, err)
+				}
+				if n != len(c) {
+					t.Errorf("Write(%q) = %d, want %d", c, n, len(c))
+				}
+			}
+			if err := w.Close(); err != nil {
+				t.Fatalf("Close() error = %v", err)
+			}
+			if got := buf.String(); got != tt.want {
+				t.Errorf("output = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// closeTracker records whether Close was called on the wrapped reader.
+type closeTracker struct {
+	io.Reader
+	closed bool
+}
+
+func (c *closeTracker) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestTopReader(t *testing.T) {
 	tests := []struct {
 		name    string
 		content string
-		want    []string
+		n       int
+		want    string
 	}{
 		{
-			name:    "CRLF line endings",
-			content: "line1\r\nline2\r\nline3\r\n",
-			want:    []string{"line1", "line2", "line3"},
+			name:    "headers only",
+			content: "Subject: a\r\nFrom: b\r\n\r\nbody1\r\nbody2\r\n",
+			n:       0,
+			want:    "Subject: a\r\nFrom: b\r\n\r\n",
 		},
 		{
-			name:    "LF line endings",
-			content: "line1\nline2\nline3\n",
-			want:    []string{"line1", "line2", "line3"},
+			name:    "some body lines",
+			content: "Subject: a\n\nbody1\nbody2\nbody3\n",
+			n:       2,
+			want:    "Subject: a\n\nbody1\nbody2\n",
 		},
 		{
-			name:    "Mixed line endings",
-			content: "line1\r\nline2\nline3\r\n",
-			want:    []string{"line1", "line2", "line3"},
+			name:    "more lines requested than present",
+			content: "Subject: a\r\n\r\nbody1",
+			n:       10,
+			want:    "Subject: a\r\n\r\nbody1",
 		},
 		{
-			name:    "No trailing newline",
-			content: "line1\r\nline2",
-			want:    []string{"line1", "line2"},
+			name:    "no header separator",
+			content: "Subject: a\r\nFrom: b\r\n",
+			n:       0,
+			want:    "Subject: a\r\nFrom: b\r\n",
 		},
 		{
-			name:    "Empty content",
-			content: "",
-			want:    []string{},
+			name:    "bare CR ends a line",
+			content: "Subject: a\r\rbody1\rbody2\rbody3\r",
+			n:       2,
+			want:    "Subject: a\r\rbody1\rbody2\r",
+		},
+		{
+			name:    "mixed line endings",
+			content: "Subject: a\n\r\nbody1\rbody2\r\nbody3\n",
+			n:       2,
+			want:    "Subject: a\n\r\nbody1\rbody2\r\n",
+		},
+		{
+			name:    "long body line counts once",
+			content: "Subject: a\n\n" + strings.Repeat("x", 10000) + "\nbody2\n",
+			n:       1,
+			want:    "Subject: a\n\n" + strings.Repeat("x", 10000) + "\n",
 		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got := splitMessageLines(tt.content)
-			if len(got) != len(tt.want) {
-				t.Errorf("splitMessageLines() = %v (len %d), want %v (len %d)", got, len(got), tt.want, len(tt.want))
-				return
-			}
-			for i := range got {
-				if got[i] != tt.want[i] {
-					t.Errorf("splitMessageLines()[%d] = %q, want %q", i, got[i], tt.want[i])
-				}
+			// One byte at a time, so line endings are split across reads
+			src := &closeTracker{Reader: iotest.OneByteReader(strings.NewReader(tt.content))}
+			r := newTopReader(src, tt.n)
+			got, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatalf("ReadAll() error = %v", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("topReader = %q, want %q", got, tt.want)
+			}
+			if err := r.Close(); err != nil {
+				t.Fatalf("Close() error = %v", err)
+			}
+			if !src.closed {
+				t.Error("Close() did not close the underlying reader")
 			}
 		})
 	}
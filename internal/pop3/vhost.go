@@ -0,0 +1,127 @@
+package pop3
+
+import (
+	"strings"
+
+	"github.com/infodancer/pop3d/internal/config"
+)
+
+// VirtualHost is a customer domain served from shared listeners. Sessions
+// are assigned to one by the name the client asks for in TLS (SNI).
+type VirtualHost struct {
+	// Name is the domain the virtual host is configured under.
+	Name string
+
+	// Hostname is used in the greeting; empty uses the server hostname.
+	Hostname string
+
+	// LoginDomain is appended to usernames given without a domain.
+	LoginDomain string
+
+	// Mechanisms limits the SASL mechanisms offered; empty offers all.
+	Mechanisms []string
+
+	// RestrictLogins refuses users of other domains.
+	RestrictLogins bool
+}
+
+// VirtualHosts looks up the virtual host for a TLS server name.
+type VirtualHosts struct {
+	hosts map[string]*VirtualHost
+}
+
+// NewVirtualHosts builds the virtual hosts from configuration. It returns
+// nil if none are configured.
+func NewVirtualHosts(domains map[string]config.DomainConfig) *VirtualHosts {
+	if len(domains) == 0 {
+		return nil
+	}
+	v := &VirtualHosts{hosts: make(map[string]*VirtualHost, len(domains))}
+	for name, d := range domains {
+		mechs := make([]string, len(d.Mechanisms))
+		for i, m := range d.Mechanisms {
+			mechs[i] = strings.ToUpper(m)
+		}
+		v.hosts[strings.ToLower(name)] = &VirtualHost{
+			Name:           name,
+			Hostname:       d.Hostname,
+			LoginDomain:    d.LoginDomain,
+			Mechanisms:     mechs,
+			RestrictLogins: d.RestrictLogins,
+		}
+	}
+	return v
+}
+
+// Lookup returns the virtual host for serverName: the one configured under
+// that name or one of its parent domains, so that pop.example.com belongs to
+// example.com, or else the one whose greeting hostname it is. It returns nil
+// if there is none.
+func (v *VirtualHosts) Lookup(serverName string) *VirtualHost {
+	if v == nil || serverName == "" {
+		return nil
+	}
+	name := strings.ToLower(strings.TrimSuffix(serverName, "."))
+	for d := name; d != ""; {
+		if vh, ok := v.hosts[d]; ok {
+			return vh
+		}
+		_, parent, ok := strings.Cut(d, ".")
+		if !ok {
+			break
+		}
+		d = parent
+	}
+	for _, vh := range v.hosts {
+		if strings.EqualFold(vh.Hostname, name) {
+			return vh
+		}
+	}
+	return nil
+}
+
+// Greeting returns the hostname for the greeting, falling back to hostname.
+func (vh *VirtualHost) Greeting(hostname string) string {
+	if vh == nil || vh.Hostname == "" {
+		return hostname
+	}
+	return vh.Hostname
+}
+
+// Qualify appends the login domain to a username without one.
+func (vh *VirtualHost) Qualify(username string) string {
+	if vh == nil || vh.LoginDomain == "" || strings.Contains(username, "@") {
+		return username
+	}
+	return username + "@" + vh.LoginDomain
+}
+
+// Permits reports whether username may log in through the virtual host.
+func (vh *VirtualHost) Permits(username string) bool {
+	if vh == nil || !vh.RestrictLogins {
+		return true
+	}
+	at := strings.LastIndex(username, "@")
+	return at >= 0 && strings.EqualFold(username[at+1:], vh.Name)
+}
+
+// AllowsMechanism reports whether the SASL mechanism may be used.
+func (vh *VirtualHost) AllowsMechanism(mech string) bool {
+	if vh == nil || len(vh.Mechanisms) == 0 {
+		return true
+	}
+	for _, m := range vh.Mechanisms {
+		if strings.EqualFold(m, mech) {
+			return true
+		}
+	}
+	return false
+}
+
+// LogName returns the virtual host's name for logs and metric labels.
+func (vh *VirtualHost) LogName() string {
+	if vh == nil {
+		return "default"
+	}
+	return vh.Name
+}
@@ -0,0 +1,144 @@
+package pop3
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/emersion/go-sasl"
+	"github.com/infodancer/pop3d/internal/config"
+	smpb "github.com/infodancer/session-manager/proto/sessionmanager/v1"
+)
+
+func TestVirtualHostsLookup(t *testing.T) {
+	vhosts := NewVirtualHosts(map[string]config.DomainConfig{
+		"example.com": {},
+		"example.org": {Hostname: "mail.customer.net"},
+	})
+
+	tests := []struct {
+		serverName string
+		want       string
+	}{
+		{"example.com", "example.com"},
+		{"pop.example.com", "example.com"},
+		{"POP.Example.COM.", "example.com"},
+		{"mail.customer.net", "example.org"},
+		{"example.net", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		vh := vhosts.Lookup(tt.serverName)
+		got := ""
+		if vh != nil {
+			got = vh.Name
+		}
+		if got != tt.want {
+			t.Errorf("Lookup(%q) = %q, want %q", tt.serverName, got, tt.want)
+		}
+	}
+
+	if NewVirtualHosts(nil).Lookup("example.com") != nil {
+		t.Error("Lookup without virtual hosts should return nil")
+	}
+}
+
+func TestVirtualHostLogin(t *testing.T) {
+	vh := &VirtualHost{Name: "example.com", LoginDomain: "example.com", RestrictLogins: true}
+
+	if got := vh.Qualify("alice"); got != "alice@example.com" {
+		t.Errorf("Qualify(alice) = %q", got)
+	}
+	if got := vh.Qualify("bob@example.net"); got != "bob@example.net" {
+		t.Errorf("Qualify(bob@example.net) = %q", got)
+	}
+	if !vh.Permits("alice@Example.com") {
+		t.Error("user of the virtual host's domain should be permitted")
+	}
+	if vh.Permits("bob@example.net") || vh.Permits("carol") {
+		t.Error("users of other domains should be refused")
+	}
+
+	// The default host changes nothing.
+	var none *VirtualHost
+	if none.Qualify("alice") != "alice" || !none.Permits("bob@example.net") || none.Greeting("mail.example.com") != "mail.example.com" {
+		t.Error("nil virtual host should leave logins and greeting unchanged")
+	}
+}
+
+func TestVirtualHostMechanisms(t *testing.T) {
+	vh := NewVirtualHosts(map[string]config.DomainConfig{
+		"example.com": {Mechanisms: []string{"login"}},
+	}).Lookup("example.com")
+
+	sess := NewSession("test.example.com", config.ModePop3s, nil, true)
+	sess.SetSASLMechanisms([]string{sasl.Plain, sasl.Login})
+	sess.SetVirtualHost(vh)
+
+	for _, c := range sess.Capabilities() {
+		if c == "SASL "+sasl.Login {
+			return
+		}
+		if len(c) > 5 && c[:5] == "SASL " {
+			t.Fatalf("capability %q, want only %s", c, sasl.Login)
+		}
+	}
+	t.Error("SASL capability missing")
+}
+
+func TestVirtualHostAppliesToEveryMechanism(t *testing.T) {
+	vh := &VirtualHost{Name: "example.com", LoginDomain: "example.com", RestrictLogins: true}
+
+	var logins []string
+	svc := &mockSessionService{
+		loginFunc: func(ctx context.Context, req *smpb.LoginRequest) (*smpb.LoginResponse, error) {
+			logins = append(logins, req.Username)
+			return &smpb.LoginResponse{SessionToken: "tok", Mailbox: req.Username}, nil
+		},
+	}
+	smClient := newTestSMClient(t, svc, &mockMailboxService{})
+
+	tests := []struct {
+		name  string
+		login func(sess *Session, user string) Response
+	}{
+		{"PASS", func(sess *Session, user string) Response {
+			sess.SetUsername(user)
+			resp, _ := (&passCommand{smClient: smClient}).Execute(context.Background(), sess, newMockConnection(), []string{"secret"})
+			return resp
+		}},
+		{"PLAIN", func(sess *Session, user string) Response {
+			ir := EncodeSASLChallenge([]byte("\x00" + user + "\x00secret"))
+			resp, _ := (&authCommand{smClient: smClient}).Execute(context.Background(), sess, newMockConnection(), []string{sasl.Plain, ir})
+			return resp
+		}},
+		{"LOGIN", func(sess *Session, user string) Response {
+			cmd := &authCommand{smClient: smClient, auth: AuthConfig{Login: true}}
+			sess.SetSASLMechanisms(cmd.auth.Mechanisms())
+			conn := newMockConnection()
+			_, _ = cmd.Execute(context.Background(), sess, conn, []string{sasl.Login, EncodeSASLChallenge([]byte(user))})
+			resp, _ := cmd.ProcessSASLResponse(context.Background(), sess, conn, EncodeSASLChallenge([]byte("secret")))
+			return resp
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logins = nil
+
+			sess := newTestSession(config.ModePop3s, true)
+			sess.SetVirtualHost(vh)
+			if resp := tt.login(sess, "alice"); !resp.OK || sess.Username() != "alice@example.com" {
+				t.Errorf("bare login = %+v as %q, want alice@example.com", resp, sess.Username())
+			}
+
+			sess = newTestSession(config.ModePop3s, true)
+			sess.SetVirtualHost(vh)
+			if resp := tt.login(sess, "bob@example.net"); resp.OK {
+				t.Error("login for another domain accepted")
+			}
+			if !slices.Equal(logins, []string{"alice@example.com"}) {
+				t.Errorf("session-manager logins = %q, want only alice@example.com", logins)
+			}
+		})
+	}
+}
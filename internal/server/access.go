@@ -0,0 +1,36 @@
+package server
+
+import (
+	"net/netip"
+
+	"github.com/infodancer/pop3d/internal/config"
+)
+
+// AccessList is an ordered list of allow and deny rules for client
+// addresses. The first rule that matches decides; an address no rule
+// matches is allowed.
+type AccessList []config.AccessRule
+
+// NewAccessList parses the rule lists and joins them in order, so that
+// server-wide rules can be checked before a listener's own.
+func NewAccessList(lists ...[]string) (AccessList, error) {
+	var acl AccessList
+	for _, rules := range lists {
+		parsed, err := config.ParseAccessRules(rules)
+		if err != nil {
+			return nil, err
+		}
+		acl = append(acl, parsed...)
+	}
+	return acl, nil
+}
+
+// Check reports whether ip is allowed and, if a rule decided, which one.
+func (a AccessList) Check(ip netip.Addr) (allowed bool, rule string) {
+	for _, r := range a {
+		if r.Matches(ip) {
+			return r.Allow, r.String()
+		}
+	}
+	return true, ""
+}
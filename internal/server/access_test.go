@@ -0,0 +1,46 @@
+package server
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestAccessList(t *testing.T) {
+	// Server-wide rules come first, so a listener cannot allow a range
+	// they deny.
+	acl, err := NewAccessList(
+		[]string{"deny 10.6.6.0/24"},
+		[]string{"allow 10.0.0.0/8", "allow 2001:db8::/32", "deny all"},
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		ip      string
+		allowed bool
+		rule    string
+	}{
+		{"10.1.2.3", true, "allow 10.0.0.0/8"},
+		{"10.6.6.6", false, "deny 10.6.6.0/24"},
+		{"2001:db8::1", true, "allow 2001:db8::/32"},
+		{"192.0.2.1", false, "deny all"},
+	}
+	for _, tt := range tests {
+		allowed, rule := acl.Check(netip.MustParseAddr(tt.ip))
+		if allowed != tt.allowed || rule != tt.rule {
+			t.Errorf("Check(%s) = %v, %q; want %v, %q", tt.ip, allowed, rule, tt.allowed, tt.rule)
+		}
+	}
+
+	var empty AccessList
+	if allowed, rule := empty.Check(netip.MustParseAddr("192.0.2.1")); !allowed || rule != "" {
+		t.Errorf("empty list Check() = %v, %q; want allowed by no rule", allowed, rule)
+	}
+}
+
+func TestNewAccessListRejectsInvalidRule(t *testing.T) {
+	if _, err := NewAccessList([]string{"allow 10.0.0.0/8"}, []string{"deny"}); err == nil {
+		t.Error("NewAccessList should reject a rule without a CIDR")
+	}
+}
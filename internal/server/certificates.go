@@ -0,0 +1,69 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"sync/atomic"
+)
+
+// CertificateStore holds the server certificates so that they can be
+// replaced while the server runs, e.g. after renewal. A tls.Config picks up
+// the current certificates through GetCertificate on every handshake.
+type CertificateStore struct {
+	certs atomic.Pointer[[]tls.Certificate]
+}
+
+// NewCertificateStore creates a store holding certs. The first certificate
+// is the default.
+func NewCertificateStore(certs []tls.Certificate) (*CertificateStore, error) {
+	parsed, err := ParseCertificates(certs)
+	if err != nil {
+		return nil, err
+	}
+	s := &CertificateStore{}
+	s.Set(parsed)
+	return s, nil
+}
+
+// ParseCertificates checks that there is at least one certificate and parses
+// the leaf of each, returning a copy ready for Set.
+func ParseCertificates(certs []tls.Certificate) ([]tls.Certificate, error) {
+	if len(certs) == 0 {
+		return nil, errors.New("no certificates")
+	}
+	certs = append([]tls.Certificate(nil), certs...)
+	for i := range certs {
+		if certs[i].Leaf != nil {
+			continue
+		}
+		leaf, err := x509.ParseCertificate(certs[i].Certificate[0])
+		if err != nil {
+			return nil, err
+		}
+		certs[i].Leaf = leaf
+	}
+	return certs, nil
+}
+
+// Set replaces the certificates with ones returned by ParseCertificates, so
+// that a reload can validate them first and then swap them in without
+// failing. Handshakes already under way keep the old ones.
+func (s *CertificateStore) Set(certs []tls.Certificate) {
+	s.certs.Store(&certs)
+}
+
+// GetCertificate returns the first certificate valid for the server name the
+// client asked for (SNI), or the default certificate if none is, for
+// tls.Config.GetCertificate.
+func (s *CertificateStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	certs := *s.certs.Load()
+	if hello.ServerName != "" {
+		for i := range certs {
+			if certs[i].Leaf.VerifyHostname(hello.ServerName) == nil {
+				return &certs[i], nil
+			}
+		}
+	}
+	return &certs[0], nil
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// newNamedCertificate creates a self-signed certificate for the given names.
+// The leaf is left unparsed, as tls.X509KeyPair may leave it.
+func newNamedCertificate(t *testing.T, names ...string) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestCertificateStoreSelectsByServerName(t *testing.T) {
+	store, err := NewCertificateStore([]tls.Certificate{
+		newNamedCertificate(t, "mail.example.net"),
+		newNamedCertificate(t, "pop.example.com"),
+		newNamedCertificate(t, "*.example.org"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		serverName string
+		want       string
+	}{
+		{"pop.example.com", "pop.example.com"},
+		{"pop3.example.org", "*.example.org"},
+		{"mail.example.net", "mail.example.net"},
+		{"unknown.example", "mail.example.net"}, // default
+		{"", "mail.example.net"},
+	}
+	for _, tt := range tests {
+		cert, err := store.GetCertificate(&tls.ClientHelloInfo{ServerName: tt.serverName})
+		if err != nil {
+			t.Fatalf("GetCertificate(%q): %v", tt.serverName, err)
+		}
+		if got := cert.Leaf.Subject.CommonName; got != tt.want {
+			t.Errorf("GetCertificate(%q) = %s, want %s", tt.serverName, got, tt.want)
+		}
+	}
+}
+
+func TestCertificateStoreSet(t *testing.T) {
+	store, err := NewCertificateStore([]tls.Certificate{newNamedCertificate(t, "old.example.com")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	certs, err := ParseCertificates([]tls.Certificate{newNamedCertificate(t, "new.example.com")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Set(certs)
+	cert, _ := store.GetCertificate(&tls.ClientHelloInfo{})
+	if got := cert.Leaf.Subject.CommonName; got != "new.example.com" {
+		t.Errorf("certificate after Set = %s, want new.example.com", got)
+	}
+}
+
+func TestParseCertificates(t *testing.T) {
+	if _, err := ParseCertificates(nil); err == nil {
+		t.Error("ParseCertificates(nil) should fail")
+	}
+	bad := tls.Certificate{Certificate: [][]byte{[]byte("not DER")}}
+	if _, err := ParseCertificates([]tls.Certificate{newNamedCertificate(t, "ok.example.com"), bad}); err == nil {
+		t.Error("ParseCertificates with an unparsable leaf should fail")
+	}
+}
@@ -2,8 +2,8 @@ package server
 
 import (
 	"bufio"
-	"context"
 	"crypto/tls"
+	"errors"
 	"io"
 	"log/slog"
 	"net"
@@ -11,6 +11,15 @@ import (
 	"time"
 
 	"github.com/infodancer/logging"
+	"github.com/infodancer/pop3d/internal/config"
+)
+
+// Timeouts that end a connection, as reported by Connection.TimedOut.
+const (
+	TimeoutPreAuth = "pre_auth"
+	TimeoutIdle    = "idle"
+	TimeoutWrite   = "write"
+	TimeoutSession = "session"
 )
 
 // Connection wraps a net.Conn with timeout management and optional transaction logging.
@@ -19,21 +28,50 @@ type Connection struct {
 	reader         *bufio.Reader
 	writer         *bufio.Writer
 	logger         *slog.Logger
+	tlsConfig      *tls.Config
+	listenerCfg    config.ListenerConfig
+	preAuthTimeout time.Duration
 	idleTimeout    time.Duration
-	commandTimeout time.Duration
+	writeTimeout   time.Duration
+	sessionEnd     time.Time // zero if the session lifetime is unlimited
+	maxAuthLine    int
+	maxBadCommands int
 	logTx          bool
 
-	mu           sync.Mutex
-	lastActivity time.Time
-	closed       bool
+	mu         sync.Mutex
+	closed     bool
+	draining   bool
+	readLimit  string // the timeout the current read deadline enforces
+	writeLimit string // the timeout the current write deadline enforces
+	timedOut   string // the timeout that ended the connection, if any
 }
 
 // ConnectionConfig holds configuration for a new connection.
 type ConnectionConfig struct {
+	// TLSConfig is the listener's TLS configuration, used for STLS.
+	TLSConfig *tls.Config
+
+	// PreAuthTimeout is how long to wait for each command before the client
+	// has logged in, IdleTimeout how long after. WriteTimeout bounds each
+	// write to the client and SessionTimeout the whole session. Zero means
+	// no limit.
+	PreAuthTimeout time.Duration
 	IdleTimeout    time.Duration
-	CommandTimeout time.Duration
+	WriteTimeout   time.Duration
+	SessionTimeout time.Duration
+
+	// MaxAuthLine bounds the AUTH command lines and SASL responses a
+	// session reads; zero means config.DefaultMaxAuthLine. MaxBadCommands
+	// is how many bad command lines end a session; zero means no limit.
+	MaxAuthLine    int
+	MaxBadCommands int
+
 	LogTransaction bool
 	Logger         *slog.Logger
+
+	// Listener is the configuration of the listener that accepted the
+	// connection, for its per-listener session settings.
+	Listener config.ListenerConfig
 }
 
 // NewConnection creates a new Connection wrapper.
@@ -49,32 +87,126 @@ func NewConnection(conn net.Conn, cfg ConnectionConfig) *Connection {
 	c := &Connection{
 		conn:           conn,
 		logger:         connLogger,
+		tlsConfig:      cfg.TLSConfig,
+		listenerCfg:    cfg.Listener,
+		preAuthTimeout: cfg.PreAuthTimeout,
 		idleTimeout:    cfg.IdleTimeout,
-		commandTimeout: cfg.CommandTimeout,
+		writeTimeout:   cfg.WriteTimeout,
+		maxAuthLine:    cfg.MaxAuthLine,
+		maxBadCommands: cfg.MaxBadCommands,
 		logTx:          cfg.LogTransaction,
-		lastActivity:   time.Now(),
 	}
+	if c.maxAuthLine <= 0 {
+		c.maxAuthLine = config.DefaultMaxAuthLine
+	}
+	if cfg.SessionTimeout > 0 {
+		c.sessionEnd = time.Now().Add(cfg.SessionTimeout)
+	}
+	c.setupIO(conn, connLogger)
+
+	return c
+}
 
-	// Set up reader/writer with optional transaction logging
-	var r io.Reader = conn
-	var w io.Writer = conn
+// setupIO creates the buffered reader and writer over conn, with optional
+// transaction logging. Every read and write notes which timeout ended it.
+func (c *Connection) setupIO(conn net.Conn, logger *slog.Logger) {
+	var r io.Reader = &timeoutReader{c: c, r: conn}
+	var w io.Writer = &timeoutWriter{c: c, w: conn}
 
-	if cfg.LogTransaction {
-		r = logging.NewTransactionReader(conn, connLogger, "recv")
-		w = logging.NewTransactionWriter(conn, connLogger, "send")
+	if c.logTx {
+		r = logging.NewTransactionReader(r, logger, "recv")
+		w = logging.NewTransactionWriter(w, logger, "send")
 	}
 
 	c.reader = bufio.NewReader(r)
 	c.writer = bufio.NewWriter(w)
+}
 
-	return c
+// timeoutReader records the timeout behind a read that exceeded its deadline.
+type timeoutReader struct {
+	c *Connection
+	r io.Reader
+}
+
+func (t *timeoutReader) Read(p []byte) (int, error) {
+	n, err := t.r.Read(p)
+	if isTimeout(err) {
+		t.c.mu.Lock()
+		// A drain interrupts reads with a deadline too; that is no timeout.
+		if !t.c.draining && t.c.timedOut == "" {
+			t.c.timedOut = t.c.readLimit
+		}
+		t.c.mu.Unlock()
+	}
+	return n, err
+}
+
+// timeoutWriter gives each write to the client the write timeout, and
+// records the timeout behind a write that exceeded it.
+type timeoutWriter struct {
+	c *Connection
+	w io.Writer
+}
+
+func (t *timeoutWriter) Write(p []byte) (int, error) {
+	if err := t.c.setWriteDeadline(); err != nil {
+		return 0, err
+	}
+	n, err := t.w.Write(p)
+	if isTimeout(err) {
+		t.c.mu.Lock()
+		if t.c.timedOut == "" {
+			t.c.timedOut = t.c.writeLimit
+		}
+		t.c.mu.Unlock()
+	}
+	return n, err
+}
+
+// isTimeout reports whether err is a deadline being exceeded.
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// deadline returns the deadline for an operation limited by timeout, and the
+// name of the timeout that decides it: limit, or the session lifetime if
+// that ends first. It returns the zero time if neither applies.
+func (c *Connection) deadline(timeout time.Duration, limit string) (time.Time, string) {
+	var d time.Time
+	if timeout > 0 {
+		d = time.Now().Add(timeout)
+	}
+	if !c.sessionEnd.IsZero() && (d.IsZero() || c.sessionEnd.Before(d)) {
+		return c.sessionEnd, TimeoutSession
+	}
+	return d, limit
+}
+
+// setWriteDeadline sets the deadline for the next write.
+func (c *Connection) setWriteDeadline() error {
+	d, limit := c.deadline(c.writeTimeout, TimeoutWrite)
+	c.mu.Lock()
+	c.writeLimit = limit
+	c.mu.Unlock()
+	return c.conn.SetWriteDeadline(d)
 }
 
 // Logger returns the connection-scoped logger.
 func (c *Connection) Logger() *slog.Logger {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	return c.logger
 }
 
+// AddLogAttrs adds attributes to the connection-scoped logger, e.g. once the
+// virtual host of the session is known.
+func (c *Connection) AddLogAttrs(args ...any) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.logger = c.logger.With(args...)
+}
+
 // RemoteAddr returns the remote address of the connection.
 func (c *Connection) RemoteAddr() net.Addr {
 	return c.conn.RemoteAddr()
@@ -115,25 +247,74 @@ func (c *Connection) SetWriteDeadline(t time.Time) error {
 	return c.conn.SetWriteDeadline(t)
 }
 
-// ResetIdleTimeout resets the idle timeout deadline.
-// Should be called after each successful read/write operation.
-func (c *Connection) ResetIdleTimeout() error {
-	c.mu.Lock()
-	c.lastActivity = time.Now()
-	c.mu.Unlock()
+// SetCommandTimeout sets the deadline for reading the next command: the
+// pre-authentication timeout until the client has logged in, the idle
+// timeout after, and never past the end of the session lifetime. The TLS
+// handshake of an implicit TLS connection is bounded the same way.
+func (c *Connection) SetCommandTimeout(authenticated bool) error {
+	timeout, limit := c.preAuthTimeout, TimeoutPreAuth
+	if authenticated {
+		timeout, limit = c.idleTimeout, TimeoutIdle
+	}
+	d, limit := c.deadline(timeout, limit)
 
-	if c.idleTimeout > 0 {
-		return c.conn.SetDeadline(time.Now().Add(c.idleTimeout))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// Drain interrupts the read with a past deadline, which must stay.
+	if c.draining {
+		return nil
 	}
-	return nil
+	c.readLimit = limit
+	return c.conn.SetReadDeadline(d)
+}
+
+// TimedOut returns the timeout that ended the connection: TimeoutPreAuth,
+// TimeoutIdle, TimeoutWrite or TimeoutSession, or "" if none did.
+func (c *Connection) TimedOut() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.timedOut
 }
 
-// SetCommandTimeout sets a deadline for the next command read.
-func (c *Connection) SetCommandTimeout() error {
-	if c.commandTimeout > 0 {
-		return c.conn.SetReadDeadline(time.Now().Add(c.commandTimeout))
+// ReadLine reads a line of at most limit octets, including the line ending.
+// A longer line is discarded up to its end and ErrLineTooLong returned, so
+// that a client cannot make the server buffer without bound. A line cut
+// short by an error is returned with the error, like bufio.Reader.ReadString.
+func (c *Connection) ReadLine(limit int) (string, error) {
+	var line []byte
+	tooLong := false
+	for {
+		chunk, err := c.reader.ReadSlice('\n')
+		if !tooLong {
+			if len(line)+len(chunk) > limit {
+				tooLong = true
+				line = nil
+			} else {
+				line = append(line, chunk...)
+			}
+		}
+		switch {
+		case errors.Is(err, bufio.ErrBufferFull):
+			continue
+		case err != nil:
+			return string(line), err
+		case tooLong:
+			return "", ErrLineTooLong
+		}
+		return string(line), nil
 	}
-	return nil
+}
+
+// MaxAuthLine returns the longest AUTH command line or SASL response a
+// session may send, including the line ending.
+func (c *Connection) MaxAuthLine() int {
+	return c.maxAuthLine
+}
+
+// MaxBadCommands returns how many bad command lines end a session, or zero
+// for no limit.
+func (c *Connection) MaxBadCommands() int {
+	return c.maxBadCommands
 }
 
 // Close closes the connection.
@@ -150,6 +331,28 @@ func (c *Connection) Close() error {
 	return c.conn.Close()
 }
 
+// Drain asks the session to end once its current command has finished, for a
+// graceful shutdown. A pending command read is interrupted so that an idle
+// session notices at once; the session handler checks Draining before each
+// read and after a failed one.
+func (c *Connection) Drain() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.draining || c.closed {
+		return
+	}
+	c.draining = true
+	_ = c.conn.SetReadDeadline(time.Now())
+}
+
+// Draining returns true once Drain has been called.
+func (c *Connection) Draining() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.draining
+}
+
 // IsClosed returns true if the connection has been closed.
 func (c *Connection) IsClosed() bool {
 	c.mu.Lock()
@@ -169,17 +372,78 @@ func (c *Connection) IsTLS() bool {
 	return ok
 }
 
+// TLSOffloaded returns true if a trusted proxy reported, in its PROXY protocol
+// v2 header, that it terminated TLS for the client.
+func (c *Connection) TLSOffloaded() bool {
+	pc, ok := c.conn.(*proxyConn)
+	return ok && pc.tlsOffloaded
+}
+
+// IsUnix returns true if the connection came in on a Unix-domain socket.
+func (c *Connection) IsUnix() bool {
+	return c.conn.LocalAddr().Network() == "unix"
+}
+
+// PeerCredentials returns the credentials of the process at the other end of
+// a Unix-domain socket, or false if they are not available.
+func (c *Connection) PeerCredentials() (PeerCredentials, bool) {
+	return peerCredentials(c.conn)
+}
+
+// TLSConfig returns the TLS configuration of the listener that accepted the
+// connection, or nil if TLS is not available.
+func (c *Connection) TLSConfig() *tls.Config {
+	return c.tlsConfig
+}
+
+// ListenerConfig returns the configuration of the listener that accepted the
+// connection.
+func (c *Connection) ListenerConfig() config.ListenerConfig {
+	return c.listenerCfg
+}
+
+// TLSConnectionState returns the TLS state of the connection, or false if the
+// connection is not using TLS.
+func (c *Connection) TLSConnectionState() (tls.ConnectionState, bool) {
+	tlsConn, ok := c.conn.(*tls.Conn)
+	if !ok {
+		return tls.ConnectionState{}, false
+	}
+	return tlsConn.ConnectionState(), true
+}
+
+// Handshake runs the TLS handshake of an implicit TLS connection now rather
+// than on the first read or write, so that the server name the client asked
+// for (SNI) is known before the greeting. It does nothing without TLS or once
+// the handshake has completed.
+func (c *Connection) Handshake() error {
+	c.mu.Lock()
+	tlsConn, ok := c.conn.(*tls.Conn)
+	c.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	err := tlsConn.Handshake()
+	if isTimeout(err) {
+		c.mu.Lock()
+		if c.timedOut == "" {
+			c.timedOut = c.readLimit
+		}
+		c.mu.Unlock()
+	}
+	return err
+}
+
 // UpgradeToTLS upgrades the connection to TLS using the provided config.
 // Returns an error if the upgrade fails or if already using TLS.
 func (c *Connection) UpgradeToTLS(tlsConfig *tls.Config) error {
-	c.mu.Lock()
-	defer c.mu.Unlock()
-
 	if c.IsTLS() {
 		return ErrAlreadyTLS
 	}
 
-	// Flush any pending writes before upgrade
+	// Flush any pending writes before upgrade. Neither the flush, whose
+	// writes take c.mu to set their deadline, nor the handshake holds the
+	// lock, so Drain and Close can still interrupt them.
 	if err := c.writer.Flush(); err != nil {
 		return err
 	}
@@ -187,64 +451,25 @@ func (c *Connection) UpgradeToTLS(tlsConfig *tls.Config) error {
 	// Perform TLS handshake
 	tlsConn := tls.Server(c.conn, tlsConfig)
 	if err := tlsConn.Handshake(); err != nil {
+		if isTimeout(err) {
+			c.mu.Lock()
+			if !c.draining && c.timedOut == "" {
+				c.timedOut = c.readLimit
+			}
+			c.mu.Unlock()
+		}
 		return err
 	}
 
-	// Replace the underlying connection
+	// Replace the underlying connection and recreate the reader and
+	// writer over it
+	c.mu.Lock()
 	c.conn = tlsConn
+	c.setupIO(tlsConn, c.logger)
+	logger := c.logger
+	c.mu.Unlock()
 
-	// Recreate reader/writer with the new TLS connection
-	var r io.Reader = tlsConn
-	var w io.Writer = tlsConn
-
-	if c.logTx {
-		r = logging.NewTransactionReader(tlsConn, c.logger, "recv")
-		w = logging.NewTransactionWriter(tlsConn, c.logger, "send")
-	}
-
-	c.reader = bufio.NewReader(r)
-	c.writer = bufio.NewWriter(w)
-
-	c.logger.Info("TLS upgrade completed")
+	logger.Info("TLS upgrade completed")
 
 	return nil
 }
-
-// IdleMonitor runs in a goroutine to monitor for idle connections.
-// It will close the connection if idle timeout is exceeded.
-// The monitor stops when the context is cancelled or the connection is closed.
-func (c *Connection) IdleMonitor(ctx context.Context) {
-	if c.idleTimeout <= 0 {
-		return
-	}
-
-	ticker := time.NewTicker(c.idleTimeout / 2)
-	defer ticker.Stop()
-
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case <-ticker.C:
-			c.mu.Lock()
-			if c.closed {
-				c.mu.Unlock()
-				return
-			}
-			idle := time.Since(c.lastActivity)
-			c.mu.Unlock()
-
-			if idle >= c.idleTimeout {
-				c.logger.Info("closing idle connection",
-					slog.Duration("idle_time", idle),
-				)
-				if err := c.Close(); err != nil {
-					c.logger.Debug("error closing idle connection",
-						slog.String("error", err.Error()),
-					)
-				}
-				return
-			}
-		}
-	}
-}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConnectionTimeouts(t *testing.T) {
+	tests := []struct {
+		name          string
+		cfg           ConnectionConfig
+		authenticated bool
+		write         bool
+		want          string
+	}{
+		{"before login", ConnectionConfig{PreAuthTimeout: 50 * time.Millisecond, IdleTimeout: time.Hour}, false, false, TimeoutPreAuth},
+		{"after login", ConnectionConfig{PreAuthTimeout: time.Hour, IdleTimeout: 50 * time.Millisecond}, true, false, TimeoutIdle},
+		{"session lifetime", ConnectionConfig{IdleTimeout: time.Hour, SessionTimeout: 50 * time.Millisecond}, true, false, TimeoutSession},
+		{"stalled write", ConnectionConfig{WriteTimeout: 50 * time.Millisecond}, false, true, TimeoutWrite},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, cli := net.Pipe()
+			defer cli.Close()
+			c := NewConnection(srv, tt.cfg)
+			defer c.Close()
+
+			if err := c.SetCommandTimeout(tt.authenticated); err != nil {
+				t.Fatal(err)
+			}
+			var err error
+			if tt.write {
+				// The client never reads, so the write stalls.
+				_, _ = c.Writer().WriteString("+OK\r\n")
+				err = c.Flush()
+			} else {
+				_, err = c.Reader().ReadString('\n')
+			}
+			if err == nil {
+				t.Fatal("expected a timeout error")
+			}
+			if got := c.TimedOut(); got != tt.want {
+				t.Errorf("TimedOut() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConnectionDrainIsNoTimeout(t *testing.T) {
+	srv, cli := net.Pipe()
+	defer cli.Close()
+	c := NewConnection(srv, ConnectionConfig{PreAuthTimeout: time.Hour})
+	defer c.Close()
+
+	if err := c.SetCommandTimeout(false); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		c.Drain()
+	}()
+	if _, err := c.Reader().ReadString('\n'); err == nil {
+		t.Fatal("Drain did not interrupt the read")
+	}
+	if got := c.TimedOut(); got != "" {
+		t.Errorf("TimedOut() = %q after a drain, want none", got)
+	}
+}
+
+func TestConnectionReadLine(t *testing.T) {
+	srv, cli := net.Pipe()
+	defer cli.Close()
+	c := NewConnection(srv, ConnectionConfig{PreAuthTimeout: 5 * time.Second})
+	defer c.Close()
+	if err := c.SetCommandTimeout(false); err != nil {
+		t.Fatal(err)
+	}
+
+	fits := strings.Repeat("a", 253) + "\r\n"
+	go func() {
+		// The overlong line is larger than the read buffer.
+		_, _ = io.WriteString(cli, fits+strings.Repeat("x", 10000)+"\r\nNOOP\r\n")
+	}()
+
+	if line, err := c.ReadLine(255); err != nil || line != fits {
+		t.Errorf("line at the limit = %d octets, %v; want it returned", len(line), err)
+	}
+	if _, err := c.ReadLine(255); !errors.Is(err, ErrLineTooLong) {
+		t.Errorf("overlong line: err = %v, want ErrLineTooLong", err)
+	}
+	if line, err := c.ReadLine(255); err != nil || line != "NOOP\r\n" {
+		t.Errorf("line after the overlong one = %q, %v; want NOOP", line, err)
+	}
+}
+
+func TestConnectionUpgradeToTLS(t *testing.T) {
+	srv, cli := net.Pipe()
+	c := NewConnection(srv, ConnectionConfig{WriteTimeout: time.Second})
+	defer c.Close()
+	// Closed first, so that the server's close_notify does not wait for it.
+	defer cli.Close()
+	// Without session tickets the server writes nothing after the
+	// handshake, which net.Pipe would block on.
+	serverCfg := &tls.Config{
+		Certificates:           []tls.Certificate{newNamedCertificate(t, "localhost")},
+		SessionTicketsDisabled: true,
+	}
+
+	// The STLS response is still buffered when the upgrade starts.
+	_, _ = c.Writer().WriteString("+OK Begin TLS negotiation\r\n")
+	errc := make(chan error, 1)
+	go func() { errc <- c.UpgradeToTLS(serverCfg) }()
+
+	_ = cli.SetDeadline(time.Now().Add(5 * time.Second))
+	if line, err := bufio.NewReader(cli).ReadString('\n'); err != nil || line != "+OK Begin TLS negotiation\r\n" {
+		t.Fatalf("response before upgrade = %q, %v", line, err)
+	}
+	tlsCli := tls.Client(cli, &tls.Config{InsecureSkipVerify: true})
+	if err := tlsCli.Handshake(); err != nil {
+		t.Fatalf("client handshake: %v", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("UpgradeToTLS() = %v", err)
+	}
+	if !c.IsTLS() {
+		t.Error("IsTLS() = false after upgrade")
+	}
+}
+
+func TestConnectionCloseInterruptsUpgrade(t *testing.T) {
+	srv, cli := net.Pipe()
+	defer cli.Close()
+	c := NewConnection(srv, ConnectionConfig{})
+	serverCfg := &tls.Config{Certificates: []tls.Certificate{newNamedCertificate(t, "localhost")}}
+
+	// The client never starts the handshake.
+	errc := make(chan error, 1)
+	go func() { errc <- c.UpgradeToTLS(serverCfg) }()
+	time.Sleep(50 * time.Millisecond)
+
+	closed := make(chan struct{})
+	go func() {
+		c.Logger()
+		c.Drain()
+		_ = c.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close blocked on the TLS handshake")
+	}
+	if err := <-errc; err == nil {
+		t.Error("UpgradeToTLS() succeeded on a closed connection")
+	}
+}
@@ -5,4 +5,18 @@ import "errors"
 var (
 	// ErrAlreadyTLS is returned when attempting to upgrade an already-TLS connection.
 	ErrAlreadyTLS = errors.New("connection already using TLS")
+
+	// ErrLineTooLong is returned when a line from the client exceeds the
+	// length allowed; the rest of the line has been discarded.
+	ErrLineTooLong = errors.New("line too long")
+
+	// ErrInvalidProxyHeader is returned when a trusted proxy sends a missing
+	// or malformed PROXY protocol header.
+	ErrInvalidProxyHeader = errors.New("invalid PROXY protocol header")
+
+	// ErrTooManyFromIP, ErrTooManyFromNetwork and ErrConnectionRate are
+	// returned when a connection exceeds a per-address limit.
+	ErrTooManyFromIP      = errors.New("too many connections from address")
+	ErrTooManyFromNetwork = errors.New("too many connections from network")
+	ErrConnectionRate     = errors.New("connection rate exceeded")
 )
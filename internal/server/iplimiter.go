@@ -0,0 +1,184 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/infodancer/pop3d/internal/config"
+)
+
+// IPLimits are the per-address connection limits. Zero values disable a
+// limit.
+type IPLimits struct {
+	// MaxPerIP and MaxPerNetwork cap concurrent connections from one
+	// address and from one /24 (IPv4) or /64 (IPv6) network.
+	MaxPerIP      int
+	MaxPerNetwork int
+
+	// Rate is the number of new connections per second an address may
+	// open, in bursts of up to Burst.
+	Rate  float64
+	Burst int
+
+	// Exempt addresses are not limited.
+	Exempt []netip.Prefix
+}
+
+// NewIPLimits converts the configured limits.
+func NewIPLimits(cfg config.LimitsConfig) (IPLimits, error) {
+	limits := IPLimits{
+		MaxPerIP:      cfg.MaxPerIP,
+		MaxPerNetwork: cfg.MaxPerNetwork,
+		Rate:          float64(cfg.ConnectionRate) / 60,
+		Burst:         cfg.ConnectionBurst,
+	}
+	if limits.Burst == 0 {
+		limits.Burst = cfg.ConnectionRate
+	}
+	for _, cidr := range cfg.Exempt {
+		p, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return IPLimits{}, fmt.Errorf("limits exempt: %w", err)
+		}
+		limits.Exempt = append(limits.Exempt, p.Masked())
+	}
+	return limits, nil
+}
+
+// IPLimiter enforces per-address connection limits, so that one client or
+// network cannot take all of the server's connections.
+type IPLimiter struct {
+	mu        sync.Mutex
+	limits    IPLimits
+	perIP     map[netip.Addr]int
+	perNet    map[netip.Prefix]int
+	buckets   map[netip.Addr]*tokenBucket
+	lastSweep time.Time
+	now       func() time.Time
+}
+
+// tokenBucket holds an address's allowance of new connections.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// NewIPLimiter creates a limiter enforcing limits.
+func NewIPLimiter(limits IPLimits) *IPLimiter {
+	return &IPLimiter{
+		limits:  limits,
+		perIP:   make(map[netip.Addr]int),
+		perNet:  make(map[netip.Prefix]int),
+		buckets: make(map[netip.Addr]*tokenBucket),
+		now:     time.Now,
+	}
+}
+
+// SetLimits replaces the limits. Connections already admitted are kept.
+func (l *IPLimiter) SetLimits(limits IPLimits) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.limits = limits
+}
+
+// Acquire admits a connection from ip, or returns ErrTooManyFromIP,
+// ErrTooManyFromNetwork or ErrConnectionRate. The returned function must be
+// called once the connection has closed.
+func (l *IPLimiter) Acquire(ip netip.Addr) (release func(), err error) {
+	ip = ip.Unmap()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, p := range l.limits.Exempt {
+		if p.Contains(ip) {
+			return func() {}, nil
+		}
+	}
+
+	network := networkOf(ip)
+	if limit := l.limits.MaxPerIP; limit > 0 && l.perIP[ip] >= limit {
+		return nil, ErrTooManyFromIP
+	}
+	if limit := l.limits.MaxPerNetwork; limit > 0 && l.perNet[network] >= limit {
+		return nil, ErrTooManyFromNetwork
+	}
+	if l.limits.Rate > 0 && !l.take(ip) {
+		return nil, ErrConnectionRate
+	}
+
+	l.perIP[ip]++
+	l.perNet[network]++
+	return func() { l.release(ip, network) }, nil
+}
+
+// release ends a connection admitted by Acquire.
+func (l *IPLimiter) release(ip netip.Addr, network netip.Prefix) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.perIP[ip]--; l.perIP[ip] <= 0 {
+		delete(l.perIP, ip)
+	}
+	if l.perNet[network]--; l.perNet[network] <= 0 {
+		delete(l.perNet, network)
+	}
+}
+
+// take removes a token from ip's bucket, refilled at the configured rate,
+// and reports whether there was one. The caller must hold l.mu.
+func (l *IPLimiter) take(ip netip.Addr) bool {
+	now := l.now()
+	burst := float64(max(l.limits.Burst, 1))
+	l.sweep(now, burst)
+
+	b, ok := l.buckets[ip]
+	if !ok {
+		b = &tokenBucket{tokens: burst, last: now}
+		l.buckets[ip] = b
+	}
+	b.tokens = min(burst, b.tokens+now.Sub(b.last).Seconds()*l.limits.Rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// sweep forgets, about once a minute, the buckets that have refilled, so
+// that addresses seen once do not accumulate. The caller must hold l.mu.
+func (l *IPLimiter) sweep(now time.Time, burst float64) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+	for ip, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.limits.Rate >= burst {
+			delete(l.buckets, ip)
+		}
+	}
+}
+
+// networkOf returns the /24 (IPv4) or /64 (IPv6) network of ip.
+func networkOf(ip netip.Addr) netip.Prefix {
+	bits := 64
+	if ip.Is4() {
+		bits = 24
+	}
+	p, _ := ip.Prefix(bits)
+	return p
+}
+
+// remoteIP returns the IP address of a TCP peer, or false for other peers
+// such as those of unix sockets.
+func remoteIP(addr net.Addr) (netip.Addr, bool) {
+	ap, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return ap.Addr().Unmap(), true
+}
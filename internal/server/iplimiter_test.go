@@ -0,0 +1,116 @@
+package server
+
+import (
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/infodancer/pop3d/internal/config"
+)
+
+func TestIPLimiterPerIP(t *testing.T) {
+	l := NewIPLimiter(IPLimits{MaxPerIP: 2})
+	ip := netip.MustParseAddr("192.0.2.1")
+
+	release, err := l.Acquire(ip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Acquire(ip); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := l.Acquire(ip); !errors.Is(err, ErrTooManyFromIP) {
+		t.Fatalf("third connection: err = %v, want ErrTooManyFromIP", err)
+	}
+	if _, err := l.Acquire(netip.MustParseAddr("192.0.2.2")); err != nil {
+		t.Errorf("another address was limited: %v", err)
+	}
+
+	release()
+	if _, err := l.Acquire(ip); err != nil {
+		t.Errorf("after release: %v", err)
+	}
+}
+
+func TestIPLimiterPerNetwork(t *testing.T) {
+	tests := []struct {
+		name         string
+		first, other string
+		sameNetwork  bool
+	}{
+		{"IPv4 same /24", "192.0.2.1", "192.0.2.200", true},
+		{"IPv4 other /24", "192.0.2.1", "192.0.3.1", false},
+		{"IPv6 same /64", "2001:db8::1", "2001:db8::ffff:1", true},
+		{"IPv6 other /64", "2001:db8::1", "2001:db8:0:1::1", false},
+		{"IPv4-mapped", "::ffff:192.0.2.1", "192.0.2.9", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewIPLimiter(IPLimits{MaxPerNetwork: 1})
+			if _, err := l.Acquire(netip.MustParseAddr(tt.first)); err != nil {
+				t.Fatal(err)
+			}
+			_, err := l.Acquire(netip.MustParseAddr(tt.other))
+			if limited := errors.Is(err, ErrTooManyFromNetwork); limited != tt.sameNetwork {
+				t.Errorf("second connection: err = %v, want limited = %v", err, tt.sameNetwork)
+			}
+		})
+	}
+}
+
+func TestIPLimiterRate(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := NewIPLimiter(IPLimits{Rate: 1, Burst: 2})
+	l.now = func() time.Time { return now }
+	ip := netip.MustParseAddr("192.0.2.1")
+
+	for i := 0; i < 2; i++ {
+		if _, err := l.Acquire(ip); err != nil {
+			t.Fatalf("burst connection %d: %v", i, err)
+		}
+	}
+	if _, err := l.Acquire(ip); !errors.Is(err, ErrConnectionRate) {
+		t.Fatalf("over the burst: err = %v, want ErrConnectionRate", err)
+	}
+
+	now = now.Add(time.Second)
+	if _, err := l.Acquire(ip); err != nil {
+		t.Errorf("after a token refilled: %v", err)
+	}
+	if _, err := l.Acquire(ip); !errors.Is(err, ErrConnectionRate) {
+		t.Errorf("only one token should have refilled: err = %v", err)
+	}
+}
+
+func TestIPLimiterExempt(t *testing.T) {
+	l := NewIPLimiter(IPLimits{
+		MaxPerIP: 1,
+		Rate:     1,
+		Burst:    1,
+		Exempt:   []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")},
+	})
+	ip := netip.MustParseAddr("10.1.2.3")
+	for i := 0; i < 5; i++ {
+		if _, err := l.Acquire(ip); err != nil {
+			t.Fatalf("exempt connection %d: %v", i, err)
+		}
+	}
+}
+
+func TestNewIPLimits(t *testing.T) {
+	limits, err := NewIPLimits(config.LimitsConfig{ConnectionRate: 30, Exempt: []string{"192.0.2.10/24"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limits.Rate != 0.5 || limits.Burst != 30 {
+		t.Errorf("rate = %v, burst = %d; want 0.5, 30", limits.Rate, limits.Burst)
+	}
+	if len(limits.Exempt) != 1 || limits.Exempt[0] != netip.MustParsePrefix("192.0.2.0/24") {
+		t.Errorf("exempt = %v", limits.Exempt)
+	}
+
+	if _, err := NewIPLimits(config.LimitsConfig{Exempt: []string{"monitoring"}}); err == nil {
+		t.Error("invalid exempt CIDR accepted")
+	}
+}
@@ -4,13 +4,22 @@ import "sync/atomic"
 
 // ConnectionLimiter provides thread-safe connection limit enforcement.
 type ConnectionLimiter struct {
-	maxConnections int64
+	maxConnections atomic.Int64
 	current        atomic.Int64
 }
 
 // NewConnectionLimiter creates a limiter with the specified maximum.
+// A maximum of zero or less means no limit.
 func NewConnectionLimiter(max int) *ConnectionLimiter {
-	return &ConnectionLimiter{maxConnections: int64(max)}
+	l := &ConnectionLimiter{}
+	l.maxConnections.Store(int64(max))
+	return l
+}
+
+// SetMax changes the maximum. Connections already over a lowered maximum
+// are kept; new ones are refused until the count drops below it.
+func (l *ConnectionLimiter) SetMax(max int) {
+	l.maxConnections.Store(int64(max))
 }
 
 // TryAcquire attempts to acquire a connection slot.
@@ -18,7 +27,7 @@ func NewConnectionLimiter(max int) *ConnectionLimiter {
 func (l *ConnectionLimiter) TryAcquire() bool {
 	for {
 		current := l.current.Load()
-		if current >= l.maxConnections {
+		if max := l.maxConnections.Load(); max > 0 && current >= max {
 			return false
 		}
 		if l.current.CompareAndSwap(current, current+1) {
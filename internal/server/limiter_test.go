@@ -138,3 +138,36 @@ func TestConnectionLimiter_ConcurrentAcquireRelease(t *testing.T) {
 		t.Errorf("Current() after all releases = %d, want 0", limiter.Current())
 	}
 }
+
+func TestConnectionLimiter_SetMax(t *testing.T) {
+	limiter := NewConnectionLimiter(2)
+	limiter.TryAcquire()
+	limiter.TryAcquire()
+
+	limiter.SetMax(3)
+	if !limiter.TryAcquire() {
+		t.Fatal("TryAcquire should succeed after raising the maximum")
+	}
+
+	// Lowering the maximum keeps existing connections but refuses new ones.
+	limiter.SetMax(1)
+	if limiter.Current() != 3 {
+		t.Errorf("Current() = %d, want 3", limiter.Current())
+	}
+	limiter.Release()
+	if limiter.TryAcquire() {
+		t.Error("TryAcquire should fail while over the lowered maximum")
+	}
+}
+
+func TestConnectionLimiter_Unlimited(t *testing.T) {
+	limiter := NewConnectionLimiter(0)
+	for i := 0; i < 100; i++ {
+		if !limiter.TryAcquire() {
+			t.Fatalf("TryAcquire %d failed without a limit", i)
+		}
+	}
+	if limiter.Current() != 100 {
+		t.Errorf("Current() = %d, want 100", limiter.Current())
+	}
+}
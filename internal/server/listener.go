@@ -5,12 +5,16 @@ import (
 	"crypto/tls"
 	"errors"
 	"log/slog"
+	"maps"
 	"net"
+	"net/netip"
+	"os"
 	"sync"
 	"time"
 
 	"github.com/infodancer/logging"
 	"github.com/infodancer/pop3d/internal/config"
+	"github.com/infodancer/pop3d/internal/metrics"
 )
 
 // ConnectionHandler is called for each new connection.
@@ -21,16 +25,46 @@ type ConnectionHandler func(ctx context.Context, conn *Connection)
 type Listener struct {
 	address   string
 	mode      config.ListenerMode
-	tlsConfig *tls.Config
-	connCfg   ConnectionConfig
 	handler   ConnectionHandler
 	logger    *slog.Logger
 	limiter   *ConnectionLimiter
+	ipLimiter *IPLimiter
+	banned    func(ip string) bool
+	collector metrics.Collector
+
+	// Permissions of a unix listener's socket file
+	socketMode  os.FileMode
+	socketGroup string
+
+	// ownLimiter enforces the listener's own connection limit, if any,
+	// within the server-wide one.
+	ownLimiter *ConnectionLimiter
 
 	listener net.Listener
 	wg       sync.WaitGroup
 	mu       sync.Mutex
 	closed   bool
+	settings listenerSettings
+
+	// Sessions in progress, with the function that cancels each one's
+	// context. draining is set once shutdown has begun, forced once the
+	// drain period has run out; drained counts the sessions that ended
+	// in between.
+	sessions map[*Connection]context.CancelFunc
+	draining bool
+	forced   bool
+	drained  int
+}
+
+// listenerSettings are the parts of a listener's configuration that a reload
+// can change. Each new connection takes a copy.
+type listenerSettings struct {
+	tlsConfig     *tls.Config
+	connCfg       ConnectionConfig
+	proxyProtocol bool
+	proxyTrusted  []netip.Prefix
+	drainTimeout  time.Duration
+	access        AccessList
 }
 
 // ListenerConfig holds configuration for creating a new Listener.
@@ -38,12 +72,48 @@ type ListenerConfig struct {
 	Address        string
 	Mode           config.ListenerMode
 	TLSConfig      *tls.Config
+	PreAuthTimeout time.Duration
 	IdleTimeout    time.Duration
-	CommandTimeout time.Duration
+	WriteTimeout   time.Duration
+	SessionTimeout time.Duration
+	MaxAuthLine    int
+	MaxBadCommands int
 	LogTransaction bool
 	Logger         *slog.Logger
 	Handler        ConnectionHandler
 	Limiter        *ConnectionLimiter
+	IPLimiter      *IPLimiter           // per-address limits; nil disables them
+	Banned         func(ip string) bool // banned client addresses; nil bans none
+	Collector      metrics.Collector    // nil → NoopCollector
+
+	// MaxConnections limits this listener's connections; zero means only
+	// Limiter applies.
+	MaxConnections int
+
+	// Options is the listener's section of the configuration, made
+	// available to sessions through Connection.ListenerConfig.
+	Options config.ListenerConfig
+
+	// DrainTimeout is how long sessions may take to finish on shutdown
+	// before they are closed.
+	DrainTimeout time.Duration
+
+	// ProxyProtocol expects a PROXY protocol v1 or v2 header from peers in
+	// ProxyTrusted. Connections from other peers are served directly.
+	ProxyProtocol bool
+	ProxyTrusted  []netip.Prefix
+
+	// Access decides which client addresses may connect; empty allows all.
+	Access AccessList
+
+	// SocketMode and SocketGroup set the permissions of a unix listener's
+	// socket file.
+	SocketMode  os.FileMode
+	SocketGroup string
+
+	// Listener, if set, is an already-open socket (e.g. from systemd socket
+	// activation) used instead of binding Address.
+	Listener net.Listener
 }
 
 // NewListener creates a new Listener with the given configuration.
@@ -52,46 +122,98 @@ func NewListener(cfg ListenerConfig) *Listener {
 	if logger == nil {
 		logger = slog.Default()
 	}
+	collector := cfg.Collector
+	if collector == nil {
+		collector = &metrics.NoopCollector{}
+	}
 
 	return &Listener{
-		address:   cfg.Address,
-		mode:      cfg.Mode,
+		address:     cfg.Address,
+		mode:        cfg.Mode,
+		handler:     cfg.Handler,
+		logger:      logging.WithListener(logger, cfg.Address, string(cfg.Mode)),
+		limiter:     cfg.Limiter,
+		ipLimiter:   cfg.IPLimiter,
+		banned:      cfg.Banned,
+		collector:   collector,
+		ownLimiter:  NewConnectionLimiter(cfg.MaxConnections),
+		socketMode:  cfg.SocketMode,
+		socketGroup: cfg.SocketGroup,
+		listener:    cfg.Listener,
+		settings:    newListenerSettings(cfg, logger),
+		sessions:    make(map[*Connection]context.CancelFunc),
+	}
+}
+
+// newListenerSettings extracts the reloadable settings from cfg.
+func newListenerSettings(cfg ListenerConfig, logger *slog.Logger) listenerSettings {
+	return listenerSettings{
 		tlsConfig: cfg.TLSConfig,
 		connCfg: ConnectionConfig{
+			TLSConfig:      cfg.TLSConfig,
+			PreAuthTimeout: cfg.PreAuthTimeout,
 			IdleTimeout:    cfg.IdleTimeout,
-			CommandTimeout: cfg.CommandTimeout,
+			WriteTimeout:   cfg.WriteTimeout,
+			SessionTimeout: cfg.SessionTimeout,
+			MaxAuthLine:    cfg.MaxAuthLine,
+			MaxBadCommands: cfg.MaxBadCommands,
 			LogTransaction: cfg.LogTransaction,
 			Logger:         logger,
+			Listener:       cfg.Options,
 		},
-		handler: cfg.Handler,
-		logger:  logging.WithListener(logger, cfg.Address, string(cfg.Mode)),
-		limiter: cfg.Limiter,
+		proxyProtocol: cfg.ProxyProtocol,
+		proxyTrusted:  cfg.ProxyTrusted,
+		drainTimeout:  cfg.DrainTimeout,
+		access:        cfg.Access,
+	}
+}
+
+// Update applies a reloaded configuration. Address, mode, handler and
+// limiter are fixed for the life of the listener; the other settings apply
+// to connections accepted from now on. Sessions in progress keep theirs.
+func (l *Listener) Update(cfg ListenerConfig) {
+	logger := cfg.Logger
+	if logger == nil {
+		logger = slog.Default()
 	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.settings = newListenerSettings(cfg, logger)
+	l.ownLimiter.SetMax(cfg.MaxConnections)
+}
+
+// currentSettings returns a copy of the listener's current settings.
+func (l *Listener) currentSettings() listenerSettings {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.settings
 }
 
 // Start begins listening for connections.
 // It blocks until the context is cancelled or an unrecoverable error occurs.
+// Sessions then get the drain period to finish before they are closed.
 func (l *Listener) Start(ctx context.Context) error {
 	var err error
 	var ln net.Listener
 
-	// For POP3S mode, wrap with TLS immediately
-	if l.mode == config.ModePop3s {
-		if l.tlsConfig == nil {
-			return errors.New("TLS configuration required for POP3S mode")
-		}
-		ln, err = tls.Listen("tcp", l.address, l.tlsConfig)
-	} else {
-		ln, err = net.Listen("tcp", l.address)
-	}
-
-	if err != nil {
-		return err
+	// For POP3S mode, connections are wrapped with TLS once accepted, after
+	// any PROXY protocol header has been read.
+	if l.mode == config.ModePop3s && l.currentSettings().tlsConfig == nil {
+		return errors.New("TLS configuration required for POP3S mode")
 	}
-
 	l.mu.Lock()
-	l.listener = ln
+	ln = l.listener
 	l.mu.Unlock()
+	if ln == nil {
+		ln, err = listen(l.address, l.mode, l.socketMode, l.socketGroup)
+		if err != nil {
+			return err
+		}
+		l.mu.Lock()
+		l.listener = ln
+		l.mu.Unlock()
+	}
 
 	l.logger.Info("listener started",
 		slog.String("address", l.address),
@@ -99,7 +221,11 @@ func (l *Listener) Start(ctx context.Context) error {
 	)
 
 	// Start accept loop in goroutine
-	go l.acceptLoop(ctx)
+	acceptDone := make(chan struct{})
+	go func() {
+		defer close(acceptDone)
+		l.acceptLoop(ctx)
+	}()
 
 	// Wait for context cancellation
 	<-ctx.Done()
@@ -113,8 +239,12 @@ func (l *Listener) Start(ctx context.Context) error {
 		)
 	}
 
-	// Wait for all connections to complete
-	l.wg.Wait()
+	// A connection accepted just before the close may still be joining wg;
+	// wait for the loop to stop so that no Add races drain's Wait.
+	<-acceptDone
+
+	// Let sessions finish, closing any left at the deadline
+	l.drain()
 
 	l.logger.Info("listener stopped")
 	return ctx.Err()
@@ -158,33 +288,88 @@ func (l *Listener) acceptLoop(ctx context.Context) {
 func (l *Listener) handleConnection(ctx context.Context, netConn net.Conn) {
 	defer l.wg.Done()
 
-	// Check connection limit
+	settings := l.currentSettings()
+
+	// Check the server-wide and the listener's connection limits
 	if l.limiter != nil && !l.limiter.TryAcquire() {
-		l.logger.Warn("connection rejected: at capacity",
-			slog.String("remote_addr", netConn.RemoteAddr().String()),
-		)
-		_, _ = netConn.Write([]byte("-ERR [SYS/TEMP] Server busy, try again later\r\n"))
-		_ = netConn.Close()
+		l.rejectBusy(netConn, "server")
 		return
 	}
 	if l.limiter != nil {
 		defer l.limiter.Release()
 	}
+	if !l.ownLimiter.TryAcquire() {
+		l.rejectBusy(netConn, "listener")
+		return
+	}
+	defer l.ownLimiter.Release()
+
+	// Take the client's address from a trusted proxy's PROXY header
+	if settings.proxyProtocol && trustedProxy(netConn.RemoteAddr(), settings.proxyTrusted) {
+		pc, err := readProxyHeader(netConn)
+		if err != nil {
+			l.logger.Warn("connection rejected: bad PROXY header",
+				slog.String("proxy_addr", netConn.RemoteAddr().String()),
+				slog.String("error", err.Error()),
+			)
+			_ = netConn.Close()
+			return
+		}
+		l.logger.Debug("PROXY header accepted",
+			slog.String("proxy_addr", netConn.RemoteAddr().String()),
+			slog.String("client_addr", pc.RemoteAddr().String()),
+			slog.Bool("tls_offloaded", pc.tlsOffloaded),
+		)
+		netConn = pc
+	}
+
+	// Access rules and per-address limits apply to the client, so after
+	// any PROXY header
+	if ip, ok := remoteIP(netConn.RemoteAddr()); ok {
+		if allowed, rule := settings.access.Check(ip); !allowed {
+			l.rejectDenied(netConn, rule)
+			return
+		}
+		if l.isBanned(netConn.RemoteAddr()) {
+			l.rejectBanned(netConn)
+			return
+		}
+		if l.ipLimiter != nil {
+			release, err := l.ipLimiter.Acquire(ip)
+			if err != nil {
+				l.rejectClient(netConn, err)
+				return
+			}
+			defer release()
+		}
+	}
+
+	if l.mode == config.ModePop3s {
+		netConn = tls.Server(netConn, settings.tlsConfig)
+	}
 
 	// Create connection wrapper
-	conn := NewConnection(netConn, l.connCfg)
+	conn := NewConnection(netConn, settings.connCfg)
 
 	conn.Logger().Info("connection accepted")
 
-	// Create connection-specific context
-	connCtx, cancel := context.WithCancel(ctx)
+	// Create connection-specific context. It is not cancelled with the
+	// listener's, so that a command in progress at shutdown can complete.
+	connCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
 	defer cancel()
 
+	if !l.track(conn, cancel) {
+		conn.Logger().Info("connection closed: drain period over")
+		_ = conn.Close()
+		return
+	}
+	defer l.untrack(conn)
+
 	// Attach logger to context
 	connCtx = logging.NewContext(connCtx, conn.Logger())
 
-	// Set initial idle timeout
-	if err := conn.ResetIdleTimeout(); err != nil {
+	// The pre-authentication timeout covers the TLS handshake and greeting
+	if err := conn.SetCommandTimeout(false); err != nil {
 		conn.Logger().Error("failed to set initial timeout",
 			slog.String("error", err.Error()),
 		)
@@ -192,9 +377,6 @@ func (l *Listener) handleConnection(ctx context.Context, netConn net.Conn) {
 		return
 	}
 
-	// Start idle monitor
-	go conn.IdleMonitor(connCtx)
-
 	// Call the connection handler
 	if l.handler != nil {
 		l.handler(connCtx, conn)
@@ -204,6 +386,164 @@ func (l *Listener) handleConnection(ctx context.Context, netConn net.Conn) {
 	conn.Logger().Info("connection closed")
 }
 
+// rejectBusy turns away a connection over a connection limit.
+func (l *Listener) rejectBusy(netConn net.Conn, limit string) {
+	l.logger.Warn("connection rejected: at capacity",
+		slog.String("remote_addr", netConn.RemoteAddr().String()),
+		slog.String("limit", limit),
+	)
+	l.collector.ConnectionRejected(limit)
+	l.refuse(netConn, "-ERR [SYS/TEMP] Server busy, try again later")
+}
+
+// rejectClient turns away a connection over a per-address limit.
+func (l *Listener) rejectClient(netConn net.Conn, err error) {
+	reason := "rate"
+	switch {
+	case errors.Is(err, ErrTooManyFromIP):
+		reason = "ip"
+	case errors.Is(err, ErrTooManyFromNetwork):
+		reason = "network"
+	}
+	l.logger.Warn("connection rejected: per-address limit",
+		slog.String("remote_addr", netConn.RemoteAddr().String()),
+		slog.String("error", err.Error()),
+	)
+	l.collector.ConnectionRejected(reason)
+	l.refuse(netConn, "-ERR [SYS/TEMP] Too many connections from your address, try again later")
+}
+
+// rejectDenied turns away a connection that an access rule denies.
+func (l *Listener) rejectDenied(netConn net.Conn, rule string) {
+	l.logger.Warn("connection rejected: access denied",
+		slog.String("remote_addr", netConn.RemoteAddr().String()),
+		slog.String("rule", rule),
+	)
+	l.collector.ConnectionRejected("access")
+	l.refuse(netConn, "-ERR [SYS/PERM] Connections from your address are not permitted")
+}
+
+// isBanned reports whether the client at addr is banned. The address is
+// given as the session sees it, host without port, so that the bans
+// recorded against a session's client match.
+func (l *Listener) isBanned(addr net.Addr) bool {
+	if l.banned == nil {
+		return false
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	return err == nil && l.banned(host)
+}
+
+// rejectBanned turns away a connection from a banned address.
+func (l *Listener) rejectBanned(netConn net.Conn) {
+	l.logger.Info("connection rejected: address banned",
+		slog.String("remote_addr", netConn.RemoteAddr().String()),
+	)
+	l.collector.ConnectionRejected("banned")
+	l.refuse(netConn, "-ERR [SYS/TEMP] Too many failed logins, try again later")
+}
+
+// refuse sends a rejected connection its reply and closes it. A pop3s client
+// expects a TLS handshake and cannot read a plaintext reply, and completing
+// the handshake would spend the server's CPU on a connection it is turning
+// away, so pop3s connections are closed without one.
+func (l *Listener) refuse(netConn net.Conn, reply string) {
+	if l.mode != config.ModePop3s {
+		_, _ = netConn.Write([]byte(reply + "\r\n"))
+	}
+	_ = netConn.Close()
+}
+
+// track registers a session so that shutdown can drain it. It returns false
+// if the drain period is already over; a session that arrives while draining
+// is asked to end straight away.
+func (l *Listener) track(conn *Connection, cancel context.CancelFunc) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.forced {
+		return false
+	}
+	l.sessions[conn] = cancel
+	if l.draining {
+		conn.Drain()
+	}
+	return true
+}
+
+// untrack removes a session once it has ended.
+func (l *Listener) untrack(conn *Connection) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	delete(l.sessions, conn)
+	if l.draining && !l.forced {
+		l.drained++
+	}
+}
+
+// drain asks every session to end after its current command and waits for
+// them. Sessions still running when the drain period runs out are closed.
+func (l *Listener) drain() {
+	start := time.Now()
+
+	l.mu.Lock()
+	l.draining = true
+	sessions := make([]*Connection, 0, len(l.sessions))
+	for conn := range l.sessions {
+		sessions = append(sessions, conn)
+	}
+	l.mu.Unlock()
+
+	for _, conn := range sessions {
+		conn.Drain()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		l.wg.Wait()
+		close(done)
+	}()
+
+	timer := time.NewTimer(l.currentSettings().drainTimeout)
+	defer timer.Stop()
+
+	var forced int
+	select {
+	case <-done:
+	case <-timer.C:
+		l.mu.Lock()
+		l.forced = true
+		remaining := maps.Clone(l.sessions)
+		l.mu.Unlock()
+
+		forced = len(remaining)
+		for conn, cancel := range remaining {
+			cancel()
+			_ = conn.Close()
+		}
+		<-done
+	}
+
+	l.mu.Lock()
+	drained := l.drained
+	l.mu.Unlock()
+
+	l.collector.SessionsDrained(drained, forced)
+	if forced > 0 {
+		l.logger.Warn("drain period over, closed remaining sessions",
+			slog.Int("drained", drained),
+			slog.Int("forced", forced),
+			slog.Duration("duration", time.Since(start)),
+		)
+		return
+	}
+	l.logger.Info("sessions drained",
+		slog.Int("drained", drained),
+		slog.Duration("duration", time.Since(start)),
+	)
+}
+
 // Close stops the listener from accepting new connections.
 func (l *Listener) Close() error {
 	l.mu.Lock()
@@ -233,5 +573,5 @@ func (l *Listener) Mode() config.ListenerMode {
 // TLSConfig returns the TLS configuration, if any.
 // For non-POP3S modes, this can be used for STLS.
 func (l *Listener) TLSConfig() *tls.Config {
-	return l.tlsConfig
+	return l.currentSettings().tlsConfig
 }
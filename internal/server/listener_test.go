@@ -0,0 +1,290 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/infodancer/pop3d/internal/config"
+	"github.com/infodancer/pop3d/internal/metrics"
+)
+
+// drainCollector records the outcome of a shutdown drain.
+type drainCollector struct {
+	metrics.NoopCollector
+	mu              sync.Mutex
+	drained, forced int
+}
+
+func (c *drainCollector) SessionsDrained(drained, forced int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.drained += drained
+	c.forced += forced
+}
+
+// startDrainListener starts a listener on a loopback port and returns its
+// address, the function that shuts it down and a channel carrying the result
+// of Start.
+func startDrainListener(t *testing.T, drain time.Duration, collector metrics.Collector, handler ConnectionHandler) (string, context.CancelFunc, <-chan error) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewListener(ListenerConfig{
+		Address:      ln.Addr().String(),
+		Mode:         config.ModePop3,
+		Handler:      handler,
+		Collector:    collector,
+		DrainTimeout: drain,
+		Listener:     ln,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	errc := make(chan error, 1)
+	go func() { errc <- l.Start(ctx) }()
+	return ln.Addr().String(), cancel, errc
+}
+
+// dialGreeting connects and reads the greeting line.
+func dialGreeting(t *testing.T, addr string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	r := bufio.NewReader(c)
+	if line, err := r.ReadString('\n'); err != nil || line != "+OK\r\n" {
+		t.Fatalf("greeting = %q, %v", line, err)
+	}
+	return c, r
+}
+
+func waitStopped(t *testing.T, errc <-chan error) {
+	t.Helper()
+	select {
+	case <-errc:
+	case <-time.After(5 * time.Second):
+		t.Fatal("listener did not stop")
+	}
+}
+
+func TestListenerDrainInterruptsIdleSession(t *testing.T) {
+	collector := &drainCollector{}
+	addr, shutdown, errc := startDrainListener(t, 5*time.Second, collector, func(ctx context.Context, conn *Connection) {
+		_, _ = conn.Writer().WriteString("+OK\r\n")
+		_ = conn.Flush()
+		for {
+			if _, err := conn.Reader().ReadString('\n'); err != nil {
+				if conn.Draining() {
+					_, _ = conn.Writer().WriteString("-ERR shutting down\r\n")
+					_ = conn.Flush()
+				}
+				return
+			}
+		}
+	})
+
+	_, r := dialGreeting(t, addr)
+	shutdown()
+
+	if line, err := r.ReadString('\n'); err != nil || line != "-ERR shutting down\r\n" {
+		t.Errorf("after shutdown = %q, %v; want the drain notice", line, err)
+	}
+	waitStopped(t, errc)
+
+	if collector.drained != 1 || collector.forced != 0 {
+		t.Errorf("drained = %d, forced = %d; want 1, 0", collector.drained, collector.forced)
+	}
+}
+
+func TestListenerDrainLetsCommandFinish(t *testing.T) {
+	release := make(chan struct{})
+	addr, shutdown, errc := startDrainListener(t, 5*time.Second, nil, func(ctx context.Context, conn *Connection) {
+		_, _ = conn.Writer().WriteString("+OK\r\n")
+		_ = conn.Flush()
+		if _, err := conn.Reader().ReadString('\n'); err != nil {
+			return
+		}
+		// A slow command that is still running when shutdown begins.
+		<-release
+		if ctx.Err() != nil {
+			return
+		}
+		_, _ = conn.Writer().WriteString("+OK done\r\n")
+		_ = conn.Flush()
+	})
+
+	c, r := dialGreeting(t, addr)
+	if _, err := c.Write([]byte("RETR 1\r\n")); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	shutdown()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	if line, err := r.ReadString('\n'); err != nil || line != "+OK done\r\n" {
+		t.Errorf("response = %q, %v; want the command to complete", line, err)
+	}
+	waitStopped(t, errc)
+}
+
+func TestListenerDrainDeadlineClosesSessions(t *testing.T) {
+	collector := &drainCollector{}
+	cancelled := make(chan struct{})
+	addr, shutdown, errc := startDrainListener(t, 50*time.Millisecond, collector, func(ctx context.Context, conn *Connection) {
+		_, _ = conn.Writer().WriteString("+OK\r\n")
+		_ = conn.Flush()
+		// Ignores the drain request, like a command that never finishes.
+		<-ctx.Done()
+		close(cancelled)
+	})
+
+	_, r := dialGreeting(t, addr)
+	shutdown()
+	waitStopped(t, errc)
+
+	select {
+	case <-cancelled:
+	default:
+		t.Error("session context was not cancelled at the drain deadline")
+	}
+	if _, err := r.ReadString('\n'); err == nil {
+		t.Error("connection still open after the drain deadline")
+	}
+	if collector.drained != 0 || collector.forced != 1 {
+		t.Errorf("drained = %d, forced = %d; want 0, 1", collector.drained, collector.forced)
+	}
+}
+
+func TestListenerRejectsOverPerIPLimit(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := NewListener(ListenerConfig{
+		Address: ln.Addr().String(),
+		Mode:    config.ModePop3,
+		Handler: func(ctx context.Context, conn *Connection) {
+			_, _ = conn.Writer().WriteString("+OK\r\n")
+			_ = conn.Flush()
+			_, _ = conn.Reader().ReadString('\n')
+		},
+		IPLimiter: NewIPLimiter(IPLimits{MaxPerIP: 1}),
+		Listener:  ln,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() { _ = l.Start(ctx) }()
+
+	// The first connection holds the address's only slot.
+	dialGreeting(t, ln.Addr().String())
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+	line, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil || line != "-ERR [SYS/TEMP] Too many connections from your address, try again later\r\n" {
+		t.Errorf("second connection got %q, %v; want the per-address rejection", line, err)
+	}
+}
+
+func TestListenerPop3sRejectsWithoutPlaintext(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	held := make(chan struct{})
+	done := make(chan struct{})
+	t.Cleanup(func() { close(done) })
+	l := NewListener(ListenerConfig{
+		Address:   ln.Addr().String(),
+		Mode:      config.ModePop3s,
+		TLSConfig: &tls.Config{},
+		Handler: func(ctx context.Context, conn *Connection) {
+			close(held)
+			<-done
+		},
+		IPLimiter: NewIPLimiter(IPLimits{MaxPerIP: 1}),
+		Listener:  ln,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() { _ = l.Start(ctx) }()
+
+	// The first connection holds the address's only slot.
+	first, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	<-held
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+	if n, err := c.Read(make([]byte, 64)); n != 0 || err != io.EOF {
+		t.Errorf("rejected pop3s connection read %d bytes, %v; want it closed without a plaintext reply", n, err)
+	}
+}
+
+func TestListenerRejectsBanned(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var handled atomic.Bool
+	var asked atomic.Value
+	l := NewListener(ListenerConfig{
+		Address: ln.Addr().String(),
+		Mode:    config.ModePop3,
+		Handler: func(ctx context.Context, conn *Connection) {
+			handled.Store(true)
+		},
+		Banned: func(ip string) bool {
+			asked.Store(ip)
+			return true
+		},
+		Listener: ln,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go func() { _ = l.Start(ctx) }()
+
+	c, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(5 * time.Second))
+	reply, err := io.ReadAll(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(reply), "-ERR [SYS/TEMP]") {
+		t.Errorf("banned client got %q, want -ERR [SYS/TEMP]", reply)
+	}
+	if ip, _ := asked.Load().(string); ip != "127.0.0.1" {
+		t.Errorf("ban checked for %q, want 127.0.0.1", ip)
+	}
+	if handled.Load() {
+		t.Error("banned connection reached the handler")
+	}
+}
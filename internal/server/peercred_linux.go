@@ -0,0 +1,29 @@
+package server
+
+import (
+	"net"
+	"syscall"
+)
+
+// peerCredentials reads the credentials of the peer of a Unix-domain socket
+// with SO_PEERCRED.
+func peerCredentials(conn net.Conn) (PeerCredentials, bool) {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return PeerCredentials{}, false
+	}
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return PeerCredentials{}, false
+	}
+
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil || credErr != nil {
+		return PeerCredentials{}, false
+	}
+	return PeerCredentials{PID: cred.Pid, UID: cred.Uid, GID: cred.Gid}, true
+}
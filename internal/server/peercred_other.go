@@ -0,0 +1,11 @@
+//go:build !linux
+
+package server
+
+import "net"
+
+// peerCredentials is only implemented on Linux (SO_PEERCRED); elsewhere peers
+// are never identified and must log in.
+func peerCredentials(conn net.Conn) (PeerCredentials, bool) {
+	return PeerCredentials{}, false
+}
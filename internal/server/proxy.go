@@ -0,0 +1,274 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// proxyHeaderTimeout bounds how long a trusted proxy has to send its header.
+const proxyHeaderTimeout = 10 * time.Second
+
+// maxProxyV1Header is the longest PROXY protocol v1 header, including CRLF.
+const maxProxyV1Header = 107
+
+// proxyV2Signature starts every PROXY protocol v2 header.
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// PROXY protocol v2 fields.
+const (
+	proxyV2CmdLocal = 0x0
+	proxyV2CmdProxy = 0x1
+
+	proxyV2FamUnspec = 0x0
+	proxyV2FamInet   = 0x1
+	proxyV2FamInet6  = 0x2
+	proxyV2FamUnix   = 0x3
+
+	proxyV2TransUnspec = 0x0
+	proxyV2TransStream = 0x1
+
+	proxyV2TypeSSL   = 0x20
+	proxyV2ClientSSL = 0x01
+)
+
+// proxyConn is a connection whose addresses were reported by a PROXY protocol
+// header. Data the client sent after the header is read from reader.
+type proxyConn struct {
+	net.Conn
+	reader       *bufio.Reader
+	remote       net.Addr // nil keeps the proxy's own address
+	local        net.Addr
+	tlsOffloaded bool // the proxy terminated TLS for the client
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+// RemoteAddr returns the client address reported by the proxy.
+func (c *proxyConn) RemoteAddr() net.Addr {
+	if c.remote != nil {
+		return c.remote
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// LocalAddr returns the address the client connected to, as reported by the proxy.
+func (c *proxyConn) LocalAddr() net.Addr {
+	if c.local != nil {
+		return c.local
+	}
+	return c.Conn.LocalAddr()
+}
+
+// readProxyHeader reads a PROXY protocol v1 or v2 header from conn, which
+// must come from a trusted proxy, and returns the connection as the client
+// sees it.
+func readProxyHeader(conn net.Conn) (*proxyConn, error) {
+	if err := conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout)); err != nil {
+		return nil, err
+	}
+
+	// The first byte tells the versions apart, so a client that sends a
+	// short command instead of a header is rejected without waiting.
+	pc := &proxyConn{Conn: conn, reader: bufio.NewReader(conn)}
+	first, err := pc.reader.Peek(1)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidProxyHeader, err)
+	}
+	switch first[0] {
+	case proxyV2Signature[0]:
+		err = pc.readV2()
+	case 'P':
+		err = pc.readV1()
+	default:
+		err = fmt.Errorf("%w: missing", ErrInvalidProxyHeader)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := conn.SetReadDeadline(time.Time{}); err != nil {
+		return nil, err
+	}
+	return pc, nil
+}
+
+// readV1 reads a text header: "PROXY TCP4 src dst sport dport\r\n".
+func (c *proxyConn) readV1() error {
+	var line []byte
+	for len(line) < maxProxyV1Header {
+		b, err := c.reader.ReadByte()
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalidProxyHeader, err)
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasPrefix(line, []byte("PROXY ")) {
+		return fmt.Errorf("%w: missing", ErrInvalidProxyHeader)
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return fmt.Errorf("%w: v1 header too long", ErrInvalidProxyHeader)
+	}
+
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		// The proxy could not tell; keep its own address.
+		return nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return fmt.Errorf("%w: %q", ErrInvalidProxyHeader, strings.TrimSpace(string(line)))
+	}
+
+	src, err := parseProxyV1Addr(fields[2], fields[4])
+	if err != nil {
+		return err
+	}
+	dst, err := parseProxyV1Addr(fields[3], fields[5])
+	if err != nil {
+		return err
+	}
+	c.remote = net.TCPAddrFromAddrPort(src)
+	c.local = net.TCPAddrFromAddrPort(dst)
+	return nil
+}
+
+// parseProxyV1Addr parses an address and port from a v1 header.
+func parseProxyV1Addr(addr, port string) (netip.AddrPort, error) {
+	ip, err := netip.ParseAddr(addr)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("%w: %w", ErrInvalidProxyHeader, err)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return netip.AddrPort{}, fmt.Errorf("%w: invalid port %q", ErrInvalidProxyHeader, port)
+	}
+	return netip.AddrPortFrom(ip, uint16(p)), nil
+}
+
+// readV2 reads a binary header: the signature, version and command, address
+// family, length, addresses and TLVs.
+func (c *proxyConn) readV2() error {
+	var hdr [16]byte
+	if _, err := io.ReadFull(c.reader, hdr[:]); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidProxyHeader, err)
+	}
+	if !bytes.Equal(hdr[:12], proxyV2Signature) {
+		return fmt.Errorf("%w: bad v2 signature", ErrInvalidProxyHeader)
+	}
+	if hdr[12]>>4 != 2 {
+		return fmt.Errorf("%w: unsupported version %d", ErrInvalidProxyHeader, hdr[12]>>4)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(hdr[14:16]))
+	if _, err := io.ReadFull(c.reader, body); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalidProxyHeader, err)
+	}
+
+	switch hdr[12] & 0xf {
+	case proxyV2CmdLocal:
+		// A health check from the proxy itself.
+		return nil
+	case proxyV2CmdProxy:
+	default:
+		return fmt.Errorf("%w: unsupported command %d", ErrInvalidProxyHeader, hdr[12]&0xf)
+	}
+
+	// POP3 runs over a stream, so a header for any other transport cannot
+	// describe this connection. Only an entirely unspecified one, whose
+	// addresses are ignored, is let through.
+	fam, trans := hdr[13]>>4, hdr[13]&0xf
+	if trans != proxyV2TransStream && (fam != proxyV2FamUnspec || trans != proxyV2TransUnspec) {
+		return fmt.Errorf("%w: unsupported transport %d", ErrInvalidProxyHeader, trans)
+	}
+
+	var addrLen int
+	switch fam {
+	case proxyV2FamInet:
+		addrLen = 12
+		if len(body) < addrLen {
+			return fmt.Errorf("%w: short v2 address", ErrInvalidProxyHeader)
+		}
+		src, _ := netip.AddrFromSlice(body[0:4])
+		dst, _ := netip.AddrFromSlice(body[4:8])
+		c.remote = net.TCPAddrFromAddrPort(netip.AddrPortFrom(src, binary.BigEndian.Uint16(body[8:10])))
+		c.local = net.TCPAddrFromAddrPort(netip.AddrPortFrom(dst, binary.BigEndian.Uint16(body[10:12])))
+	case proxyV2FamInet6:
+		addrLen = 36
+		if len(body) < addrLen {
+			return fmt.Errorf("%w: short v2 address", ErrInvalidProxyHeader)
+		}
+		src, _ := netip.AddrFromSlice(body[0:16])
+		dst, _ := netip.AddrFromSlice(body[16:32])
+		c.remote = net.TCPAddrFromAddrPort(netip.AddrPortFrom(src, binary.BigEndian.Uint16(body[32:34])))
+		c.local = net.TCPAddrFromAddrPort(netip.AddrPortFrom(dst, binary.BigEndian.Uint16(body[34:36])))
+	case proxyV2FamUnix:
+		// Keep the proxy's own address.
+		addrLen = 216
+		if len(body) < addrLen {
+			return fmt.Errorf("%w: short v2 address", ErrInvalidProxyHeader)
+		}
+	default:
+		// UNSPEC: keep the proxy's own address and ignore the rest.
+		return nil
+	}
+
+	return c.parseTLVs(body[addrLen:])
+}
+
+// parseTLVs reads the v2 type-length-value extensions. Only PP2_TYPE_SSL is
+// used: it tells whether the client connected to the proxy over TLS.
+func (c *proxyConn) parseTLVs(tlvs []byte) error {
+	for len(tlvs) > 0 {
+		if len(tlvs) < 3 {
+			return fmt.Errorf("%w: truncated TLV", ErrInvalidProxyHeader)
+		}
+		typ, n := tlvs[0], int(binary.BigEndian.Uint16(tlvs[1:3]))
+		if len(tlvs) < 3+n {
+			return fmt.Errorf("%w: truncated TLV", ErrInvalidProxyHeader)
+		}
+		value := tlvs[3 : 3+n]
+		if typ == proxyV2TypeSSL && n >= 1 && value[0]&proxyV2ClientSSL != 0 {
+			c.tlsOffloaded = true
+		}
+		tlvs = tlvs[3+n:]
+	}
+	return nil
+}
+
+// parseTrustedProxies parses the CIDRs allowed to send PROXY headers.
+func parseTrustedProxies(cidrs []string) ([]netip.Prefix, error) {
+	prefixes := make([]netip.Prefix, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		p, err := netip.ParsePrefix(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("proxy_trusted: %w", err)
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
+
+// trustedProxy returns true if addr is within one of the trusted prefixes.
+func trustedProxy(addr net.Addr, trusted []netip.Prefix) bool {
+	ip, ok := remoteIP(addr)
+	if !ok {
+		return false
+	}
+	for _, p := range trusted {
+		if p.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
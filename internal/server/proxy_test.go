@@ -0,0 +1,276 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+// proxyV2Header builds a v2 PROXY header for a TCP over IPv4 connection.
+func proxyV2Header(src, dst netip.AddrPort, tlvs []byte) []byte {
+	body := append(src.Addr().AsSlice(), dst.Addr().AsSlice()...)
+	body = binary.BigEndian.AppendUint16(body, src.Port())
+	body = binary.BigEndian.AppendUint16(body, dst.Port())
+	body = append(body, tlvs...)
+
+	hdr := append([]byte{}, proxyV2Signature...)
+	hdr = append(hdr, 0x21, 0x11) // v2 PROXY, INET STREAM
+	hdr = binary.BigEndian.AppendUint16(hdr, uint16(len(body)))
+	return append(hdr, body...)
+}
+
+// withV2Transport replaces the transport of a v2 header built by
+// proxyV2Header.
+func withV2Transport(hdr []byte, trans byte) []byte {
+	hdr[13] = hdr[13]&0xf0 | trans
+	return hdr
+}
+
+// sslTLV builds a PP2_TYPE_SSL TLV with the given client flags.
+func sslTLV(client byte) []byte {
+	value := []byte{client, 0, 0, 0, 0}
+	tlv := []byte{proxyV2TypeSSL}
+	tlv = binary.BigEndian.AppendUint16(tlv, uint16(len(value)))
+	return append(tlv, value...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	src := netip.MustParseAddrPort("203.0.113.7:51000")
+	dst := netip.MustParseAddrPort("192.0.2.1:995")
+
+	local := append([]byte{}, proxyV2Signature...)
+	local = append(local, 0x20, 0x00, 0x00, 0x00) // v2 LOCAL, UNSPEC, no body
+
+	tests := []struct {
+		name       string
+		header     []byte
+		wantRemote string // "" keeps the proxy's address
+		wantTLS    bool
+		wantErr    bool
+	}{
+		{
+			name:       "v1 TCP4",
+			header:     []byte("PROXY TCP4 203.0.113.7 192.0.2.1 51000 110\r\n"),
+			wantRemote: "203.0.113.7:51000",
+		},
+		{
+			name:       "v1 TCP6",
+			header:     []byte("PROXY TCP6 2001:db8::7 2001:db8::1 51000 110\r\n"),
+			wantRemote: "[2001:db8::7]:51000",
+		},
+		{
+			name:   "v1 UNKNOWN",
+			header: []byte("PROXY UNKNOWN\r\n"),
+		},
+		{
+			name:       "v2 TCP4",
+			header:     proxyV2Header(src, dst, nil),
+			wantRemote: "203.0.113.7:51000",
+		},
+		{
+			name:       "v2 TLS offloaded",
+			header:     proxyV2Header(src, dst, sslTLV(proxyV2ClientSSL)),
+			wantRemote: "203.0.113.7:51000",
+			wantTLS:    true,
+		},
+		{
+			name:       "v2 SSL TLV without client TLS",
+			header:     proxyV2Header(src, dst, sslTLV(0)),
+			wantRemote: "203.0.113.7:51000",
+		},
+		{
+			name:   "v2 LOCAL",
+			header: local,
+		},
+		{
+			name:    "v2 DGRAM",
+			header:  withV2Transport(proxyV2Header(src, dst, nil), 0x2),
+			wantErr: true,
+		},
+		{
+			name:    "v2 TCP4 with unspecified transport",
+			header:  withV2Transport(proxyV2Header(src, dst, nil), 0x0),
+			wantErr: true,
+		},
+		{
+			name:    "v2 truncated TLV",
+			header:  proxyV2Header(src, dst, []byte{proxyV2TypeSSL, 0, 5, 1}),
+			wantErr: true,
+		},
+		{
+			name:    "v1 bad address",
+			header:  []byte("PROXY TCP4 not-an-ip 192.0.2.1 51000 110\r\n"),
+			wantErr: true,
+		},
+		{
+			name:    "missing header",
+			header:  []byte("USER alice@example.com\r\n"),
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer server.Close()
+			defer client.Close()
+			go func() {
+				_, _ = client.Write(append(tt.header, "CAPA\r\n"...))
+			}()
+
+			pc, err := readProxyHeader(server)
+			if tt.wantErr {
+				if !errors.Is(err, ErrInvalidProxyHeader) {
+					t.Fatalf("readProxyHeader() error = %v, want ErrInvalidProxyHeader", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("readProxyHeader() error = %v", err)
+			}
+
+			wantRemote := tt.wantRemote
+			if wantRemote == "" {
+				wantRemote = server.RemoteAddr().String()
+			}
+			if got := pc.RemoteAddr().String(); got != wantRemote {
+				t.Errorf("RemoteAddr() = %s, want %s", got, wantRemote)
+			}
+			if pc.tlsOffloaded != tt.wantTLS {
+				t.Errorf("tlsOffloaded = %v, want %v", pc.tlsOffloaded, tt.wantTLS)
+			}
+
+			// The client's first command follows the header.
+			line, err := bufio.NewReader(pc).ReadString('\n')
+			if err != nil || line != "CAPA\r\n" {
+				t.Errorf("data after header = %q, %v; want CAPA", line, err)
+			}
+		})
+	}
+}
+
+func TestTrustedProxy(t *testing.T) {
+	trusted, err := parseTrustedProxies([]string{"10.0.0.0/8", "2001:db8::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		addr string
+		want bool
+	}{
+		{"10.1.2.3:4000", true},
+		{"[::ffff:10.1.2.3]:4000", true},
+		{"[2001:db8::1]:4000", true},
+		{"192.0.2.1:4000", false},
+	}
+	for _, tt := range tests {
+		addr := net.TCPAddrFromAddrPort(netip.MustParseAddrPort(tt.addr))
+		if got := trustedProxy(addr, trusted); got != tt.want {
+			t.Errorf("trustedProxy(%s) = %v, want %v", tt.addr, got, tt.want)
+		}
+	}
+
+	if _, err := parseTrustedProxies([]string{"10.0.0.0"}); err == nil {
+		t.Error("parseTrustedProxies accepted an address without a prefix length")
+	}
+}
+
+func TestListenerProxyProtocol(t *testing.T) {
+	tests := []struct {
+		name       string
+		trusted    string
+		header     []byte
+		wantRemote string
+		wantTLS    bool
+		wantServed bool
+	}{
+		{
+			name:       "trusted proxy",
+			trusted:    "127.0.0.0/8",
+			header:     proxyV2Header(netip.MustParseAddrPort("203.0.113.7:51000"), netip.MustParseAddrPort("192.0.2.1:110"), sslTLV(proxyV2ClientSSL)),
+			wantRemote: "203.0.113.7:51000",
+			wantTLS:    true,
+			wantServed: true,
+		},
+		{
+			name:       "untrusted peer is served directly",
+			trusted:    "10.0.0.0/8",
+			wantServed: true,
+		},
+		{
+			name:    "trusted proxy without header",
+			trusted: "127.0.0.0/8",
+			header:  []byte("CAPA\r\n"),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer ln.Close()
+
+			type result struct {
+				remote string
+				tls    bool
+			}
+			served := make(chan result, 1)
+			l := NewListener(ListenerConfig{
+				Address:       ln.Addr().String(),
+				Mode:          "pop3",
+				ProxyProtocol: true,
+				ProxyTrusted:  []netip.Prefix{netip.MustParsePrefix(tt.trusted)},
+				Handler: func(ctx context.Context, conn *Connection) {
+					served <- result{conn.RemoteAddr().String(), conn.TLSOffloaded()}
+				},
+			})
+
+			client, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer client.Close()
+			if _, err := client.Write(tt.header); err != nil {
+				t.Fatal(err)
+			}
+
+			conn, err := ln.Accept()
+			if err != nil {
+				t.Fatal(err)
+			}
+			l.wg.Add(1)
+			l.handleConnection(context.Background(), conn)
+
+			select {
+			case r := <-served:
+				if !tt.wantServed {
+					t.Fatalf("connection served from %s, want rejected", r.remote)
+				}
+				wantRemote := tt.wantRemote
+				if wantRemote == "" {
+					wantRemote = client.LocalAddr().String()
+				}
+				if r.remote != wantRemote || r.tls != tt.wantTLS {
+					t.Errorf("served %s (TLS offloaded %v), want %s (%v)", r.remote, r.tls, wantRemote, tt.wantTLS)
+				}
+			default:
+				if tt.wantServed {
+					t.Fatal("connection was not served")
+				}
+				_ = client.SetReadDeadline(time.Now().Add(time.Second))
+				if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+					t.Errorf("client read = %v, want EOF after rejection", err)
+				}
+			}
+		})
+	}
+}
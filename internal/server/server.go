@@ -3,12 +3,15 @@ package server
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"log/slog"
+	"net"
 	"sync"
 
 	"github.com/infodancer/logging"
 	"github.com/infodancer/pop3d/internal/config"
+	"github.com/infodancer/pop3d/internal/metrics"
 )
 
 // Server coordinates multiple listeners and handles POP3 connections.
@@ -16,10 +19,22 @@ type Server struct {
 	cfg       *config.Config
 	tlsConfig *tls.Config
 	logger    *slog.Logger
+	collector metrics.Collector
 	handler   ConnectionHandler
+	banned    func(ip string) bool
+	activated []ActivatedListener
 
 	listeners []*Listener
+	limiter   *ConnectionLimiter
+	ipLimiter *IPLimiter
 	mu        sync.Mutex
+
+	// Set by Run, so that Reload can start listeners. Listeners that a
+	// reload removes stay in wg until their sessions have drained.
+	ctx      context.Context
+	stopping bool
+	wg       sync.WaitGroup
+	errs     []error
 }
 
 // Config holds configuration for creating a new Server.
@@ -27,6 +42,16 @@ type Config struct {
 	Cfg       *config.Config
 	TLSConfig *tls.Config
 	Logger    *slog.Logger
+	Collector metrics.Collector // nil → NoopCollector
+
+	// Activated holds sockets passed in by the service manager. When set,
+	// they replace the configured listeners.
+	Activated []ActivatedListener
+
+	// Banned reports whether a client address is banned, e.g. for repeated
+	// login failures. Banned clients are turned away on accept. Nil bans
+	// none.
+	Banned func(ip string) bool
 }
 
 // New creates a new Server with the given configuration.
@@ -40,6 +65,9 @@ func New(sc Config) (*Server, error) {
 		cfg:       sc.Cfg,
 		tlsConfig: sc.TLSConfig,
 		logger:    logger,
+		collector: sc.Collector,
+		banned:    sc.Banned,
+		activated: sc.Activated,
 	}
 
 	return s, nil
@@ -60,71 +88,67 @@ func (s *Server) Run(ctx context.Context) error {
 		s.handler = s.defaultHandler
 	}
 
-	// Create shared connection limiter
-	limiter := NewConnectionLimiter(s.cfg.Limits.MaxConnections)
+	// Create shared connection limiters
+	s.limiter = NewConnectionLimiter(s.cfg.Limits.MaxConnections)
+	limits, err := NewIPLimits(s.cfg.Limits)
+	if err != nil {
+		s.mu.Unlock()
+		return err
+	}
+	s.ipLimiter = NewIPLimiter(limits)
 
-	// Create listeners
-	for _, lc := range s.cfg.Listeners {
-		// Determine if this listener needs TLS
-		var tlsCfg *tls.Config
-		if lc.Mode == config.ModePop3s {
-			if s.tlsConfig == nil {
+	// Create listeners, on the sockets passed in by the service manager if
+	// there are any
+	if len(s.activated) > 0 {
+		for _, a := range s.activated {
+			lc := settingsForMode(s.cfg, a.Mode)
+			lc.Address = a.Listener.Addr().String()
+			listenerCfg, err := s.listenerConfig(s.cfg, lc)
+			if err != nil {
+				s.mu.Unlock()
+				return err
+			}
+			listenerCfg.Listener = a.Listener
+			s.listeners = append(s.listeners, NewListener(listenerCfg))
+		}
+	} else {
+		for _, lc := range s.cfg.Listeners {
+			listenerCfg, err := s.listenerConfig(s.cfg, lc)
+			if err != nil {
 				s.mu.Unlock()
-				return fmt.Errorf("listener %s: TLS required for POP3S mode but not configured", lc.Address)
+				return err
 			}
-			tlsCfg = s.tlsConfig
-		} else if s.tlsConfig != nil {
-			// Make TLS available for STLS on non-POP3S listeners
-			tlsCfg = s.tlsConfig
-		}
-
-		listener := NewListener(ListenerConfig{
-			Address:        lc.Address,
-			Mode:           lc.Mode,
-			TLSConfig:      tlsCfg,
-			IdleTimeout:    s.cfg.Timeouts.ConnectionTimeout(),
-			CommandTimeout: s.cfg.Timeouts.CommandTimeout(),
-			LogTransaction: s.cfg.LogLevel == "debug",
-			Logger:         s.logger,
-			Handler:        s.handler,
-			Limiter:        limiter,
-		})
-		s.listeners = append(s.listeners, listener)
+			s.listeners = append(s.listeners, NewListener(listenerCfg))
+		}
 	}
 
-	s.mu.Unlock()
+	// Start all listeners in goroutines
+	s.ctx = ctx
+	for _, l := range s.listeners {
+		s.startListener(l)
+	}
 
 	s.logger.Info("starting server",
 		slog.String("hostname", s.cfg.Hostname),
 		slog.Int("listener_count", len(s.listeners)),
 	)
 
-	// Start all listeners in goroutines
-	var wg sync.WaitGroup
-	errChan := make(chan error, len(s.listeners))
-
-	for _, l := range s.listeners {
-		wg.Add(1)
-		go func(listener *Listener) {
-			defer wg.Done()
-			if err := listener.Start(ctx); err != nil && err != context.Canceled {
-				errChan <- fmt.Errorf("listener %s: %w", listener.Address(), err)
-			}
-		}(l)
-	}
+	s.mu.Unlock()
 
 	// Wait for context cancellation
 	<-ctx.Done()
 
 	s.logger.Info("server shutting down")
 
-	// Wait for all listeners to stop
-	wg.Wait()
+	// Wait for all listeners to stop, including any a reload removed
+	s.mu.Lock()
+	s.stopping = true
+	s.mu.Unlock()
+	s.wg.Wait()
 
 	// Check for any errors
-	close(errChan)
 	var firstErr error
-	for err := range errChan {
+	for _, err := range s.errs {
 		if firstErr == nil {
 			firstErr = err
 		}
@@ -139,6 +163,260 @@ func (s *Server) Run(ctx context.Context) error {
 	return ctx.Err()
 }
 
+// startListener runs a listener until the server's context is cancelled.
+// The caller must hold s.mu.
+func (s *Server) startListener(l *Listener) {
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		if err := l.Start(s.ctx); err != nil && err != context.Canceled {
+			s.mu.Lock()
+			s.errs = append(s.errs, fmt.Errorf("listener %s: %w", l.Address(), err))
+			s.mu.Unlock()
+		}
+	}()
+}
+
+// Reload applies a new configuration to the running server. The connection
+// limits and timeouts are updated, and listeners are added or removed to match
+// cfg.Listeners; a listener whose address stays keeps its socket and takes
+// the new settings. Sessions in progress are not affected, including those
+// on removed listeners. If any part of cfg cannot be applied, nothing is
+// changed and an error is returned.
+func (s *Server) Reload(cfg *config.Config) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.ctx == nil || s.stopping {
+		return errors.New("server is not running")
+	}
+
+	limits, err := NewIPLimits(cfg.Limits)
+	if err != nil {
+		return err
+	}
+
+	// Sockets from the service manager cannot be added or removed; they
+	// only take the new settings.
+	if len(s.activated) > 0 {
+		updates := make([]ListenerConfig, len(s.listeners))
+		for i, l := range s.listeners {
+			lc := settingsForMode(cfg, l.Mode())
+			lc.Address = l.Address()
+			listenerCfg, err := s.listenerConfig(cfg, lc)
+			if err != nil {
+				return err
+			}
+			updates[i] = listenerCfg
+		}
+		s.apply(cfg, limits)
+		for i, l := range s.listeners {
+			l.Update(updates[i])
+		}
+		s.logger.Info("configuration reloaded")
+		return nil
+	}
+
+	plan, err := s.planListeners(cfg)
+	if err != nil {
+		return err
+	}
+
+	s.apply(cfg, limits)
+	for l, listenerCfg := range plan.keep {
+		l.Update(listenerCfg)
+	}
+	for _, l := range plan.remove {
+		if err := l.Close(); err != nil {
+			s.logger.Debug("error closing listener",
+				slog.String("address", l.Address()),
+				slog.String("error", err.Error()),
+			)
+		}
+		s.logger.Info("listener removed", slog.String("address", l.Address()))
+	}
+
+	listeners := make([]*Listener, 0, len(cfg.Listeners))
+	for _, l := range s.listeners {
+		if _, ok := plan.keep[l]; ok {
+			listeners = append(listeners, l)
+		}
+	}
+	for _, listenerCfg := range plan.add {
+		l := NewListener(listenerCfg)
+		listeners = append(listeners, l)
+		s.startListener(l)
+	}
+	s.listeners = listeners
+
+	s.logger.Info("configuration reloaded",
+		slog.Int("listener_count", len(s.listeners)),
+		slog.Int("listeners_added", len(plan.add)),
+		slog.Int("listeners_removed", len(plan.remove)),
+	)
+	return nil
+}
+
+// listenerPlan is the set of listener changes a reload makes.
+type listenerPlan struct {
+	keep   map[*Listener]ListenerConfig
+	add    []ListenerConfig // with their sockets already bound
+	remove []*Listener
+}
+
+// planListeners works out the listener changes for cfg and binds the sockets
+// of new listeners, so that a failure leaves the server unchanged. The caller
+// must hold s.mu.
+func (s *Server) planListeners(cfg *config.Config) (listenerPlan, error) {
+	plan := listenerPlan{keep: make(map[*Listener]ListenerConfig)}
+	current := make(map[string]*Listener, len(s.listeners))
+	for _, l := range s.listeners {
+		current[l.Address()] = l
+	}
+
+	// Close the sockets bound so far if the plan fails
+	fail := func(err error) (listenerPlan, error) {
+		for _, listenerCfg := range plan.add {
+			_ = listenerCfg.Listener.Close()
+		}
+		return listenerPlan{}, err
+	}
+
+	for _, lc := range cfg.Listeners {
+		listenerCfg, err := s.listenerConfig(cfg, lc)
+		if err != nil {
+			return fail(err)
+		}
+		if l, ok := current[lc.Address]; ok {
+			if l.Mode() != lc.Mode {
+				return fail(fmt.Errorf("listener %s: changing mode requires a restart", lc.Address))
+			}
+			plan.keep[l] = listenerCfg
+			continue
+		}
+		ln, err := listen(lc.Address, lc.Mode, listenerCfg.SocketMode, listenerCfg.SocketGroup)
+		if err != nil {
+			return fail(fmt.Errorf("listener %s: %w", lc.Address, err))
+		}
+		listenerCfg.Listener = ln
+		plan.add = append(plan.add, listenerCfg)
+	}
+
+	for _, l := range s.listeners {
+		if _, ok := plan.keep[l]; !ok {
+			plan.remove = append(plan.remove, l)
+		}
+	}
+	return plan, nil
+}
+
+// apply makes cfg the server's configuration and updates the connection
+// limits. The caller must hold s.mu.
+func (s *Server) apply(cfg *config.Config, limits IPLimits) {
+	s.cfg = cfg
+	s.limiter.SetMax(cfg.Limits.MaxConnections)
+	s.ipLimiter.SetLimits(limits)
+}
+
+// listenerConfig builds the configuration of a listener from its section of
+// cfg.
+func (s *Server) listenerConfig(cfg *config.Config, lc config.ListenerConfig) (ListenerConfig, error) {
+	// Determine if this listener needs TLS
+	var tlsCfg *tls.Config
+	if lc.Mode == config.ModePop3s {
+		if s.tlsConfig == nil {
+			return ListenerConfig{}, fmt.Errorf("listener %s: TLS required for POP3S mode but not configured", lc.Address)
+		}
+		tlsCfg = s.tlsConfig
+	} else if s.tlsConfig != nil && lc.Mode != config.ModeUnix {
+		// Make TLS available for STLS on POP3 listeners. Unix sockets
+		// stay on the host and need none.
+		tlsCfg = s.tlsConfig
+	}
+
+	// Request or require client certificates on this listener only. Without
+	// a CA pool they would be verified against the system roots.
+	if tlsCfg != nil && lc.ClientAuthType() != tls.NoClientCert {
+		if tlsCfg.ClientCAs == nil {
+			return ListenerConfig{}, fmt.Errorf("listener %s: client_auth requires a client CA pool", lc.Address)
+		}
+		tlsCfg = tlsCfg.Clone()
+		tlsCfg.ClientAuth = lc.ClientAuthType()
+	}
+
+	trusted, err := parseTrustedProxies(lc.ProxyTrusted)
+	if err != nil {
+		return ListenerConfig{}, fmt.Errorf("listener %s: %w", lc.Address, err)
+	}
+
+	// Server-wide access rules come before the listener's own
+	access, err := NewAccessList(cfg.Access, lc.Access)
+	if err != nil {
+		return ListenerConfig{}, fmt.Errorf("listener %s: %w", lc.Address, err)
+	}
+
+	// The listener's own timeouts, where set, override the server's
+	timeouts := lc.EffectiveTimeouts(cfg.Timeouts)
+
+	return ListenerConfig{
+		Address:        lc.Address,
+		Mode:           lc.Mode,
+		TLSConfig:      tlsCfg,
+		PreAuthTimeout: timeouts.PreAuthTimeout(),
+		IdleTimeout:    timeouts.IdleTimeout(),
+		WriteTimeout:   timeouts.WriteTimeout(),
+		SessionTimeout: timeouts.SessionTimeout(),
+		MaxAuthLine:    cfg.Limits.MaxAuthLine,
+		MaxBadCommands: cfg.Limits.MaxBadCommands,
+		LogTransaction: cfg.LogLevel == "debug",
+		Logger:         s.logger,
+		Handler:        s.handler,
+		Limiter:        s.limiter,
+		IPLimiter:      s.ipLimiter,
+		Banned:         s.banned,
+		Collector:      s.collector,
+		MaxConnections: lc.MaxConnections,
+		Options:        lc,
+		SocketMode:     lc.SocketPermissions(),
+		SocketGroup:    lc.SocketGroup,
+		DrainTimeout:   timeouts.DrainTimeout(),
+		ProxyProtocol:  lc.ProxyProtocol,
+		ProxyTrusted:   trusted,
+		Access:         access,
+	}, nil
+}
+
+// settingsForMode returns the configuration of the first listener in cfg
+// with the given mode, so that an activated socket gets the same
+// per-listener settings (client_auth, timeouts, ...) as the listener it
+// replaces. Without one, the defaults apply.
+func settingsForMode(cfg *config.Config, mode config.ListenerMode) config.ListenerConfig {
+	for _, lc := range cfg.Listeners {
+		if lc.Mode == mode {
+			return lc
+		}
+	}
+	return config.ListenerConfig{Mode: mode}
+}
+
+// CheckAccess applies the server-wide access rules and those of the
+// listener for mode to the client at addr, for a connection that did not
+// arrive through a listener, such as one passed by inetd. An address that
+// is not an IP address is allowed, as on a listener.
+func (s *Server) CheckAccess(addr net.Addr, mode config.ListenerMode) (allowed bool, rule string, err error) {
+	cfg := s.Config()
+	access, err := NewAccessList(cfg.Access, settingsForMode(cfg, mode).Access)
+	if err != nil {
+		return false, "", err
+	}
+	ip, ok := remoteIP(addr)
+	if !ok {
+		return true, "", nil
+	}
+	allowed, rule = access.Check(ip)
+	return allowed, rule, nil
+}
+
 // Shutdown gracefully stops the server.
 // It closes all listeners and waits for connections to complete.
 func (s *Server) Shutdown() {
@@ -162,6 +440,8 @@ func (s *Server) TLSConfig() *tls.Config {
 
 // Config returns the server's configuration.
 func (s *Server) Config() *config.Config {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	return s.cfg
 }
 
@@ -0,0 +1,239 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/infodancer/pop3d/internal/config"
+)
+
+// freeAddress returns a loopback address with a port that was free a moment ago.
+func freeAddress(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+// greets reports whether a POP3 greeting is served at addr.
+func greets(addr string) bool {
+	c, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		return false
+	}
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(time.Second))
+	line, err := bufio.NewReader(c).ReadString('\n')
+	return err == nil && line == "+OK\r\n"
+}
+
+// startServer runs a server with a listener on each address and waits until
+// they accept connections.
+func startServer(t *testing.T, addrs ...string) *Server {
+	t.Helper()
+	cfg := config.Default()
+	cfg.Listeners = nil
+	for _, a := range addrs {
+		cfg.Listeners = append(cfg.Listeners, config.ListenerConfig{Address: a, Mode: config.ModePop3})
+	}
+	srv, err := New(Config{Cfg: &cfg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv.SetHandler(func(ctx context.Context, conn *Connection) {
+		_, _ = conn.Writer().WriteString("+OK\r\n")
+		_ = conn.Flush()
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_ = srv.Run(ctx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	for _, a := range addrs {
+		deadline := time.Now().Add(5 * time.Second)
+		for !greets(a) {
+			if time.Now().After(deadline) {
+				t.Fatalf("listener %s did not start", a)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	return srv
+}
+
+// reloadConfig copies the server's configuration with new listeners.
+func reloadConfig(srv *Server, addrs ...string) *config.Config {
+	cfg := *srv.Config()
+	cfg.Listeners = nil
+	for _, a := range addrs {
+		cfg.Listeners = append(cfg.Listeners, config.ListenerConfig{Address: a, Mode: config.ModePop3})
+	}
+	return &cfg
+}
+
+func TestServerReloadAddsAndRemovesListeners(t *testing.T) {
+	a, b := freeAddress(t), freeAddress(t)
+	srv := startServer(t, a)
+
+	if err := srv.Reload(reloadConfig(srv, a, b)); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if !greets(a) || !greets(b) {
+		t.Fatal("both listeners should accept after adding one")
+	}
+
+	if err := srv.Reload(reloadConfig(srv, b)); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if greets(a) {
+		t.Error("removed listener still accepts connections")
+	}
+	if !greets(b) {
+		t.Error("kept listener stopped accepting connections")
+	}
+}
+
+func TestServerReloadRejectsInvalidConfig(t *testing.T) {
+	a, b := freeAddress(t), freeAddress(t)
+	srv := startServer(t, a)
+
+	// POP3S without TLS cannot be applied; the new plain listener must not
+	// be started either.
+	cfg := reloadConfig(srv, b)
+	cfg.Listeners = append(cfg.Listeners, config.ListenerConfig{Address: freeAddress(t), Mode: config.ModePop3s})
+	cfg.Limits.MaxConnections = 1
+	if err := srv.Reload(cfg); err == nil {
+		t.Fatal("Reload should fail")
+	}
+
+	if !greets(a) {
+		t.Error("existing listener stopped after a failed reload")
+	}
+	if greets(b) {
+		t.Error("listener from a failed reload accepts connections")
+	}
+	if srv.Config().Limits.MaxConnections == 1 {
+		t.Error("configuration from a failed reload was applied")
+	}
+}
+
+func TestServerReloadRejectsModeChange(t *testing.T) {
+	a := freeAddress(t)
+	srv := startServer(t, a)
+
+	cfg := reloadConfig(srv, a)
+	cfg.Listeners[0].Mode = config.ModePop3s
+	if err := srv.Reload(cfg); err == nil {
+		t.Fatal("Reload should refuse to change a listener's mode")
+	}
+}
+
+func TestServerReloadUpdatesLimit(t *testing.T) {
+	a := freeAddress(t)
+	srv := startServer(t, a)
+
+	cfg := reloadConfig(srv, a)
+	cfg.Limits.MaxConnections = 7
+	if err := srv.Reload(cfg); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if got := srv.limiter.maxConnections.Load(); got != 7 {
+		t.Errorf("connection limit = %d, want 7", got)
+	}
+}
+
+func TestServerListenerMaxConnections(t *testing.T) {
+	a := freeAddress(t)
+	srv := startServer(t, a)
+
+	cfg := reloadConfig(srv, a)
+	cfg.Listeners[0].MaxConnections = 1
+	if err := srv.Reload(cfg); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	// Take the listener's only slot, as a session in progress would.
+	srv.mu.Lock()
+	srv.listeners[0].ownLimiter.TryAcquire()
+	srv.mu.Unlock()
+
+	c, err := net.DialTimeout("tcp", a, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(time.Second))
+	line, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil || !strings.HasPrefix(line, "-ERR [SYS/TEMP]") {
+		t.Errorf("over the listener limit got %q, %v; want a busy response", line, err)
+	}
+}
+
+func TestServerReloadUpdatesAccessRules(t *testing.T) {
+	a := freeAddress(t)
+	srv := startServer(t, a)
+
+	cfg := reloadConfig(srv, a)
+	cfg.Listeners[0].Access = []string{"deny 127.0.0.0/8"}
+	if err := srv.Reload(cfg); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+
+	c, err := net.DialTimeout("tcp", a, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	_ = c.SetDeadline(time.Now().Add(time.Second))
+	line, err := bufio.NewReader(c).ReadString('\n')
+	if err != nil || line != "-ERR [SYS/PERM] Connections from your address are not permitted\r\n" {
+		t.Errorf("denied address got %q, %v; want an access denied response", line, err)
+	}
+
+	cfg = reloadConfig(srv, a)
+	cfg.Access = []string{"allow 127.0.0.1"}
+	cfg.Listeners[0].Access = []string{"deny all"}
+	if err := srv.Reload(cfg); err != nil {
+		t.Fatalf("Reload: %v", err)
+	}
+	if !greets(a) {
+		t.Error("address allowed by a server-wide rule was rejected")
+	}
+}
+
+func TestListenerClientAuthRequiresCAPool(t *testing.T) {
+	cfg := config.Default()
+	srv, err := New(Config{Cfg: &cfg, TLSConfig: &tls.Config{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	lc := config.ListenerConfig{Address: "127.0.0.1:0", Mode: config.ModePop3s, ClientAuth: "require"}
+	if _, err := srv.listenerConfig(&cfg, lc); err == nil {
+		t.Error("client_auth accepted without a client CA pool")
+	}
+
+	srv.tlsConfig.ClientCAs = x509.NewCertPool()
+	got, err := srv.listenerConfig(&cfg, lc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.TLSConfig.ClientAuth != tls.RequireAndVerifyClientCert {
+		t.Errorf("ClientAuth = %v, want RequireAndVerifyClientCert", got.TLSConfig.ClientAuth)
+	}
+}
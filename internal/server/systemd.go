@@ -0,0 +1,85 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/infodancer/pop3d/internal/config"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd socket activation.
+const listenFDsStart = 3
+
+// ActivatedListener is a listening socket passed in by the service manager.
+type ActivatedListener struct {
+	// Name is the socket's FileDescriptorName.
+	Name string
+	// Mode is the listener mode named by Name.
+	Mode     config.ListenerMode
+	Listener net.Listener
+}
+
+// ActivationListeners returns the listeners passed by systemd socket
+// activation (LISTEN_PID, LISTEN_FDS and LISTEN_FDNAMES), or nil if the
+// process was not socket-activated. Each socket's FileDescriptorName must be
+// a listener mode, "pop3", "pop3s" or "unix". The environment variables are
+// unset so that child processes do not inherit them.
+func ActivationListeners() ([]ActivatedListener, error) {
+	listeners, err := activationListeners(os.Getenv, os.Getpid(), listenFDsStart)
+	for _, v := range []string{"LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES"} {
+		_ = os.Unsetenv(v)
+	}
+	return listeners, err
+}
+
+// activationListeners implements ActivationListeners for the given
+// environment, process ID and first descriptor.
+func activationListeners(getenv func(string) string, pid, start int) ([]ActivatedListener, error) {
+	if getenv("LISTEN_PID") != strconv.Itoa(pid) {
+		return nil, nil
+	}
+	n, err := strconv.Atoi(getenv("LISTEN_FDS"))
+	if err != nil || n <= 0 {
+		return nil, nil
+	}
+
+	var names []string
+	if v := getenv("LISTEN_FDNAMES"); v != "" {
+		names = strings.Split(v, ":")
+	}
+
+	listeners := make([]ActivatedListener, 0, n)
+	closeAll := func() {
+		for _, l := range listeners {
+			_ = l.Listener.Close()
+		}
+	}
+	for i := 0; i < n; i++ {
+		fd := start + i
+		name := "unknown"
+		if i < len(names) {
+			name = names[i]
+		}
+
+		mode := config.ListenerMode(name)
+		if mode != config.ModePop3 && mode != config.ModePop3s && mode != config.ModeUnix {
+			closeAll()
+			return nil, fmt.Errorf("socket %d: name %q is not a listener mode; set FileDescriptorName=pop3, pop3s or unix", fd, name)
+		}
+
+		syscall.CloseOnExec(fd)
+		f := os.NewFile(uintptr(fd), name)
+		ln, err := net.FileListener(f)
+		_ = f.Close() // FileListener holds its own copy of the descriptor
+		if err != nil {
+			closeAll()
+			return nil, fmt.Errorf("socket %d (%s): %w", fd, name, err)
+		}
+		listeners = append(listeners, ActivatedListener{Name: name, Mode: mode, Listener: ln})
+	}
+	return listeners, nil
+}
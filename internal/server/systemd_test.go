@@ -0,0 +1,82 @@
+package server
+
+import (
+	"net"
+	"strconv"
+	"syscall"
+	"testing"
+
+	"github.com/infodancer/pop3d/internal/config"
+)
+
+// listenerFD returns a descriptor for a new TCP listener, and its address.
+// The descriptor is owned by the caller, like one passed in by systemd.
+func listenerFD(t *testing.T) (int, string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	f, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fd, ln.Addr().String()
+}
+
+func TestActivationListeners(t *testing.T) {
+	env := func(vars map[string]string) func(string) string {
+		return func(k string) string { return vars[k] }
+	}
+
+	t.Run("not activated", func(t *testing.T) {
+		listeners, err := activationListeners(env(nil), 1234, listenFDsStart)
+		if err != nil || listeners != nil {
+			t.Errorf("activationListeners() = %v, %v; want nil, nil", listeners, err)
+		}
+	})
+
+	t.Run("another process", func(t *testing.T) {
+		listeners, err := activationListeners(env(map[string]string{"LISTEN_PID": "99", "LISTEN_FDS": "1"}), 1234, listenFDsStart)
+		if err != nil || listeners != nil {
+			t.Errorf("activationListeners() = %v, %v; want nil, nil", listeners, err)
+		}
+	})
+
+	t.Run("named socket", func(t *testing.T) {
+		fd, addr := listenerFD(t)
+		listeners, err := activationListeners(env(map[string]string{
+			"LISTEN_PID":     "1234",
+			"LISTEN_FDS":     "1",
+			"LISTEN_FDNAMES": "pop3s",
+		}), 1234, fd)
+		if err != nil {
+			t.Fatalf("activationListeners() error = %v", err)
+		}
+		if len(listeners) != 1 {
+			t.Fatalf("got %d listeners, want 1", len(listeners))
+		}
+		defer listeners[0].Listener.Close()
+		if listeners[0].Mode != config.ModePop3s || listeners[0].Listener.Addr().String() != addr {
+			t.Errorf("listener = %s on %s, want pop3s on %s", listeners[0].Mode, listeners[0].Listener.Addr(), addr)
+		}
+	})
+
+	t.Run("unnamed socket", func(t *testing.T) {
+		fd, _ := listenerFD(t)
+		defer syscall.Close(fd)
+		_, err := activationListeners(env(map[string]string{
+			"LISTEN_PID": "1234",
+			"LISTEN_FDS": strconv.Itoa(1),
+		}), 1234, fd)
+		if err == nil {
+			t.Error("activationListeners() accepted a socket without a mode name")
+		}
+	})
+}
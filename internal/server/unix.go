@@ -0,0 +1,75 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+
+	"github.com/infodancer/pop3d/internal/config"
+)
+
+// PeerCredentials identify the process at the other end of a Unix-domain
+// socket, as reported by the kernel.
+type PeerCredentials struct {
+	PID int32
+	UID uint32
+	GID uint32
+}
+
+// listen opens the socket of a listener: a TCP socket, or for unix mode a
+// socket file with the given permissions and group.
+func listen(address string, mode config.ListenerMode, perm os.FileMode, group string) (net.Listener, error) {
+	if mode != config.ModeUnix {
+		return net.Listen("tcp", address)
+	}
+	return listenUnix(address, perm, group)
+}
+
+// listenUnix creates a Unix-domain socket at path, replacing a socket left
+// behind by an earlier run. Anything else at path is left alone.
+func listenUnix(path string, perm os.FileMode, group string) (net.Listener, error) {
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := setSocketPermissions(path, perm, group); err != nil {
+		_ = ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// setSocketPermissions applies the mode and, if set, the group of a socket
+// file. The group is a name or a numeric ID.
+func setSocketPermissions(path string, perm os.FileMode, group string) error {
+	if group != "" {
+		gid, err := strconv.Atoi(group)
+		if err != nil {
+			g, err := user.LookupGroup(group)
+			if err != nil {
+				return fmt.Errorf("socket group: %w", err)
+			}
+			if gid, err = strconv.Atoi(g.Gid); err != nil {
+				return fmt.Errorf("socket group %s: %w", group, err)
+			}
+		}
+		if err := os.Chown(path, -1, gid); err != nil {
+			return fmt.Errorf("socket group: %w", err)
+		}
+	}
+	if err := os.Chmod(path, perm); err != nil {
+		return fmt.Errorf("socket mode: %w", err)
+	}
+	return nil
+}
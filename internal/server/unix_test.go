@@ -0,0 +1,86 @@
+package server
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/infodancer/pop3d/internal/config"
+)
+
+func TestListenUnix(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pop3.sock")
+
+	// A socket left behind by an earlier run is replaced.
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	ln, err := listen(path, config.ModeUnix, 0o600, "")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		t.Errorf("%s is not a socket", path)
+	}
+	if perm := fi.Mode().Perm(); perm != 0o600 {
+		t.Errorf("socket mode = %v, want 0600", perm)
+	}
+}
+
+func TestListenUnixRefusesOtherFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "pop3.sock")
+	if err := os.WriteFile(path, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if ln, err := listen(path, config.ModeUnix, 0o600, ""); err == nil {
+		ln.Close()
+		t.Fatal("listen replaced a regular file")
+	}
+}
+
+func TestConnectionPeerCredentials(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("SO_PEERCRED is Linux only")
+	}
+	path := filepath.Join(t.TempDir(), "pop3.sock")
+	ln, err := listen(path, config.ModeUnix, 0o600, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	client, err := net.Dial("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	accepted, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := NewConnection(accepted, ConnectionConfig{})
+	defer conn.Close()
+
+	if !conn.IsUnix() {
+		t.Error("IsUnix() = false on a unix socket")
+	}
+	creds, ok := conn.PeerCredentials()
+	if !ok {
+		t.Fatal("PeerCredentials() not available")
+	}
+	if creds.UID != uint32(os.Getuid()) || creds.GID != uint32(os.Getgid()) || creds.PID != int32(os.Getpid()) {
+		t.Errorf("PeerCredentials() = %+v, want this process", creds)
+	}
+}